@@ -0,0 +1,229 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// adminResult is the reply to an admin message.
+type adminResult struct {
+	Command string `json:"command"` // msg_type of the admin message
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// metrics counts what the bridge did while enabled by admin-metrics.
+type metrics struct {
+	Prompts       int     `json:"prompts"`
+	PromptSeconds float64 `json:"promptSeconds"`
+	ToolCalls     int     `json:"toolCalls"`
+	ToolFailures  int     `json:"toolFailures"`
+
+	FirstToken *latencyStats `json:"firstToken,omitempty"` // of the last prompts, also before metrics were enabled
+}
+
+// The methods of metrics do nothing on a nil metrics, so callers need not
+// check whether metrics are enabled.
+
+func (m *metrics) prompt(d time.Duration) {
+	if m != nil {
+		m.Prompts++
+		m.PromptSeconds += d.Seconds()
+	}
+}
+
+func (m *metrics) toolResult(isError bool) {
+	if m == nil {
+		return
+	}
+	m.ToolCalls++
+	if isError {
+		m.ToolFailures++
+	}
+}
+
+// selfCheck is one check of admin-self-test.
+type selfCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// handleAdmin runs an admin message and sends the result to remote. Admin
+// messages are ignored unless enabled with Config.Admin. Restarting a server
+// recreates host, so the host to use from then on is returned.
+func (b *Bridge) handleAdmin(ctx context.Context, host Host, msg Message) (Host, error) {
+	if !b.conf.Admin {
+		slog.Warn("admin messages are not enabled", "MsgType", msg.MsgType)
+		return host, nil
+	}
+	res := adminResult{Command: msg.MsgType, OK: true}
+	var err error
+	switch msg.MsgType {
+	case msgTypeSetLogLevel:
+		err = b.setLogLevel(msg.Content)
+	case msgTypeAdminMetrics:
+		res.Data = b.toggleMetrics(msg.Content)
+	case msgTypeSelfTest:
+		checks := b.selfTest(ctx, host)
+		for _, c := range checks {
+			res.OK = res.OK && c.OK
+		}
+		res.Data = checks
+	case msgTypeRestartServer:
+		host, err = b.restartServer(ctx, host, msg.Content)
+	}
+	if err != nil {
+		res.OK, res.Error = false, err.Error()
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return host, err
+	}
+	return host, b.send(Message{MsgType: msgTypeAdminResult, Content: string(data)})
+}
+
+func (b *Bridge) setLogLevel(name string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	if b.conf.SetLogLevel == nil {
+		return fmt.Errorf("the log level cannot be changed")
+	}
+	b.conf.SetLogLevel(level)
+	slog.Info("log level changed", "level", level)
+	return nil
+}
+
+// toggleMetrics turns metrics on or off, or leaves them if state is empty,
+// and returns the metrics if on.
+func (b *Bridge) toggleMetrics(state string) any {
+	switch state {
+	case "on":
+		if b.metrics == nil {
+			b.metrics = &metrics{}
+		}
+	case "off":
+		b.metrics = nil
+	}
+	if b.metrics == nil {
+		return nil
+	}
+	m := *b.metrics
+	m.FirstToken = b.firstTokens.stats()
+	return m
+}
+
+// selfTest checks the model and the MCP servers the bridge can reach.
+func (b *Bridge) selfTest(ctx context.Context, host Host) []selfCheck {
+	model := host.GetModelString()
+	checks := []selfCheck{{Name: "model", OK: model != "", Detail: model}}
+	if _, ok := ollamaModel(model); ok {
+		check := selfCheck{Name: "ollama", OK: true}
+		client, err := ollamaClient()
+		if err == nil {
+			err = client.Heartbeat(ctx)
+		}
+		if err != nil {
+			check.OK, check.Detail = false, err.Error()
+		}
+		checks = append(checks, check)
+	}
+	servers, err := loadMCPServers(b.options.ConfigFile)
+	if err != nil {
+		return append(checks, selfCheck{Name: "config", Detail: err.Error()})
+	}
+	tools := b.getToolbox(ctx, b.options.ConfigFile)
+	for _, name := range slices.Sorted(maps.Keys(servers)) {
+		check := selfCheck{Name: "server " + name}
+		if _, ok := tools.clients[name]; ok {
+			count := 0
+			for tool := range tools.tools {
+				if strings.HasPrefix(tool, name+"__") {
+					count++
+				}
+			}
+			check.OK, check.Detail = true, fmt.Sprintf("%d tools", count)
+		} else {
+			check.Detail = "not connected, see the log"
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// restartServer restarts the MCP server name. The SDK cannot restart a
+// single server, so the hosts whose configuration has it are recreated,
+// keeping their conversations. Hosts of scheduled jobs are left alone.
+func (b *Bridge) restartServer(ctx context.Context, host Host, name string) (Host, error) {
+	restarted := false
+	restart := func(agent string, old Host) (Host, error) {
+		opts, err := b.agentOptions(agent)
+		if err != nil {
+			return old, err
+		}
+		servers, err := loadMCPServers(opts.ConfigFile)
+		if _, ok := servers[name]; err != nil || !ok {
+			return old, err
+		}
+		h, err := b.newHost(ctx, &opts)
+		if err != nil {
+			return old, err
+		}
+		if err := h.ReplaceMessages(old.Messages()); err != nil {
+			h.Close()
+			return old, err
+		}
+		old.Close()
+		restarted = true
+		return h, nil
+	}
+	host, err := restart(defaultAgent, host)
+	if err != nil {
+		return host, err
+	}
+	for agent, h := range b.agentHosts {
+		if b.agentHosts[agent], err = restart(agent, h); err != nil {
+			return host, err
+		}
+	}
+	for _, s := range b.sessions {
+		if s.host, err = restart(s.agent, s.host); err != nil {
+			return host, err
+		}
+	}
+	b.toolsMu.Lock()
+	defer b.toolsMu.Unlock()
+	if b.tools != nil {
+		servers, _ := loadMCPServers(b.options.ConfigFile)
+		ok, err := b.tools.restart(ctx, name, servers)
+		if err != nil {
+			return host, err
+		}
+		restarted = restarted || ok
+	}
+	for _, s := range b.sessions {
+		if s.tools == nil {
+			continue
+		}
+		servers, _ := loadMCPServers(s.config)
+		ok, err := s.tools.restart(ctx, name, servers)
+		if err != nil {
+			return host, err
+		}
+		restarted = restarted || ok
+	}
+	if !restarted {
+		return host, fmt.Errorf("no running server %q", name)
+	}
+	slog.Info("restarted MCP server", "server", name)
+	return host, nil
+}
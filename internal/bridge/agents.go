@@ -0,0 +1,113 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/mark3labs/mcphost/sdk"
+)
+
+const (
+	defaultAgent = "default" // the host created from the command line flags
+
+	routerPrompt = "You route requests to the best suited assistant. " +
+		"Answer with the name of exactly one assistant and nothing else."
+)
+
+// agentProfile configures a specialized assistant with its own model, tools
+// and system prompt. Empty fields default to the command line flags.
+type agentProfile struct {
+	Description  string `json:"description"` // shown to the router model
+	Model        string `json:"model"`
+	SystemPrompt string `json:"systemPrompt"`
+	ConfigFile   string `json:"configFile"` // mcphost configuration with the MCP servers of this agent
+}
+
+// agentOptions returns the host options of an agent profile, with the model
+// switched to if any.
+func (b *Bridge) agentOptions(name string) (sdk.Options, error) {
+	opts := b.options
+	if name == defaultAgent {
+		if model, ok := b.models[name]; ok {
+			opts.Model = model
+		}
+		return opts, nil
+	}
+	profile, ok := b.bridgeConf.Agents[name]
+	if !ok {
+		return opts, fmt.Errorf("unknown agent %q", name)
+	}
+	if profile.Model != "" {
+		opts.Model = profile.Model
+	}
+	if model, ok := b.models[name]; ok {
+		opts.Model = model
+	}
+	if profile.SystemPrompt != "" {
+		opts.SystemPrompt = b.withToolDocs(profile.SystemPrompt)
+	}
+	if profile.ConfigFile != "" {
+		var err error
+		opts.ConfigFile, err = b.confinedConfig(profile.ConfigFile)
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func (b *Bridge) agentHost(ctx context.Context, name string) (Host, error) {
+	if host, ok := b.agentHosts[name]; ok {
+		return host, nil
+	}
+	opts, err := b.agentOptions(name)
+	if err != nil {
+		return nil, err
+	}
+	host, err := b.newCheckedHost(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+	b.agentHosts[name] = host
+	return host, nil
+}
+
+func (b *Bridge) closeAgentHosts() {
+	for name, host := range b.agentHosts {
+		host.Close()
+		delete(b.agentHosts, name)
+	}
+}
+
+// routeAgent asks the router model which agent should answer prompt. It
+// falls back to the default agent if the answer is not an agent name.
+func (b *Bridge) routeAgent(ctx context.Context, routerModel, prompt string) string {
+	var list strings.Builder
+	fmt.Fprintf(&list, "Assistants:\n- %s: general system administration\n", defaultAgent)
+	for _, name := range slices.Sorted(maps.Keys(b.bridgeConf.Agents)) {
+		fmt.Fprintf(&list, "- %s: %s\n", name, b.bridgeConf.Agents[name].Description)
+	}
+	fmt.Fprintf(&list, "\nRequest:\n%s\n\nWhich assistant should handle the request?", prompt)
+
+	router, err := b.helperHost(ctx, routerModel, routerPrompt)
+	if err != nil {
+		slog.Warn("creating router", "err", err)
+		return defaultAgent
+	}
+	defer router.ClearSession()
+	answer, err := router.Prompt(ctx, list.String())
+	if err != nil {
+		slog.Warn("routing prompt", "err", err)
+		return defaultAgent
+	}
+	name := strings.Trim(strings.TrimSpace(answer), "`'\".")
+	if _, ok := b.bridgeConf.Agents[name]; !ok {
+		slog.Debug("router answered no known agent", "answer", answer)
+		return defaultAgent
+	}
+	return name
+}
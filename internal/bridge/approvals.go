@@ -0,0 +1,215 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const allTools = "*" // decision key matching every tool
+
+// scopes of an allow or deny reply from remote
+const (
+	scopeOnce     = "once"     // only this tool call, the default
+	scopeSession  = "session"  // until the bridge exits, in the session of the call
+	scopeAlways   = "always"   // persisted in the approvals file
+	scopeDuration = "duration" // for the duration given in the reply
+)
+
+type decision struct {
+	Allow bool      `json:"allow"`
+	Until time.Time `json:"-"` // zero for no expiry
+}
+
+// callPattern matches the tool calls an allow-tool-always reply approved.
+type callPattern struct {
+	args     string            // the approved arguments as canonical JSON, if there are no patterns
+	patterns map[string]string // path.Match patterns of the values of the named arguments
+}
+
+// matches reports whether a call with args matches p. Arguments without a
+// pattern may have any value.
+func (p callPattern) matches(args string) bool {
+	if p.patterns == nil {
+		return canonicalArgs(args) == p.args
+	}
+	values := map[string]any{}
+	if strings.TrimSpace(args) != "" && json.Unmarshal([]byte(args), &values) != nil {
+		return false
+	}
+	for name, pattern := range p.patterns {
+		value, ok := values[name]
+		if !ok {
+			return false
+		}
+		s, isString := value.(string)
+		if !isString {
+			data, _ := json.Marshal(value)
+			s = string(data)
+		}
+		if ok, _ := path.Match(pattern, s); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalArgs returns arguments as JSON with sorted keys and no spaces, so
+// identical calls compare equal.
+func canonicalArgs(args string) string {
+	var value any = map[string]any{}
+	if strings.TrimSpace(args) != "" && json.Unmarshal([]byte(args), &value) != nil {
+		return args
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return args
+	}
+	return string(data)
+}
+
+// decisionCache remembers allow and deny replies from remote that were given
+// with a scope beyond a single tool call.
+type decisionCache struct {
+	decisions map[string]decision // scope session and duration, keyed by tool name or allTools
+	always    map[string]decision // scope always, keyed like decisions
+	path      string              // file for scope always, empty to keep them in memory only
+
+	// calls are the calls allowed with allow-tool-always until the bridge
+	// exits, keyed by tool name.
+	calls map[string][]callPattern
+}
+
+func loadDecisionCache(path string) (*decisionCache, error) {
+	c := &decisionCache{decisions: map[string]decision{}, always: map[string]decision{}, path: path, calls: map[string][]callPattern{}}
+	if path == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &c.always)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// forSession returns a cache for the approvals of a session. It shares the
+// decisions with scope always with c, the others start empty.
+func (c *decisionCache) forSession() *decisionCache {
+	return &decisionCache{decisions: map[string]decision{}, always: c.always, path: c.path, calls: map[string][]callPattern{}}
+}
+
+// clone returns a cache for a session forked from the one of c, starting
+// with the same approvals.
+func (c *decisionCache) clone() *decisionCache {
+	s := c.forSession()
+	maps.Copy(s.decisions, c.decisions)
+	for tool, patterns := range c.calls {
+		s.calls[tool] = slices.Clone(patterns)
+	}
+	return s
+}
+
+// lookup returns the remembered decision for a call of tool with args, if
+// there is one.
+func (c *decisionCache) lookup(tool, args string) (allow, found bool) {
+	for _, p := range c.calls[tool] {
+		if p.matches(args) {
+			return true, true
+		}
+	}
+	d, _, found := c.grant(tool)
+	return d.Allow, found
+}
+
+// grant returns the remembered decision for all calls of tool and its scope,
+// if there is one.
+func (c *decisionCache) grant(tool string) (d decision, scope string, found bool) {
+	now := time.Now()
+	for _, key := range []string{tool, allTools} {
+		if d, ok := c.always[key]; ok {
+			return d, scopeAlways, true
+		}
+		d, ok := c.decisions[key]
+		if !ok {
+			continue
+		}
+		if d.Until.IsZero() {
+			return d, scopeSession, true
+		}
+		if now.Before(d.Until) {
+			return d, scopeDuration, true
+		}
+		delete(c.decisions, key)
+	}
+	return decision{}, "", false
+}
+
+// record remembers a reply for the given scope. duration is only used with
+// scopeDuration and has the format of time.ParseDuration.
+func (c *decisionCache) record(tool string, allow bool, scope, duration string) error {
+	switch scope {
+	case "", scopeOnce:
+		return nil
+	case scopeSession:
+		c.decisions[tool] = decision{Allow: allow}
+		return nil
+	case scopeAlways:
+		c.always[tool] = decision{Allow: allow}
+		return c.save()
+	case scopeDuration:
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("duration must be positive: %s", duration)
+		}
+		c.decisions[tool] = decision{Allow: allow, Until: time.Now().Add(d)}
+		return nil
+	default:
+		return fmt.Errorf("unknown scope %q", scope)
+	}
+}
+
+// allowCalls remembers an allow-tool-always reply to a call of tool with
+// args. Without patterns only identical calls are allowed.
+func (c *decisionCache) allowCalls(tool, args string, patterns json.RawMessage) error {
+	p := callPattern{args: canonicalArgs(args)}
+	if len(patterns) > 0 {
+		if err := json.Unmarshal(patterns, &p.patterns); err != nil {
+			return fmt.Errorf("argument patterns must be a JSON object of strings: %w", err)
+		}
+		for name, pattern := range p.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("argument %s: %w", name, err)
+			}
+		}
+	}
+	c.calls[tool] = append(c.calls[tool], p)
+	return nil
+}
+
+// save writes the decisions with scope always to the approvals file.
+func (c *decisionCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(c.always, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, b, 0o600)
+}
@@ -0,0 +1,225 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// file extensions for fenced code block languages the model commonly uses
+var languageExtensions = map[string]string{
+	"bash":       ".sh",
+	"sh":         ".sh",
+	"shell":      ".sh",
+	"zsh":        ".sh",
+	"python":     ".py",
+	"py":         ".py",
+	"go":         ".go",
+	"javascript": ".js",
+	"js":         ".js",
+	"typescript": ".ts",
+	"ts":         ".ts",
+	"json":       ".json",
+	"yaml":       ".yaml",
+	"yml":        ".yaml",
+	"toml":       ".toml",
+	"ini":        ".ini",
+	"xml":        ".xml",
+	"html":       ".html",
+	"css":        ".css",
+	"sql":        ".sql",
+	"dockerfile": ".dockerfile",
+	"nginx":      ".conf",
+	"conf":       ".conf",
+	"systemd":    ".service",
+	"perl":       ".pl",
+	"ruby":       ".rb",
+	"rust":       ".rs",
+	"c":          ".c",
+	"cpp":        ".cpp",
+	"java":       ".java",
+	"makefile":   ".mk",
+	"diff":       ".diff",
+	"patch":      ".patch",
+}
+
+type codeBlock struct {
+	Language string
+	Filename string // suggested by the model in the fence info string, may be empty
+	Content  string
+}
+
+// extractCodeBlocks returns the fenced code blocks of a markdown text.
+// Fences like ```bash, ```bash install.sh, ```yaml:config.yaml and
+// ```python title="main.py" are understood. An unterminated block is ignored.
+func extractCodeBlocks(text string) []codeBlock {
+	var blocks []codeBlock
+	var current *codeBlock
+	var fence string
+	var body strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if current == nil {
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				fence = trimmed[:3]
+				current = parseFenceInfo(strings.TrimSpace(trimmed[3:]))
+				body.Reset()
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			current.Content = body.String()
+			blocks = append(blocks, *current)
+			current = nil
+			continue
+		}
+		body.WriteString(line)
+		body.WriteString("\n")
+	}
+	return blocks
+}
+
+func parseFenceInfo(info string) *codeBlock {
+	block := &codeBlock{}
+	fields := strings.Fields(info)
+	if len(fields) == 0 {
+		return block
+	}
+	lang, name, found := strings.Cut(fields[0], ":")
+	block.Language = strings.ToLower(lang)
+	if found {
+		block.Filename = name
+	}
+	for _, f := range fields[1:] {
+		key, value, found := strings.Cut(f, "=")
+		if !found {
+			value = key
+		} else if key != "title" && key != "filename" && key != "file" {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		if strings.Contains(value, ".") {
+			block.Filename = value
+			break
+		}
+	}
+	block.Filename = safeFilename(block.Filename)
+	return block
+}
+
+// safeFilename strips any directory components so a suggested name can never
+// point outside the artifacts directory.
+func safeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+type artifactInfo struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// artifactStore saves file content produced by the model into a directory
+// private to this session. Content is saved once, saving it again returns the
+// artifact saved first.
+type artifactStore struct {
+	dir   string
+	count int
+	saved map[string]artifactInfo // keyed by SHA256
+}
+
+func newArtifactStore(baseDir string) (*artifactStore, error) {
+	session := fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), os.Getpid())
+	dir := filepath.Join(baseDir, session)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactStore{dir: dir, saved: map[string]artifactInfo{}}, nil
+}
+
+// save writes content under name, or a generated name if that is empty or
+// already taken.
+func (s *artifactStore) save(name, ext, content string) (artifactInfo, error) {
+	sum := sha256.Sum256([]byte(content))
+	if info, ok := s.saved[hex.EncodeToString(sum[:])]; ok {
+		return info, nil
+	}
+	s.count++
+	if name == "" {
+		name = fmt.Sprintf("artifact-%d%s", s.count, ext)
+	}
+	path := filepath.Join(s.dir, name)
+	if _, err := os.Stat(path); err == nil {
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		name = fmt.Sprintf("%s-%d%s", base, s.count, filepath.Ext(name))
+		path = filepath.Join(s.dir, name)
+	}
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		return artifactInfo{}, err
+	}
+	info := artifactInfo{Path: path, Name: name, SHA256: hex.EncodeToString(sum[:]), Size: len(content)}
+	s.saved[info.SHA256] = info
+	return info, nil
+}
+
+// saveResponse stores the file-like code blocks of a final response and
+// announces each of them to remote with an artifact message.
+func (s *artifactStore) saveResponse(send func(Message) error, response string) error {
+	for _, block := range extractCodeBlocks(response) {
+		ext, known := languageExtensions[block.Language]
+		if block.Filename == "" && !known {
+			continue
+		}
+		info, err := s.save(block.Filename, ext, block.Content)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		err = send(Message{MsgType: msgTypeArtifact, Content: string(b)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type codeArtifact struct {
+	Language string `json:"language"`
+	Content  string `json:"content"`
+	Filename string `json:"filename,omitempty"` // suggested name for saving
+}
+
+// sendCodeArtifacts sends each fenced code block of a final response as a
+// code-artifact message, so remote does not have to parse markdown.
+func sendCodeArtifacts(send func(Message) error, response string) error {
+	for i, block := range extractCodeBlocks(response) {
+		filename := block.Filename
+		if ext, known := languageExtensions[block.Language]; filename == "" && known {
+			filename = fmt.Sprintf("snippet-%d%s", i+1, ext)
+		}
+		b, err := json.Marshal(codeArtifact{Language: block.Language, Content: block.Content, Filename: filename})
+		if err != nil {
+			return err
+		}
+		err = send(Message{MsgType: msgTypeCodeArtifact, Content: string(b)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
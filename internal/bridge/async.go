@@ -0,0 +1,156 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// errWoken is returned by recvOrWake when woken before remote sent anything.
+var errWoken = errors.New("woken")
+
+// asyncRun is a tool call running in the background, see runAsync.
+type asyncRun struct {
+	id      string // in meta.pending of its messages
+	call    textToolCall
+	session string // of the prompt that made the call
+	agent   string
+	start   time.Time
+
+	contents []mcp.Content
+	isError  bool
+	err      error
+}
+
+// asyncRuns are the tool calls running in the background. They finish on
+// their own goroutines and are delivered by chatLoop once it is idle.
+type asyncRuns struct {
+	ctx    context.Context // of all runs, canceled when the bridge closes
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	wake   chan struct{} // signaled when a run finished
+
+	mu       sync.Mutex
+	finished []*asyncRun
+}
+
+func newAsyncRuns() *asyncRuns {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &asyncRuns{ctx: ctx, cancel: cancel, wake: make(chan struct{}, 1)}
+}
+
+// take returns the runs finished since the last call.
+func (a *asyncRuns) take() []*asyncRun {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	finished := a.finished
+	a.finished = nil
+	return finished
+}
+
+// close cancels the runs and waits for them to end.
+func (a *asyncRuns) close() {
+	a.cancel()
+	a.wg.Wait()
+}
+
+// runsAsync reports whether calls of tool run in the background, and
+// returns its full name for the bridge to run it.
+func (b *Bridge) runsAsync(ctx context.Context, tool string) (string, bool) {
+	if b.conf.AsyncTools == "" {
+		return "", false
+	}
+	full, ok := b.promptToolbox(ctx).resolve(tool)
+	if !ok || !matchesToolPatterns(b.conf.AsyncTools, full) {
+		return "", false
+	}
+	return full, true
+}
+
+// runAsync starts an authorized call in the background, holding its slot of
+// the limiter until it ends, so minutes long tools like a system update do
+// not block the conversation. It tells remote with a tool-result-pending
+// message and returns the note for the model.
+func (b *Bridge) runAsync(ctx context.Context, call textToolCall) string {
+	id, err := newID()
+	if err != nil {
+		slog.Error("creating message ID", "err", err)
+	}
+	tools := b.promptToolbox(ctx)
+	run := &asyncRun{id: id, call: call, session: b.session, agent: b.agent, start: time.Now()}
+	b.async.wg.Add(1)
+	go func() {
+		defer b.async.wg.Done()
+		run.contents, run.isError, run.err = tools.call(b.async.ctx, call.Name, call.Args)
+		b.limiter.release(call.Name)
+		b.async.mu.Lock()
+		b.async.finished = append(b.async.finished, run)
+		b.async.mu.Unlock()
+		select {
+		case b.async.wake <- struct{}{}:
+		default: // woken already
+		}
+	}()
+	slog.Info("tool runs in the background", "tool", call.Name, "pending", id)
+	pending := resultMessage(msgTypeResultPending, call.Name, nil, nil).withMeta("pending", id)
+	if err := b.send(pending); err != nil {
+		slog.Error("sending message", "err", err)
+	}
+	return fmt.Sprintf("The tool %s was started in the background, its result is not known yet and comes later. Tell the user it is running.", call.Name)
+}
+
+// deliverAsync sends the results of the tool calls finished in the background
+// to remote in tool-result-async messages. With Config.AsyncFollowUp the
+// model goes on with each result like after a prompt.
+func (b *Bridge) deliverAsync(ctx context.Context, host Host) error {
+	for _, run := range b.async.take() {
+		items := b.resultItems(run.contents)
+		result := itemsText(items)
+		if run.err != nil {
+			result, run.isError = run.err.Error(), true
+			items = []resultItem{{Type: mcp.ContentTypeText, Text: result}}
+		}
+		status := auditOK
+		switch {
+		case errors.Is(run.err, context.Canceled):
+			status = auditCanceled
+		case run.isError:
+			status = auditFailed
+		}
+		ran := b.recordToolRun(run.call.Name, run.call.Args, run.start, status)
+		if b.breaker.record(run.call.Name, run.isError) {
+			if err := b.send(Message{MsgType: msgTypeUnavailable, Content: run.call.Name}); err != nil {
+				return err
+			}
+		}
+		msg := resultMessage(msgTypeResultAsync, run.call.Name, b.sentItems(items), ran)
+		msg.Session = run.session
+		if err := b.send(msg.withMeta("pending", run.id).withMeta("failed", run.isError)); err != nil {
+			return err
+		}
+		if !b.conf.AsyncFollowUp {
+			b.inspectResult(run.call.Name, result)
+			continue
+		}
+		result = b.guardResult(run.call.Name, result)
+		note := "The tool " + run.call.Name + " returned:\n" + result
+		if run.isError {
+			note = "The tool " + run.call.Name + " failed:\n" + result
+		}
+		err := b.handlePromptMessage(ctx, host, Message{
+			MsgType: msgTypePrompt,
+			Content: "The tool call started in the background earlier has finished. " + note + "\n\nTell the user what came of it.",
+			Agent:   run.agent,
+			Session: run.session,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
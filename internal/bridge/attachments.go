@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// attachment is a text file, like a log, sent with a prompt in
+// Message.Attachments. The bridge keeps the attachments of each session by
+// ID, so remote may send one again with the ID only.
+type attachment struct {
+	ID       string `json:"id,omitempty"` // "sha256:" and the hex SHA-256 of the content
+	Name     string `json:"name,omitempty"`
+	MIMEType string `json:"mimeType,omitempty"`
+	Content  string `json:"content,omitempty"` // empty to refer to one sent before by ID
+}
+
+func attachmentID(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// attachmentTag starts the text of an attachment in a prompt, by which the
+// bridge finds it in the conversation.
+func attachmentTag(id string) string {
+	return fmt.Sprintf("<attachment id=%q", id)
+}
+
+// attachmentStore returns the attachments of a session, the ones of the main
+// conversation for an unknown one.
+func (b *Bridge) attachmentStore(session string) map[string]attachment {
+	if s, ok := b.sessions[session]; ok {
+		if s.attachments == nil {
+			s.attachments = map[string]attachment{}
+		}
+		return s.attachments
+	}
+	if b.attachments == nil {
+		b.attachments = map[string]attachment{}
+	}
+	return b.attachments
+}
+
+// attachPrompt appends the attachments of a prompt of session to it. The
+// content of an attachment already in the conversation of host is not sent
+// to the model again, only a reference to it, so a log sent with every turn
+// takes room in the context once.
+func (b *Bridge) attachPrompt(host Host, session, prompt string, attachments []attachment) (string, error) {
+	if len(attachments) == 0 {
+		return prompt, nil
+	}
+	store := b.attachmentStore(session)
+	var history []string
+	for _, m := range host.Messages() {
+		history = append(history, m.Content)
+	}
+	conversation := strings.Join(history, "\n")
+	var sb strings.Builder
+	sb.WriteString(prompt)
+	for _, a := range attachments {
+		if a.Content != "" {
+			a.ID = attachmentID(a.Content)
+			if known, ok := store[a.ID]; ok {
+				a.Content = known.Content // kept once, however often remote sends it
+			} else {
+				store[a.ID] = a
+			}
+		} else if known, ok := store[a.ID]; ok {
+			a.Content = known.Content
+			if a.Name == "" {
+				a.Name = known.Name
+			}
+		} else {
+			return "", fmt.Errorf("no attachment %q in the session", a.ID)
+		}
+		name := a.Name
+		if name == "" {
+			name = "attachment"
+		}
+		if strings.Contains(conversation, attachmentTag(a.ID)) {
+			fmt.Fprintf(&sb, "\n\n[attachment %s (%s) unchanged, see it earlier in the conversation]", name, a.ID)
+			continue
+		}
+		fmt.Fprintf(&sb, "\n\n%s name=%q>\n%s\n</attachment>", attachmentTag(a.ID), name, strings.TrimSuffix(a.Content, "\n"))
+		conversation += attachmentTag(a.ID) // sent twice in this prompt
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// statuses of tool calls in the audit log
+const (
+	auditOK       = "ok"
+	auditFailed   = "failed"
+	auditCanceled = "canceled" // the prompt was canceled while the tool ran
+	auditNotRun   = "not-run"  // denied
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time     time.Time        `json:"time"`
+	Tool     string           `json:"tool"`
+	Args     json.RawMessage  `json:"args,omitempty"`
+	Decision string           `json:"decision"` // allow or deny
+	Status   string           `json:"status"`
+	Duration string           `json:"duration,omitempty"` // of the run, e.g. "1.5s"
+	Env      *toolEnvironment `json:"env,omitempty"`      // how the tool ran
+}
+
+// auditLog appends every tool call, run or denied, to a file as JSON lines.
+// Lines are written whole, so several bridges may share the file.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+// record appends e to the log. Failures are logged, the tool call goes on.
+func (l *auditLog) record(e auditEntry) {
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("encoding audit entry", "tool", e.Tool, "err", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		slog.Error("writing audit log", "err", err)
+	}
+}
+
+// denied records a call of tool with args that was not allowed to run.
+func (l *auditLog) denied(tool, args string) {
+	l.record(auditEntry{Time: time.Now(), Tool: tool, Args: rawArgs(args), Decision: "deny", Status: auditNotRun})
+}
+
+func (l *auditLog) close() {
+	if l == nil {
+		return
+	}
+	if err := l.f.Close(); err != nil {
+		slog.Warn("closing audit log", "err", err)
+	}
+}
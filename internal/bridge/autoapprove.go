@@ -0,0 +1,46 @@
+package bridge
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// toolPatterns returns the tool patterns of a comma separated list option,
+// like Config.AutoApprove, written like the ones of the tool policy. "*"
+// matches all tools.
+func toolPatterns(option, list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		for _, part := range strings.SplitN(pattern, ":", 2) {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("%s pattern %q: %w", option, pattern, err)
+			}
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// autoApproved reports whether tool runs without asking remote, as no human
+// is there to answer. Policies still deny tools, and servers of trust level
+// ask still have every call confirmed.
+func (b *Bridge) autoApproved(tool string) bool {
+	return matchesToolPatterns(b.conf.AutoApprove, tool)
+}
+
+// matchesToolPatterns reports whether tool matches one of the patterns of a
+// list checked with toolPatterns.
+func matchesToolPatterns(list, tool string) bool {
+	patterns, _ := toolPatterns("", list) // checked by Validate
+	for _, pattern := range patterns {
+		if ok, _ := matchToolPattern(pattern, tool); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"strings"
+)
+
+// batchItem is a tool call in the content of a confirm-batch message.
+type batchItem struct {
+	Tool    string          `json:"tool"`
+	Server  string          `json:"server"`
+	Args    json.RawMessage `json:"args"`
+	Summary string          `json:"summary,omitempty"` // see toolSummary
+}
+
+// batchDecision is the answer of remote to an item of a confirm-batch
+// message, in the content of batch-decisions.
+type batchDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"` // for the model if denied, like in deny-tool-run
+}
+
+func batchKey(tool, args string) string {
+	return tool + "\x00" + canonicalArgs(args)
+}
+
+// parseTextToolCalls recognizes a response of one or more tool calls written
+// as text: one as parseTextToolCall does, several each in <tool_call> tags,
+// as the chat templates of Qwen and Hermes models write parallel calls, or
+// as bare JSON objects one per line.
+func parseTextToolCalls(response string) ([]textToolCall, bool) {
+	if call, ok := parseTextToolCall(response); ok {
+		return []textToolCall{call}, true
+	}
+	s := strings.TrimSpace(response)
+	var parts []string
+	if strings.HasPrefix(s, "<tool_call>") {
+		for _, block := range strings.Split(s, "<tool_call>")[1:] {
+			call, rest, _ := strings.Cut(block, "</tool_call>")
+			if strings.TrimSpace(rest) != "" {
+				return nil, false
+			}
+			parts = append(parts, call)
+		}
+	} else {
+		for line := range strings.Lines(s) {
+			if strings.TrimSpace(line) != "" {
+				parts = append(parts, line)
+			}
+		}
+	}
+	if len(parts) < 2 {
+		return nil, false
+	}
+	var calls []textToolCall
+	for _, part := range parts {
+		call, ok := parseTextToolCall(part)
+		if !ok {
+			return nil, false
+		}
+		calls = append(calls, call)
+	}
+	return calls, true
+}
+
+// asksRemote reports whether decideTool would ask remote about a call of
+// name with args, as no policy, trust level, team or remembered decision
+// settles it. Unlike decideTool it tells remote nothing.
+func (b *Bridge) asksRemote(ctx context.Context, name, args string, preApproved bool) bool {
+	if b.workdir != "" && len(pathsOutside(args, b.workdir)) > 0 {
+		return false
+	}
+	trust := b.serverTrust(name)
+	if trust == trustBlocked {
+		return false
+	}
+	decision := policyAsk
+	if b.policy != nil {
+		decision, _ = b.policy.evaluate(ctx, name, args)
+	}
+	if byPattern, _ := b.toolPolicy.decide(name); byPattern == policyDeny || byPattern == policyAllow && decision == policyAsk {
+		decision = byPattern
+	}
+	switch {
+	case b.turn.injection != nil && decision != policyDeny:
+		return true
+	case decision != policyAsk:
+		return false
+	case trust == trustAsk:
+		return true
+	case preApproved || trust == trustTrusted || b.autoApproved(name) || b.readOnlyTool(ctx, name):
+		return false
+	}
+	if b.team != nil {
+		if _, found := b.team.lookup(ctx, name); found {
+			return false
+		}
+	}
+	_, found := b.approvals.lookup(name, args)
+	return !found
+}
+
+// confirmBatch asks remote about all calls it has to decide on with a single
+// confirm-batch message, instead of one confirmation after the other while
+// they run. The answers are kept for confirmToolRun. The SDK makes native
+// calls one by one, so only calls the model wrote as text come in batches.
+func (b *Bridge) confirmBatch(ctx context.Context, calls []textToolCall, planned plannedTools) {
+	b.batchAnswers = map[string]batchDecision{}
+	preview := maps.Clone(planned)
+	var pending []textToolCall
+	items := []batchItem{}
+	for _, call := range calls {
+		args, _ := b.transformArgs(call.Name, call.Args)
+		if !b.asksRemote(ctx, call.Name, args, preview.take(call.Name)) {
+			continue
+		}
+		server, _, _ := strings.Cut(call.Name, "__")
+		pending = append(pending, textToolCall{Name: call.Name, Args: args})
+		items = append(items, batchItem{Tool: call.Name, Server: server, Args: rawArgs(args), Summary: b.toolSummary(ctx, call.Name, args)})
+	}
+	if len(items) < 2 {
+		return // a single call is confirmed as usual
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		slog.Error("encoding batch", "err", err)
+		return
+	}
+	id, err := newID()
+	if err != nil {
+		slog.Error("creating message ID", "err", err)
+		return
+	}
+	if err := b.send(Message{ID: id, MsgType: msgTypeConfirmBatch, Content: string(data)}); err != nil {
+		slog.Error("sending message", "err", err)
+		return
+	}
+	msg, err := b.recvReply(ctx, id)
+	if err != nil {
+		slog.Warn("receiving batch decisions", "err", err)
+		return
+	}
+	decisions := make([]batchDecision, len(pending))
+	switch msg.MsgType {
+	case msgTypeBatchDecisions:
+		if err := json.Unmarshal([]byte(msg.Content), &decisions); err != nil {
+			slog.Warn("parsing batch decisions, asking for each call", "err", err)
+			return
+		}
+	case msgTypeAllow, msgTypeDeny: // the same for all calls
+		for i := range decisions {
+			decisions[i] = batchDecision{Allow: msg.MsgType == msgTypeAllow, Reason: strings.TrimSpace(msg.Content)}
+		}
+	default:
+		slog.Warn("expected batch decisions, got", "MsgType", msg.MsgType)
+		return
+	}
+	for i, d := range decisions[:min(len(decisions), len(pending))] {
+		b.batchAnswers[batchKey(pending[i].Name, pending[i].Args)] = d
+	}
+}
+
+// batchAnswer returns the answer of remote to a call of tool with args in
+// the last confirm-batch, if there is one.
+func (b *Bridge) batchAnswer(tool, args string) (batchDecision, bool) {
+	d, ok := b.batchAnswers[batchKey(tool, args)]
+	return d, ok
+}
@@ -0,0 +1,1329 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcphost/sdk"
+)
+
+const maxReprompts = 3 // times a prompt is run again for unavailable tools or invalid calls
+
+// Config holds the settings of the bridge, set from the command line.
+type Config struct {
+	Model               string // e.g. ollama:qwen2.5:3b
+	ConfigFile          string // mcphost configuration
+	SystemPrompt        string
+	Compress            string // encoding of large content sent to remote if it accepts it, none if empty
+	CompressMinSize     int
+	BridgeConfigFile    string
+	MaxParallelTools    int // 0 for no limit
+	PolicyFile          string
+	PolicyQuery         string
+	ToolPolicyFile      string // patterns of tools allowed or denied without asking
+	FilterCmd           string
+	EmbeddingModel      string
+	SummaryModel        string
+	CircuitThreshold    int // 0 to never disable tools
+	CircuitCooldown     time.Duration
+	Preset              string
+	PlanFirst           bool
+	ApprovalsFile       string
+	ArtifactsDir        string
+	CodeArtifacts       bool
+	MaxChunksPerSecond  int // 0 for no limit
+	ChunkBoundary       string
+	DetectTextToolCalls bool
+	SimulateStreaming   int    // words per second, 0 to send at once
+	EmulateTools        string // comma separated model patterns
+	LowMemory           bool
+	Warmup              bool
+	TeamApprovals       string           // file, directory or URL of decisions shared by a team
+	Telemetry           bool             // count usage into anonymized reports in TelemetryDir
+	TelemetryDir        string           // spool directory, in the user cache directory if empty
+	ReattachGrace       time.Duration    // how long work goes on for a frontend to reattach, see Serve
+	OutboundQueue       int              // messages queued for a slow remote, 0 to write them at once
+	Overflow            string           // what to do when the queue is full, block if empty
+	ToolEnvironment     bool             // send the environment of tool calls with their results
+	AuditLog            string           // file every tool call is appended to as a JSON line, none if empty
+	Heartbeat           time.Duration    // interval of pings to remote, 0 for none
+	ElicitArgs          bool             // ask remote for required arguments missing in tool calls
+	ValidateArgs        bool             // check tool calls against the input schemas of the tools
+	RepairModel         string           // model asked to fix invalid tool arguments, none if empty
+	ToolSummaryModel    string           // model summarizing tool calls without a summary template, none if empty
+	MaxResultText       int              // bytes of text per item of a tool result sent to remote, 0 for all
+	MaxMessageSize      int              // bytes of a message from remote, larger ones are skipped, 32 MiB if 0
+	HistoryFile         string           // file the main conversation is saved to after every prompt, none if empty
+	Resume              bool             // go on with the conversation in HistoryFile
+	ContextWindow       int              // tokens of the context of the model, 0 for no context-usage warnings
+	ContextWarnings     string           // comma separated percentages of ContextWindow to warn at, like "70,90"
+	CompactAt           int              // percentage of ContextWindow at which older turns are summarized, 0 for never
+	AutoApproveReadOnly bool             // run tools annotated with readOnlyHint without asking
+	AutoApprove         string           // comma separated patterns of tools to run without asking, "*" for all
+	AsyncTools          string           // comma separated patterns of tools run in the background, see runAsync
+	AsyncFollowUp       bool             // let the model go on with the results of tools run in the background
+	Verbosity           string           // terse, normal or detailed, normal if empty
+	FirstTokenSLO       time.Duration    // time to the first token to warn about when exceeded repeatedly, 0 for none
+	MaxInputTokens      int              // estimated tokens of a prompt with the conversation sent to the model, 0 for no limit
+	MaxOutputTokens     int              // estimated tokens of a response, cut off beyond, 0 for no limit
+	MaxSessionTokens    int              // estimated tokens a session may send to and receive from the model, 0 for no limit
+	InjectionGuard      bool             // run tool calls through the bridge to set their results off as data, and confirm tool calls after output that looks like instructions
+	Admin               bool             // allow remote to manage the bridge with admin messages
+	SetLogLevel         func(slog.Level) // changes the level of the logger, for admin-set-log-level
+}
+
+// Validate checks the settings that do not need any files.
+func (c Config) Validate() error {
+	if c.Model == "" {
+		return errors.New("model must be set")
+	}
+	if c.Compress != "" && c.Compress != encodingGzip {
+		return fmt.Errorf("unsupported compression: %s", c.Compress)
+	}
+	if _, ok := ollamaModel(c.EmbeddingModel); c.EmbeddingModel != "" && !ok {
+		return errors.New("embedding model must be an ollama model")
+	}
+	if _, ok := presets[c.Preset]; c.Preset != "" && !ok {
+		return fmt.Errorf("unknown preset: %s", c.Preset)
+	}
+	if _, ok := verbosities[c.Verbosity]; c.Verbosity != "" && !ok {
+		return fmt.Errorf("unknown verbosity: %s", c.Verbosity)
+	}
+	if c.ChunkBoundary != "" && c.ChunkBoundary != boundaryWord && c.ChunkBoundary != boundarySentence {
+		return fmt.Errorf("unknown chunk boundary: %s", c.ChunkBoundary)
+	}
+	if c.Overflow != "" && c.Overflow != overflowBlock && c.Overflow != overflowDropChunks {
+		return fmt.Errorf("unknown overflow policy: %s", c.Overflow)
+	}
+	if c.Resume && c.HistoryFile == "" {
+		return errors.New("resuming needs a history file")
+	}
+	if _, err := toolPatterns("auto-approve", c.AutoApprove); err != nil {
+		return err
+	}
+	if _, err := toolPatterns("async", c.AsyncTools); err != nil {
+		return err
+	}
+	if _, err := parseContextWarnings(c.ContextWarnings); err != nil {
+		return err
+	}
+	if c.CompactAt < 0 || c.CompactAt > 100 {
+		return fmt.Errorf("compacting at %d%% of the context", c.CompactAt)
+	}
+	if c.CompactAt > 0 && c.ContextWindow <= 0 {
+		return errors.New("compacting needs a context window")
+	}
+	return nil
+}
+
+// Bridge connects remote, speaking JSON lines, with mcphost.
+type Bridge struct {
+	conf        Config
+	bridgeConf  bridgeConfig
+	newHost     HostFactory
+	options     sdk.Options // of the default agent
+	limiter     *toolLimiter
+	artifacts   *artifactStore
+	decisions   *decisionCache
+	policy      *regoPolicy
+	toolPolicy  *toolPolicy // nil without Config.ToolPolicyFile
+	team        *teamDecisions
+	breaker     *circuitBreaker
+	middlewares []Middleware
+	filter      *filterProcess
+
+	// agentHosts are the hosts of the agent profiles, created on first use.
+	// Each agent keeps its own conversation.
+	agentHosts map[string]Host
+	// helperHosts are hosts without any MCP servers, used for side tasks like
+	// summarizing that must never run tools. Keyed by model and system prompt.
+	helperHosts map[[2]string]Host
+	// presetHosts run prompts of an agent that ask for another preset
+	// or verbosity than the default. They hold no conversation of their own,
+	// see runWithPreset.
+	presetHosts map[presetKey]*presetHost
+	// backupHosts run prompts of an agent with another model of its
+	// provider group, see runWithFailover. Keyed by agent and model.
+	backupHosts map[[2]string]Host
+	tools       *toolbox   // created on first use by getToolbox
+	toolsMu     sync.Mutex // guards tools, which scheduled jobs use as well
+	warmup      warmup
+
+	// sessions are conversations forked by remote, keyed by session ID.
+	sessions map[string]*session
+	pins     []pin // sent with every prompt, in the order pinned
+	jobs     *jobScheduler
+	metrics  *metrics   // nil unless enabled with admin-metrics
+	usage    *telemetry // nil unless opted in
+	audit    *auditLog  // nil unless configured
+	clients  *clients   // nil unless serving several frontends
+	remote   remoteVersion
+	encoding string // of large content sent to remote, as it accepts Config.Compress
+	request  string // ID of the message from remote being handled
+	queue    *outQueue
+	turn     turnStats // of the prompt being handled
+
+	// workdir is the working directory of the session of the prompt being
+	// handled, see toolCaller.
+	workdir string
+	// approvals are the decisions of the session of the prompt being
+	// handled, decisions for the main conversation.
+	approvals *decisionCache
+	// export is the transcript last sent to remote in chunks, nil if none.
+	export *transcriptExport
+	// batchAnswers are the answers to the confirm-batch of the tool calls
+	// running, keyed by batchKey.
+	batchAnswers map[string]batchDecision
+	// edit is the call remote allowed with arguments it changed, to run
+	// instead of the one the model made, see editOf.
+	edit *textToolCall
+	// history is where the main conversation is saved, nil without
+	// Config.HistoryFile.
+	history *historyFile
+	// contextWarned is the highest threshold of Config.ContextWarnings each
+	// conversation was warned of, see warnContext.
+	contextWarned map[Host]int
+	// attachments are the ones sent with prompts of the main conversation,
+	// keyed by ID. Forked sessions keep their own.
+	attachments map[string]attachment
+	// verbosity is the one remote set for the main conversation, empty for
+	// Config.Verbosity.
+	verbosity string
+	// session and agent are of the prompt being handled.
+	session, agent string
+	// spent are the tokens of the main conversation counted against
+	// Config.MaxSessionTokens. Sessions count their own.
+	spent int
+	// async are the tool calls running in the background.
+	async *asyncRuns
+	// firstTokens are the times to the first token of the last prompts, to
+	// check against Config.FirstTokenSLO.
+	firstTokens firstTokenTracker
+	// checkpoints are the checkpoints of each conversation by name.
+	checkpoints map[Host]map[string]checkpoint
+	// models are the models switched to with switch-model by agent,
+	// defaultAgent for the main conversation.
+	models map[string]string
+	// memory is the memory of the model last reported in a done message.
+	memory memoryReport
+
+	// canceler and heartbeat are used by the goroutines reading from remote
+	// while the bridge is busy, see intercept. So is send, guarded by sendMu.
+	canceler  promptCanceler
+	heartbeat heartbeat
+	sendMu    sync.Mutex
+
+	// confined maps mcphost configurations to their copies with confined
+	// servers, see confinedConfig.
+	confined map[string]string
+
+	// providerGroups are the models standing in for each other, with their
+	// health.
+	providerGroups []*failoverGroup
+
+	in         <-chan inputLine // from readLines
+	out        io.Writer
+	disconnect context.CancelCauseFunc // cancels the work for remote
+}
+
+// New sets up a bridge, creating hosts with newHost.
+func New(conf Config, newHost HostFactory) (*Bridge, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	bridgeConf, err := loadBridgeConfig(conf.BridgeConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading bridge config: %w", err)
+	}
+	b := &Bridge{
+		conf:        conf,
+		bridgeConf:  bridgeConf,
+		newHost:     newHost,
+		limiter:     newToolLimiter(conf.MaxParallelTools, bridgeConf.Servers),
+		breaker:     newCircuitBreaker(conf.CircuitThreshold, conf.CircuitCooldown),
+		middlewares: slices.Clone(middlewares),
+		agentHosts:  map[string]Host{},
+		helperHosts: map[[2]string]Host{},
+		presetHosts: map[presetKey]*presetHost{},
+		models:      map[string]string{},
+		async:       newAsyncRuns(),
+		backupHosts: map[[2]string]Host{},
+		sessions:    map[string]*session{},
+		confined:    map[string]string{},
+		disconnect:  func(error) {}, // until Run
+		options: sdk.Options{
+			Model:        conf.Model,
+			ConfigFile:   conf.ConfigFile,
+			SystemPrompt: conf.SystemPrompt,
+			Streaming:    true,
+			Quiet:        true,
+		},
+	}
+	b.options.ConfigFile, err = b.confinedConfig(conf.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("confining MCP servers: %w", err)
+	}
+	b.providerGroups = newFailoverGroups(bridgeConf.ProviderGroups)
+	b.jobs, err = newJobScheduler(bridgeConf.Jobs)
+	if err != nil {
+		return nil, fmt.Errorf("loading bridge config: %w", err)
+	}
+	b.decisions, err = loadDecisionCache(conf.ApprovalsFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading approvals: %w", err)
+	}
+	b.approvals = b.decisions
+	b.firstTokens.slo = conf.FirstTokenSLO
+	if conf.ArtifactsDir != "" {
+		b.artifacts, err = newArtifactStore(conf.ArtifactsDir)
+		if err != nil {
+			return nil, fmt.Errorf("creating artifacts directory: %w", err)
+		}
+	}
+	b.toolPolicy, err = loadToolPolicy(conf.ToolPolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading tool policy: %w", err)
+	}
+	if conf.PolicyFile != "" {
+		b.policy, err = newRegoPolicy(conf.PolicyFile, conf.PolicyQuery, bridgeConf.RiskClasses)
+		if err != nil {
+			return nil, fmt.Errorf("loading policy: %w", err)
+		}
+	}
+	if conf.Telemetry {
+		b.usage, err = newTelemetry(conf.TelemetryDir, bridgeConf.RiskClasses)
+		if err != nil {
+			return nil, fmt.Errorf("setting up telemetry: %w", err)
+		}
+	}
+	if conf.AuditLog != "" {
+		b.audit, err = openAuditLog(conf.AuditLog)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %w", err)
+		}
+	}
+	if conf.HistoryFile != "" {
+		b.history = &historyFile{path: conf.HistoryFile}
+	}
+	if conf.TeamApprovals != "" {
+		b.team, err = newTeamDecisions(conf.TeamApprovals)
+		if err != nil {
+			return nil, fmt.Errorf("loading team approvals: %w", err)
+		}
+	}
+	if conf.FilterCmd != "" {
+		b.filter, err = startFilterProcess(conf.FilterCmd)
+		if err != nil {
+			return nil, fmt.Errorf("starting filter: %w", err)
+		}
+		b.middlewares = append(b.middlewares, b.filter)
+	}
+	b.options.SystemPrompt = b.withToolDocs(conf.SystemPrompt)
+	slog.Debug("sdk config", "options", b.options)
+	if conf.Preset != "" {
+		setParams(presets[conf.Preset]) // applies to all hosts created later as well
+	}
+	b.applyVerbosity(conf.Verbosity)
+	return b, nil
+}
+
+// DefaultHost creates the host of the default agent. In low memory mode it
+// is only created on first use, and if the model is not found, so remote
+// learns of it and can pull it.
+func (b *Bridge) DefaultHost(ctx context.Context) (Host, error) {
+	if b.conf.LowMemory {
+		return &lazyHost{ctx: ctx, opts: b.options, newHost: b.newCheckedHost}, nil
+	}
+	host, err := b.newCheckedHost(ctx, &b.options)
+	var notFound *modelNotFoundError
+	if errors.As(err, &notFound) {
+		slog.Warn("model not found", "model", notFound.Model, "available", notFound.Available)
+		return &lazyHost{ctx: ctx, opts: b.options, newHost: b.newCheckedHost}, nil
+	}
+	return host, err
+}
+
+// Run exchanges messages with remote until it quits, closing host at the end.
+// If the input ends or output fails before, the work for remote is canceled
+// and ErrConnectionLost returned.
+func (b *Bridge) Run(ctx context.Context, host Host, in io.Reader, out io.Writer) error {
+	ctx, disconnect := context.WithCancelCause(ctx)
+	defer disconnect(nil)
+	b.disconnect = disconnect // not read by readLines, which may outlive Run
+	lines := make(chan inputLine)
+	done := make(chan struct{})
+	defer close(done)
+	report := func(e bridgeError) {
+		if err := b.sendError(e); err != nil {
+			slog.Error("sending message", "err", err)
+		}
+	}
+	go readLines(b.newScanner(in, report), lines, done, b.intercept, func() { disconnect(ErrConnectionLost) })
+	return b.serve(ctx, host, lines, out)
+}
+
+func (b *Bridge) serve(ctx context.Context, host Host, in <-chan inputLine, out io.Writer) error {
+	b.in = in
+	b.out = out
+	if b.conf.OutboundQueue > 0 {
+		b.queue = newOutQueue(out, b.conf.OutboundQueue, b.conf.Overflow)
+		go b.queue.run(b.disconnect)
+		defer func() {
+			b.queue.close()
+			b.queue = nil
+		}()
+	}
+	if b.conf.Warmup {
+		b.startWarmup(ctx, host.GetModelString())
+	}
+	if b.conf.Heartbeat > 0 {
+		beatCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		b.startHeartbeat(beatCtx, b.conf.Heartbeat)
+	}
+	hello, err := b.helloMessage()
+	if err != nil {
+		return err
+	}
+	err = b.send(hello)
+	if err != nil {
+		return err
+	}
+	b.warnIfExceedsVRAM(ctx, host.GetModelString())
+	err = b.chatLoop(ctx, host)
+	b.sayGoodbye(ctx, err)
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, ErrConnectionLost) {
+		return cause
+	}
+	return err
+}
+
+// Close stops the hosts and processes the bridge started.
+func (b *Bridge) Close() {
+	b.jobs.close()
+	b.async.close()
+	b.usage.flush()
+	b.closeAgentHosts()
+	b.closeSessions()
+	b.closePresetHosts()
+	b.closeBackupHosts()
+	b.closeHelperHosts()
+	b.closeToolbox()
+	b.removeConfinedConfigs()
+	b.audit.close()
+	if b.filter != nil {
+		if err := b.filter.Close(); err != nil {
+			slog.Warn("stopping filter", "err", err)
+		}
+	}
+}
+
+func (b *Bridge) chatLoop(ctx context.Context, host Host) error {
+	defer func() { host.Close() }() // host changes when a server is restarted
+
+	if b.conf.Resume && b.history != nil && !b.history.resumed {
+		if err := b.history.resume(host); err != nil {
+			slog.Warn("resuming conversation, starting a new one", "err", err)
+		}
+	}
+	for {
+		b.saveHistory(host)
+		b.clients.release()
+		b.setRequest("")
+		ready, err := b.readyMessage()
+		if err != nil {
+			return err
+		}
+		err = b.send(ready)
+		if err != nil {
+			return err
+		}
+
+		msg, err := b.recvOrWake(ctx, b.async.wake)
+		if errors.Is(err, errWoken) {
+			err = b.deliverAsync(ctx, host)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		b.setRequest(msg.ID)
+		switch msg.MsgType {
+		case msgTypeQuit:
+			return nil
+		case msgTypePrompt:
+			err = b.handlePromptMessage(ctx, host, msg)
+			if err != nil && !b.reportError(ctx, err) {
+				return err
+			}
+		case msgTypeResumeSession:
+			err = b.handleResumeSession(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeRetryTool:
+			err = b.handleRetryTool(ctx, host, msg)
+			if err != nil && !b.reportError(ctx, err) {
+				return err
+			}
+		case msgTypeSummarize:
+			err = b.handleSummarize(ctx, host, msg.Content == summaryReplace)
+			if err != nil {
+				return err
+			}
+			if b.conf.LowMemory {
+				b.shed()
+			}
+		case msgTypeEmbed:
+			err = b.handleEmbed(ctx, msg.Content)
+			if err != nil {
+				return err
+			}
+		case msgTypeGetHistory:
+			err = b.handleGetHistory(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeClearContext:
+			err = b.handleClearContext(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeExport:
+			err = b.handleExport(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeExportTranscript:
+			err = b.handleExportTranscript(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeCheckpoint:
+			err = b.handleCheckpoint(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeRollback:
+			err = b.handleRollback(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeSwitchModel:
+			host, err = b.handleSwitchModel(ctx, host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeGetPolicy:
+			err = b.handleGetPolicy(ctx, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeSetSystemPrompt:
+			err = b.handleSetSystemPrompt(host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeSetVerbosity:
+			err = b.handleSetVerbosity(msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeForkSession:
+			err = b.handleForkSession(ctx, host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeOpenSession:
+			err = b.handleOpenSession(ctx, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeCloseSession:
+			err = b.handleCloseSession(msg)
+			if err != nil {
+				return err
+			}
+		case msgTypePin, msgTypeUnpin, msgTypeListPins:
+			err = b.handlePins(msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeListJobResults:
+			err = b.handleListJobResults(msg.Content)
+			if err != nil {
+				return err
+			}
+		case msgTypeListTemplates, msgTypeComplete, msgTypeReadResource:
+			err = b.handleResources(ctx, host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeSetLogLevel, msgTypeAdminMetrics, msgTypeSelfTest, msgTypeRestartServer:
+			host, err = b.handleAdmin(ctx, host, msg)
+			if err != nil {
+				return err
+			}
+		case msgTypeVersion:
+			b.handleVersion(msg.Content)
+		case msgTypeGetServerStatus:
+			err = b.handleServerStatus()
+			if err != nil {
+				return err
+			}
+		case msgTypeEstimateTokens:
+			err = b.handleEstimateTokens(ctx, host, msg.Agent, msg.Content)
+			if err != nil {
+				return err
+			}
+		case msgTypePullModel:
+			err = b.handlePullModel(ctx, msg.Content)
+			if err != nil {
+				return err
+			}
+		case msgTypeDeleteModel:
+			err = b.handleDeleteModel(ctx, msg.Content)
+			if err != nil {
+				return err
+			}
+		case msgTypeListModels:
+			err = b.handleListModels(ctx)
+			if err != nil {
+				return err
+			}
+		default:
+			slog.Warn("expected prompt or quit, got", "MsgType", msg.MsgType)
+		}
+	}
+}
+
+// handlePromptMessage answers a prompt message with the host of its session
+// or agent.
+func (b *Bridge) handlePromptMessage(ctx context.Context, host Host, msg Message) error {
+	prompt := msg.Content
+	if msg.Template != "" {
+		var err error
+		prompt, err = b.expandTemplate(msg.Template, msg.Content)
+		if err != nil {
+			slog.Warn("dropping prompt", "template", msg.Template, "err", err)
+			return b.sendNotRun(ctx, host, msg.Content, b.sendError(bridgeError{Code: errorBadTemplate, Message: err.Error()}))
+		}
+	}
+	agentHost, agent, ok := b.sessionHost(msg.Session)
+	if !ok {
+		if msg.Session != "" {
+			slog.Warn("dropping prompt of unknown session", "session", msg.Session)
+			return b.sendNotRun(ctx, host, prompt, b.sendError(bridgeError{Code: errorUnknownSession,
+				Message: fmt.Sprintf("no open session %q", msg.Session)}))
+		}
+		agentHost, agent = b.selectAgent(ctx, host, msg)
+	}
+	prompt, err := b.attachPrompt(agentHost, msg.Session, prompt, msg.Attachments)
+	if err != nil {
+		slog.Warn("dropping prompt", "err", err)
+		return b.sendNotRun(ctx, agentHost, prompt, b.sendError(bridgeError{Code: errorUnknownAttachment, Message: err.Error()}))
+	}
+	if exceeded, ok := b.promptBudget(agentHost, msg.Session, prompt); ok {
+		return b.sendNotRun(ctx, agentHost, prompt, b.sendBudgetExceeded(exceeded))
+	}
+	var response string
+	start := time.Now()
+	b.turn = turnStats{start: start, finish: finishStop}
+	b.workdir = b.sessionWorkdir(msg.Session)
+	b.approvals = b.sessionDecisions(msg.Session)
+	b.session, b.agent = msg.Session, agent
+	b.edit = nil
+	verbosity := b.sessionVerbosity(msg.Session)
+	known := len(agentHost.Messages())
+	switch {
+	case b.emulatesTools(agentHost.GetModelString()):
+		err = b.withEmulatedTools(ctx, agentHost, func(h Host) error {
+			response, err = b.handlePrompt(ctx, b.emulationPrompt(ctx)+prompt, h)
+			return err
+		})
+	case msg.Preset != "" && msg.Preset != b.conf.Preset || verbosities[verbosity] != verbosities[b.conf.Verbosity]:
+		err = b.runWithPreset(ctx, agentHost, agent, msg.Session, msg.Preset, verbosity, func(h Host) error {
+			response, err = b.handlePrompt(ctx, prompt, h)
+			return err
+		})
+	case b.providerGroupOf(agentHost.GetModelString()) != nil:
+		group := b.providerGroupOf(agentHost.GetModelString())
+		err = b.runWithFailover(ctx, agentHost, agent, group, func(h Host) error {
+			response, err = b.handlePrompt(ctx, prompt, h)
+			return err
+		})
+	default:
+		response, err = b.handlePrompt(ctx, prompt, agentHost)
+	}
+	if err != nil {
+		return err
+	}
+	b.metrics.prompt(time.Since(start))
+	b.usage.prompt(agentHost.GetModelString())
+	b.spend(agentHost, msg.Session)
+	if response != "" {
+		err = b.sendSources(agentHost, known)
+		if err != nil {
+			return err
+		}
+	}
+	if msg.Template != "" && response != "" {
+		err = b.postProcess(ctx, msg.Template, response)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.sendDone(ctx, agentHost, prompt, response)
+	if err != nil {
+		return err
+	}
+	err = b.compactContext(ctx, agentHost, msg.Session)
+	if err != nil {
+		return err
+	}
+	if b.conf.LowMemory {
+		b.shed(agentHost)
+	}
+	return nil
+}
+
+// selectAgent returns the host and name of the agent named in a prompt
+// message, or picked by the router model. Without agent profiles it returns
+// host.
+func (b *Bridge) selectAgent(ctx context.Context, host Host, msg Message) (Host, string) {
+	if len(b.bridgeConf.Agents) == 0 {
+		return host, defaultAgent
+	}
+	name := msg.Agent
+	if name == "" && b.bridgeConf.Router != "" {
+		name = b.routeAgent(ctx, b.bridgeConf.Router, msg.Content)
+	}
+	selected := host
+	if name != "" && name != defaultAgent {
+		var err error
+		selected, err = b.agentHost(ctx, name)
+		if err != nil {
+			slog.Warn("using default agent", "agent", name, "err", err)
+			name, selected = defaultAgent, host
+		}
+	}
+	if name == "" {
+		name = defaultAgent
+	}
+	err := b.send(Message{MsgType: msgTypeAgent, Content: name})
+	if err != nil {
+		slog.Error("sending message", "err", err)
+	}
+	return selected, name
+}
+
+func (b *Bridge) handleSummarize(ctx context.Context, host Host, replace bool) error {
+	reply := Message{MsgType: msgTypeSummary}
+	summary, err := b.summarize(ctx, host, b.conf.SummaryModel)
+	if err != nil {
+		slog.Warn("summarizing conversation", "err", err)
+	} else {
+		reply.Content = summary
+		if replace {
+			before := countContextTokens(host.Messages()).Total
+			if err := replaceWithSummary(host, summary); err != nil {
+				slog.Error("replacing history with summary", "err", err)
+			} else {
+				reply = reply.withMeta("removedTokens", before-countContextTokens(host.Messages()).Total)
+			}
+		}
+	}
+	return b.send(reply)
+}
+
+func (b *Bridge) handleEmbed(ctx context.Context, text string) error {
+	reply := Message{MsgType: msgTypeEmbedding}
+	if b.conf.EmbeddingModel == "" {
+		slog.Warn("embed requested but no embedding model is set")
+	} else if vector, err := embed(ctx, b.conf.EmbeddingModel, text); err != nil {
+		slog.Warn("creating embedding", "err", err)
+	} else {
+		data, err := json.Marshal(vector)
+		if err != nil {
+			return err
+		}
+		reply.Content = string(data)
+	}
+	return b.send(reply)
+}
+
+// toolCaller is who a tool call is authorized for: a prompt of remote, or a
+// scheduled job nobody watches.
+type toolCaller struct {
+	workdir   string            // tools are confined to, empty for none
+	approvals *decisionCache    // remembered decisions, nil for none
+	injection *injectionSuspect // tool output that looked like instructions, see inspectResult
+	// confirm decides on calls nothing else decides on, like confirmToolRun.
+	confirm func(ctx context.Context, name, args string) (bool, string)
+	quiet   bool // do not tell remote of denied calls
+}
+
+// promptCaller returns the caller of the prompt being handled.
+func (b *Bridge) promptCaller() toolCaller {
+	return toolCaller{workdir: b.workdir, approvals: b.approvals, injection: b.turn.injection, confirm: b.confirmToolRun}
+}
+
+// authorizeTool decides whether a tool may run for the prompt being handled,
+// see authorizeCall.
+func (b *Bridge) authorizeTool(ctx context.Context, name, args string, preApproved bool) (allow bool, reason string) {
+	return b.authorizeCall(ctx, b.promptCaller(), name, args, preApproved)
+}
+
+// authorizeCall decides whether a tool may run, consulting the policies, the
+// decisions of the team, the remembered decisions and finally the confirm
+// of c. Tools of an approved plan are preApproved and, like read-only tools
+// and those of trusted servers, only checked against the policies. The tools
+// of servers to ask about are always confirmed, those of blocked servers
+// never run. Denied calls go to the audit log, the others once they ran. The
+// reason is the one remote gave for denying the call, if any.
+func (b *Bridge) authorizeCall(ctx context.Context, c toolCaller, name, args string, preApproved bool) (allow bool, reason string) {
+	allow, reason = b.decideTool(ctx, c, name, args, preApproved)
+	if !allow {
+		b.audit.denied(name, args)
+	}
+	return allow, reason
+}
+
+// sendDenied tells remote of a denied call, unless c is quiet.
+func (b *Bridge) sendDenied(c toolCaller, denied Message) {
+	if c.quiet {
+		return
+	}
+	if err := b.send(denied); err != nil {
+		slog.Error("onToolCall: sending message", "err", err)
+	}
+}
+
+func (b *Bridge) decideTool(ctx context.Context, c toolCaller, name, args string, preApproved bool) (bool, string) {
+	if b.deniedOutsideWorkdir(c, name, args) {
+		return false, ""
+	}
+	trust := b.serverTrust(name)
+	if trust == trustBlocked {
+		b.sendDenied(c, Message{MsgType: msgTypeToolDenied, Content: name}.withMeta("reason", serverBlocked))
+		return false, ""
+	}
+	decision := policyAsk
+	if b.policy != nil {
+		var err error
+		decision, err = b.policy.evaluate(ctx, name, args)
+		if err != nil {
+			slog.Warn("evaluating policy", "tool", name, "err", err)
+		}
+	}
+	// a tool denied by pattern is denied whatever the Rego policy says
+	byPattern, pattern := b.toolPolicy.decide(name)
+	if byPattern == policyDeny || byPattern == policyAllow && decision == policyAsk {
+		decision = byPattern
+	}
+	allow := decision == policyAllow
+	var reason string
+	if c.injection != nil && decision != policyDeny {
+		allow, reason = c.confirm(ctx, name, args) // the output of a tool may have steered the call
+	} else if decision == policyAsk && trust != trustAsk && (preApproved || trust == trustTrusted || b.autoApproved(name) || b.readOnlyTool(ctx, name)) {
+		allow = true
+	} else if decision == policyAsk && trust == trustAsk {
+		allow, reason = c.confirm(ctx, name, args) // remembered decisions do not apply
+	} else if decision == policyAsk {
+		var found bool
+		if b.team != nil {
+			allow, found = b.team.lookup(ctx, name)
+			if found && !allow {
+				b.sendDenied(c, Message{MsgType: msgTypeToolDenied, Content: name})
+			}
+		}
+		if !found && c.approvals != nil {
+			allow, found = c.approvals.lookup(name, args)
+		}
+		if !found {
+			allow, reason = c.confirm(ctx, name, args)
+		}
+	} else {
+		slog.Debug("policy decision", "tool", name, "decision", decision)
+		if !allow {
+			denied := Message{MsgType: msgTypeToolDenied, Content: name}
+			if byPattern == policyDeny {
+				denied = denied.withMeta("pattern", pattern)
+			}
+			b.sendDenied(c, denied)
+		}
+	}
+	if b.policy != nil {
+		final := policyDeny
+		if allow {
+			final = policyAllow
+		}
+		b.policy.remember(name, args, final)
+	}
+	return allow, reason
+}
+
+// confirmToolRun asks remote for permission to run a tool and remembers the
+// answer if it comes with a scope. A deny reply may give the reason in its
+// content, an allow reply other arguments to run the tool with.
+func (b *Bridge) confirmToolRun(ctx context.Context, name, args string) (allow bool, reason string) {
+	if d, ok := b.batchAnswer(name, args); ok {
+		return d.Allow, d.Reason
+	}
+	if b.edit != nil && b.edit.Name == name && canonicalArgs(b.edit.Args) == canonicalArgs(args) {
+		b.edit = nil
+		return true, "" // remote allowed it as it edited the call
+	}
+	details := fmt.Sprintf("Run tool: %s with args: %s", name, args)
+	server := serverName(name)
+	id, err := newID()
+	if err != nil {
+		slog.Error("onToolCall: creating message ID", "err", err)
+		return false, ""
+	}
+	confirm := Message{ID: id, MsgType: msgTypeConfirm, Content: details, Tool: name, Server: server, Args: rawArgs(args)}
+	if summary := b.toolSummary(ctx, name, args); summary != "" {
+		confirm = confirm.withMeta("summary", summary)
+	}
+	if b.turn.injection != nil {
+		confirm = confirm.withMeta("injection", b.turn.injection)
+	}
+	err = b.send(confirm)
+	if err != nil {
+		slog.Error("onToolcall: sending message", "err", err)
+	}
+	msg, err := b.recvReply(ctx, id)
+	if ctx.Err() != nil {
+		slog.Info("onToolCall: canceled while waiting for confirmation", "tool", name)
+		return false, ""
+	}
+	if err != nil {
+		slog.Error("onToolCall: receiving message", "err", err)
+	}
+	allow = true
+	switch msg.MsgType {
+	case msgTypeDeny:
+		allow, reason = false, strings.TrimSpace(msg.Content)
+	case msgTypeAllow:
+		if edited, ok := editedArgs(args, msg.Args); ok {
+			b.edit = &textToolCall{Name: name, Args: edited, edited: true}
+		}
+	case msgTypeAllowAlways:
+		if err := b.approvals.allowCalls(name, args, msg.Args); err != nil {
+			slog.Warn("onToolCall: not remembering approval", "tool", name, "err", err)
+		}
+		return true, ""
+	default:
+		slog.Warn("onToolCall: expected allow or deny, got:", "MsgType", msg.MsgType)
+		return true, ""
+	}
+	tool := name
+	if msg.Tool == allTools {
+		tool = allTools
+	}
+	err = b.approvals.record(tool, allow, msg.Scope, msg.Duration)
+	if err != nil {
+		slog.Warn("onToolCall: not remembering decision", "Scope", msg.Scope, "err", err)
+	}
+	return allow, reason
+}
+
+// handlePrompt runs a prompt. If the model calls an unavailable tool, the
+// prompt is run again with a note telling the model to do without it. A tool
+// call written as text is run and its result sent to the model as the next
+// prompt. It returns the final response.
+func (b *Bridge) handlePrompt(ctx context.Context, prompt string, host Host) (string, error) {
+	var planned plannedTools
+	if b.conf.PlanFirst {
+		steps, err := makePlan(ctx, host, prompt)
+		if err != nil {
+			slog.Warn("making plan, running without", "err", err)
+		} else if len(steps) > 0 {
+			approved, err := b.approvePlan(ctx, steps)
+			if err != nil {
+				return "", err
+			}
+			if !approved {
+				slog.Info("plan rejected")
+				b.turn.finish = finishPlanRejected
+				return "", nil
+			}
+			planned = newPlannedTools(steps)
+		}
+	}
+	prompt = b.pinnedPrompt(prompt)
+	defer b.unpinHistory(host)
+	textCalls := 0
+	for attempt := 0; ; {
+		result, err := b.runPrompt(ctx, prompt, host, planned)
+		if err != nil {
+			return "", err
+		}
+		if result.toolCall != nil && textCalls < maxTextToolCalls {
+			textCalls++
+			calls := append([]textToolCall{*result.toolCall}, result.batch...)
+			if len(calls) > 1 {
+				b.confirmBatch(ctx, calls, planned)
+			}
+			var notes []string
+			for _, call := range calls {
+				note, ok := b.runTextToolCall(ctx, call, planned)
+				if call.edited {
+					note = editedCallNote(call) + note
+				}
+				if !ok {
+					b.batchAnswers = nil
+					b.turn.finish = finishToolRefused
+					return "", nil
+				}
+				notes = append(notes, note)
+			}
+			b.batchAnswers = nil
+			prompt = strings.Join(notes, "\n\n") + "\n\nContinue with the request."
+			continue
+		}
+		if result.denied != "" {
+			prompt = result.denied + "\n\nContinue with the request."
+			continue
+		}
+		if len(result.unavailable) == 0 && len(result.invalid) == 0 || attempt == maxReprompts {
+			return result.response, nil
+		}
+		attempt++
+		if len(result.unavailable) > 0 {
+			prompt += fmt.Sprintf("\n\n(The tools %s are temporarily unavailable. Do not call them, answer without them.)",
+				strings.Join(result.unavailable, ", "))
+		}
+		for _, note := range result.invalid {
+			prompt += "\n\n(" + note + ")"
+		}
+	}
+}
+
+// deniedCallNote tells the model that remote denied a call of tool, and why.
+func deniedCallNote(tool, reason string) string {
+	return "The call of the tool " + tool + " was denied by the user and not run, saying: " + reason +
+		"\nDo not call it like this again."
+}
+
+type promptResult struct {
+	unavailable []string      // tools the model tried to call while unavailable, which cancels the prompt
+	invalid     []string      // notes on calls with invalid arguments, which cancel the prompt
+	toolCall    *textToolCall // a tool call the model wrote as its response instead of making it
+	denied      string        // note on a call remote denied with a reason, which cancels the prompt
+	response    string        // the final response, empty if the prompt was canceled
+
+	// batch are further calls the model wrote along with toolCall.
+	batch []textToolCall
+}
+
+// runPrompt runs a prompt. Calls of planned tools run without confirmation.
+func (b *Bridge) runPrompt(ctx context.Context, prompt string, host Host, planned plannedTools) (promptResult, error) {
+	var result promptResult
+	promptCanceled := false
+	redirected := false // canceled to run a tool call with transformed arguments
+	toolRunning := ""
+	var toolStart time.Time
+	promptCtx, cancelPrompt := context.WithCancel(ctx)
+	b.canceler.start(cancelPrompt)
+	chunks := newChunkWriter(b.send, b.conf.MaxChunksPerSecond, b.conf.ChunkBoundary)
+	var partial strings.Builder
+	reasoningConf, strip := reasoningConfigFor(host.GetModelString(), b.bridgeConf.Reasoning)
+	reasoning := newReasoningFilter(reasoningConf)
+	textTool := newTextToolFilter()
+	detectText := b.conf.DetectTextToolCalls || b.emulatesTools(host.GetModelString())
+	b.turn.model = host.GetModelString()
+	overBudget := false
+	visible := func(text string) {
+		if overBudget {
+			return
+		}
+		b.turn.token()
+		partial.WriteString(text)
+		if err := chunks.Write(text); err != nil {
+			slog.Error("onStreaming: sending message", "err", err)
+		}
+		if exceeded, ok := b.outputBudget(partial.Len()); ok {
+			overBudget, promptCanceled = true, true
+			cancelPrompt()
+			if err := b.sendBudgetExceeded(exceeded); err != nil {
+				slog.Error("onStreaming: sending message", "err", err)
+			}
+		}
+	}
+	stream := func(text string, thinking bool) {
+		var err error
+		switch {
+		case !thinking && detectText:
+			textTool.write(text, visible)
+		case !thinking:
+			visible(text)
+		case reasoningConf.Forward:
+			err = chunks.Flush()
+			if err == nil {
+				err = b.send(Message{MsgType: msgTypeThinking, Content: text})
+			}
+		}
+		if err != nil {
+			slog.Error("onStreaming: sending message", "err", err)
+		}
+	}
+
+	streamed := false
+	onStreaming := func(chunk string) {
+		streamed = true
+		if strip {
+			reasoning.write(chunk, stream)
+		} else {
+			stream(chunk, false)
+		}
+	}
+
+	response, err := host.PromptWithCallbacks(
+		promptCtx,
+		prompt,
+		func(name, args string) { // onToolCall callback
+			err := chunks.Flush()
+			if err != nil {
+				slog.Error("onToolCall: sending message", "err", err)
+			}
+			if !b.breaker.allow(name) {
+				slog.Info("onToolCall: circuit open", "tool", name)
+				err := b.send(Message{MsgType: msgTypeUnavailable, Content: name})
+				if err != nil {
+					slog.Error("onToolCall: sending message", "err", err)
+				}
+				result.unavailable = append(result.unavailable, name)
+				promptCanceled = true
+				cancelPrompt()
+				return
+			}
+			if transformed, ok := b.transformArgs(name, args); ok {
+				// the SDK runs the call as the model made it, so the bridge
+				// runs it itself with the new arguments
+				promptCanceled = true
+				cancelPrompt()
+				if full, ok := b.promptToolbox(ctx).resolve(name); ok {
+					result.toolCall = &textToolCall{Name: full, Args: transformed}
+					redirected = true
+					return
+				}
+				slog.Warn("onToolCall: cannot run tool with transformed arguments", "tool", name)
+				err := b.send(Message{MsgType: msgTypeToolDenied, Content: name})
+				if err != nil {
+					slog.Error("onToolCall: sending message", "err", err)
+				}
+				return
+			}
+			if full, ok := b.runsAsync(ctx, name); ok {
+				// the SDK waits for the result, so the bridge runs the call
+				// itself in the background
+				promptCanceled = true
+				cancelPrompt()
+				result.toolCall = &textToolCall{Name: full, Args: args}
+				redirected = true
+				return
+			}
+			if full, ok := b.lacksArgs(promptCtx, name, args); ok {
+				// the SDK would run the call as it is, so the bridge runs it
+				// itself once remote provided the missing arguments
+				promptCanceled = true
+				cancelPrompt()
+				result.toolCall = &textToolCall{Name: full, Args: args}
+				redirected = true
+				return
+			}
+			full, repaired, errs := b.checkToolArgs(promptCtx, name, args)
+			if len(errs) > 0 {
+				b.rejectToolArgs(name, errs)
+				result.invalid = append(result.invalid, invalidCallNote(name, errs))
+				promptCanceled = true
+				cancelPrompt()
+				return
+			}
+			if repaired != args {
+				slog.Info("onToolCall: repaired arguments", "tool", name)
+				promptCanceled = true
+				cancelPrompt()
+				result.toolCall = &textToolCall{Name: full, Args: repaired}
+				redirected = true
+				return
+			}
+			if _, retried := retryPolicyFor(name, b.bridgeConf.Retries); retried || b.conf.InjectionGuard {
+				// the SDK passes results on to the model as they are, so the
+				// bridge runs the call itself to retry failures or to set the
+				// result off as data
+				if full, ok := b.promptToolbox(ctx).resolve(name); ok {
+					promptCanceled = true
+					cancelPrompt()
+					result.toolCall = &textToolCall{Name: full, Args: args}
+					redirected = true
+					return
+				}
+			}
+			allow, reason := b.authorizeTool(promptCtx, name, args, planned.take(name))
+			if !allow {
+				promptCanceled = true
+				cancelPrompt()
+				if reason != "" {
+					// the model hears why and goes on without the call
+					result.denied = deniedCallNote(name, reason)
+					redirected = true
+				}
+				return
+			}
+			if edit, ok := b.editOf(textToolCall{Name: name, Args: args}); ok {
+				// the SDK runs the call as the model made it, so the
+				// bridge runs it itself as remote edited it
+				promptCanceled = true
+				cancelPrompt()
+				if full, ok := b.promptToolbox(ctx).resolve(name); ok {
+					edit.Name, b.edit.Name = full, full
+					result.toolCall = &edit
+					redirected = true
+					return
+				}
+				slog.Warn("onToolCall: cannot run tool with edited arguments", "tool", name)
+				err := b.send(Message{MsgType: msgTypeToolDenied, Content: name})
+				if err != nil {
+					slog.Error("onToolCall: sending message", "err", err)
+				}
+				return
+			}
+			if err := b.limiter.acquire(promptCtx, name); err != nil {
+				slog.Warn("onToolCall: waiting for tool slot", "err", err)
+				return
+			}
+			toolRunning = name
+			toolStart = time.Now()
+		},
+		func(name, args, result string, isError bool) { // onToolResult callback
+			b.metrics.toolResult(isError)
+			b.turn.toolCalls++
+			b.usage.count("tool:" + riskClass(name, b.bridgeConf.RiskClasses))
+			if toolRunning != "" {
+				b.limiter.release(toolRunning)
+				toolRunning = ""
+			}
+			status := auditOK
+			switch {
+			case isError:
+				status = auditFailed
+			case errors.Is(promptCtx.Err(), context.Canceled):
+				status = auditCanceled
+			}
+			ran := b.recordToolRun(name, args, toolStart, status)
+			b.turn.toolRan(name, toolStart, isError)
+			toolStart = time.Time{}
+			b.inspectResult(name, result)
+			if promptCtx.Err() == nil && b.breaker.record(name, isError) {
+				slog.Warn("onToolResult: opening circuit", "tool", name)
+				err := b.send(Message{MsgType: msgTypeUnavailable, Content: name})
+				if err != nil {
+					slog.Error("onToolResult: sending message", "err", err)
+				}
+			}
+			if isError {
+				items := b.sentItems(b.resultItems(parseToolResult(result)))
+				err := b.send(b.failedResult(name, items, ran))
+				if err != nil {
+					slog.Error("onToolResult: sending message", "err", err)
+				}
+				return
+			}
+			if errors.Is(promptCtx.Err(), context.Canceled) {
+				err := b.send(Message{MsgType: msgTypeResultCanceled, Content: name})
+				if err != nil {
+					slog.Error("onToolResult: sending message", "err", err)
+				}
+				return
+			}
+			err := b.send(resultMessage(msgTypeResultOK, name, b.sentItems(b.resultItems(parseToolResult(result))), ran))
+			if err != nil {
+				slog.Error("onToolResult: sending message", "err", err)
+			}
+		},
+		onStreaming)
+	if b.canceler.stop() {
+		promptCanceled = true
+	}
+	if err == nil && !streamed {
+		// the provider does not stream, or mcphost fell back to not streaming
+		simulateStream(promptCtx, response, b.conf.SimulateStreaming, onStreaming)
+	}
+	if strip {
+		reasoning.flush(stream)
+		response = stripReasoning(response, reasoningConf)
+	}
+	if detectText && err == nil {
+		if calls, ok := parseTextToolCalls(response); ok {
+			tools := b.promptToolbox(ctx)
+			for i, call := range calls {
+				if calls[i].Name, ok = tools.resolve(call.Name); !ok {
+					break
+				}
+			}
+			if ok {
+				result.toolCall, result.batch = &calls[0], calls[1:]
+			}
+		}
+	}
+	if result.toolCall == nil || redirected {
+		textTool.release(visible)
+	}
+	if flushErr := chunks.Flush(); flushErr != nil {
+		slog.Error("flushing chunks", "err", flushErr)
+	}
+	if err != nil && !promptCanceled {
+		return result, err
+	}
+	if err != nil && redirected {
+		if err := keepRedirected(host, prompt, partial.String()); err != nil {
+			slog.Error("keeping prompt", "err", err)
+		}
+		return result, nil
+	}
+	if err != nil && len(result.unavailable) == 0 && len(result.invalid) == 0 {
+		retained, err := keepInterrupted(host, prompt, partial.String())
+		if err != nil {
+			slog.Error("keeping partial response", "err", err)
+		}
+		b.turn.finish = finishCanceled
+		if overBudget {
+			b.turn.finish = finishBudget
+		}
+		err = b.send(Message{MsgType: msgTypePromptCanceled, Content: strconv.Itoa(retained)})
+		if err != nil {
+			slog.Error("sending message", "err", err)
+		}
+	}
+	if result.toolCall != nil {
+		return result, nil
+	}
+	if err == nil && b.conf.CodeArtifacts {
+		if err := sendCodeArtifacts(b.send, response); err != nil {
+			slog.Error("sending code artifacts", "err", err)
+		}
+	}
+	if err == nil && b.artifacts != nil {
+		if err := b.artifacts.saveResponse(b.send, response); err != nil {
+			slog.Error("saving artifacts", "err", err)
+		}
+	}
+	if err == nil {
+		result.response = response
+	}
+	return result, nil
+}
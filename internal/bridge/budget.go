@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// budgets of budget-exceeded errors
+const (
+	budgetPromptInput  = "prompt-input"  // Config.MaxInputTokens
+	budgetPromptOutput = "prompt-output" // Config.MaxOutputTokens
+	budgetSession      = "session"       // Config.MaxSessionTokens
+)
+
+// budgetExceeded is the budget of a budget-exceeded error. Tokens are
+// estimated like in done messages.
+type budgetExceeded struct {
+	Budget string `json:"budget"`
+	Limit  int    `json:"limit"`
+	Tokens int    `json:"tokens"` // that the prompt would take or has taken
+}
+
+// sessionSpent returns the tokens the conversation of a session, or the main
+// one, has sent to and received from the model so far.
+func (b *Bridge) sessionSpent(id string) *int {
+	if s, ok := b.sessions[id]; ok {
+		return &s.spent
+	}
+	return &b.spent
+}
+
+// promptBudget checks a prompt for session before it is sent to the model of
+// host, which gets the whole conversation with it. It reports the budget it
+// would exceed, if any.
+func (b *Bridge) promptBudget(host Host, session, prompt string) (budgetExceeded, bool) {
+	input := countContextTokens(host.Messages()).Total + estimateTokens(prompt)
+	if limit := b.conf.MaxInputTokens; limit > 0 && input > limit {
+		return budgetExceeded{Budget: budgetPromptInput, Limit: limit, Tokens: input}, true
+	}
+	if limit, spent := b.conf.MaxSessionTokens, *b.sessionSpent(session); limit > 0 && spent+input > limit {
+		return budgetExceeded{Budget: budgetSession, Limit: limit, Tokens: spent + input}, true
+	}
+	return budgetExceeded{}, false
+}
+
+// outputBudget reports whether a response of length bytes exceeds
+// Config.MaxOutputTokens.
+func (b *Bridge) outputBudget(length int) (budgetExceeded, bool) {
+	tokens := (length + 3) / 4 // like estimateTokens
+	if limit := b.conf.MaxOutputTokens; limit > 0 && tokens > limit {
+		return budgetExceeded{Budget: budgetPromptOutput, Limit: limit, Tokens: tokens}, true
+	}
+	return budgetExceeded{}, false
+}
+
+// spend counts the conversation of host, as sent to the model for the turn
+// and with the response received, against the session budget.
+func (b *Bridge) spend(host Host, session string) {
+	*b.sessionSpent(session) += countContextTokens(host.Messages()).Total
+}
+
+// sendBudgetExceeded tells remote that a prompt was not run, or its response
+// cut off, as it exceeded a budget. Metered providers charge the tokens.
+func (b *Bridge) sendBudgetExceeded(e budgetExceeded) error {
+	msg := fmt.Sprintf("the %s budget of %d tokens is exceeded, with %d tokens", e.Budget, e.Limit, e.Tokens)
+	slog.Warn(msg)
+	return b.sendError(bridgeError{Code: errorBudgetExceeded, Message: msg, Budget: &e})
+}
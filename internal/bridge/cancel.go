@@ -0,0 +1,46 @@
+package bridge
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// promptCanceler cancels the model call of the running prompt for
+// cancel-prompt messages. These are handled as soon as they are read, as the
+// bridge does not read from remote while the model generates.
+type promptCanceler struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc // nil while no model call runs
+	canceled bool
+}
+
+// start makes cancel-prompt call cancel until stop.
+func (p *promptCanceler) start(cancel context.CancelFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancel, p.canceled = cancel, false
+}
+
+// stop reports whether remote canceled the model call since start.
+func (p *promptCanceler) stop() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancel = nil
+	return p.canceled
+}
+
+// cancelPrompt cancels the running model call, if any, for a cancel-prompt
+// message of remote.
+func (b *Bridge) cancelPrompt() {
+	p := &b.canceler
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel == nil {
+		slog.Info("no prompt to cancel")
+		return
+	}
+	slog.Info("prompt canceled by remote")
+	p.cancel()
+	p.canceled = true
+}
@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// checkpoint is the state of a conversation saved under a name, to roll back
+// to after the model tried a risky change that went wrong.
+type checkpoint struct {
+	saved       time.Time
+	messages    []*schema.Message
+	decisions   *decisionCache // approvals with scope session and duration
+	attachments map[string]attachment
+}
+
+// checkpointInfo is the meta.checkpoint of checkpoint-saved and rolled-back
+// messages.
+type checkpointInfo struct {
+	Name     string    `json:"name"`
+	Saved    time.Time `json:"saved"`
+	Messages int       `json:"messages"` // of the conversation at the checkpoint
+	Removed  int       `json:"removed"`  // messages after the checkpoint that were dropped, in rolled-back
+}
+
+// handleCheckpoint saves the conversation of the session or agent of msg,
+// with its approvals and attachments, under the name in content. A
+// checkpoint of the same name is replaced.
+func (b *Bridge) handleCheckpoint(host Host, msg Message) error {
+	if h, _, ok := b.sessionHost(msg.Session); ok {
+		host = h
+	} else if h, ok := b.agentHosts[msg.Agent]; ok {
+		host = h
+	}
+	cp := checkpoint{
+		saved:       time.Now(),
+		messages:    slices.Clone(host.Messages()),
+		decisions:   b.sessionDecisions(msg.Session).clone(),
+		attachments: maps.Clone(b.attachmentStore(msg.Session)),
+	}
+	if b.checkpoints == nil {
+		b.checkpoints = map[Host]map[string]checkpoint{}
+	}
+	if b.checkpoints[host] == nil {
+		b.checkpoints[host] = map[string]checkpoint{}
+	}
+	b.checkpoints[host][msg.Content] = cp
+	slog.Info("saved checkpoint", "name", msg.Content, "session", msg.Session, "agent", msg.Agent, "messages", len(cp.messages))
+	info := checkpointInfo{Name: msg.Content, Saved: cp.saved, Messages: len(cp.messages)}
+	reply := Message{MsgType: msgTypeCheckpointSaved, Content: msg.Content, Session: msg.Session, Agent: msg.Agent}
+	return b.send(reply.withMeta("checkpoint", info))
+}
+
+// handleRollback restores the conversation of the session or agent of msg,
+// with its approvals and attachments, to the checkpoint named in content.
+// The checkpoint is kept, so remote can roll back to it again.
+func (b *Bridge) handleRollback(host Host, msg Message) error {
+	if h, _, ok := b.sessionHost(msg.Session); ok {
+		host = h
+	} else if h, ok := b.agentHosts[msg.Agent]; ok {
+		host = h
+	}
+	cp, ok := b.checkpoints[host][msg.Content]
+	if !ok {
+		return b.sendError(bridgeError{Code: errorUnknownCheckpoint,
+			Message: fmt.Sprintf("no checkpoint %q in the conversation", msg.Content)})
+	}
+	removed := max(len(host.Messages())-len(cp.messages), 0)
+	if err := host.ReplaceMessages(slices.Clone(cp.messages)); err != nil {
+		return err
+	}
+	if s, ok := b.sessions[msg.Session]; ok {
+		s.decisions = cp.decisions.clone()
+	} else {
+		b.decisions = cp.decisions.clone()
+	}
+	store := b.attachmentStore(msg.Session)
+	clear(store)
+	maps.Copy(store, cp.attachments)
+	delete(b.contextWarned, host)
+	slog.Info("rolled back to checkpoint", "name", msg.Content, "session", msg.Session, "agent", msg.Agent, "removed", removed)
+	info := checkpointInfo{Name: msg.Content, Saved: cp.saved, Messages: len(cp.messages), Removed: removed}
+	reply := Message{MsgType: msgTypeRolledBack, Content: msg.Content, Session: msg.Session, Agent: msg.Agent}
+	return b.send(reply.withMeta("checkpoint", info))
+}
@@ -0,0 +1,164 @@
+package bridge
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	boundaryWord     = "word"
+	boundarySentence = "sentence"
+
+	// boundaryHold is how long text waits for its boundary while the model
+	// pauses, without a rate limit to wait as long as.
+	boundaryHold = 250 * time.Millisecond
+)
+
+// chunkWriter forwards streamed chunks to remote, aggregating them into
+// fewer messages if they arrive faster than the configured rate. With a
+// boundary set, text after the last word or sentence boundary is held back
+// until the boundary is complete. Text held back is sent once the model
+// pauses for the interval, so the tail of a stream does not wait for the
+// next chunk.
+type chunkWriter struct {
+	send     func(Message) error
+	interval time.Duration // minimum time between two chunk messages, 0 for no limit
+	boundary string        // boundaryWord, boundarySentence or empty for none
+	last     time.Time
+	pending  strings.Builder
+
+	mu    sync.Mutex // the flush timer sends as well
+	timer *time.Timer
+}
+
+func newChunkWriter(send func(Message) error, perSecond int, boundary string) *chunkWriter {
+	cw := &chunkWriter{send: send, boundary: boundary}
+	if perSecond > 0 {
+		cw.interval = time.Second / time.Duration(perSecond)
+	}
+	return cw
+}
+
+func (cw *chunkWriter) Write(chunk string) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	defer cw.holdBack()
+	cw.pending.WriteString(chunk)
+	if time.Since(cw.last) < cw.interval {
+		return nil
+	}
+	content := cw.pending.String()
+	n := boundaryIndex(content, cw.boundary)
+	if n == 0 {
+		return nil
+	}
+	cw.pending.Reset()
+	cw.pending.WriteString(content[n:])
+	return cw.sendChunk(content[:n])
+}
+
+// holdBack starts the flush timer over while text is held back.
+func (cw *chunkWriter) holdBack() {
+	wait := cw.interval
+	if wait == 0 {
+		wait = boundaryHold
+	}
+	switch {
+	case cw.pending.Len() == 0:
+		if cw.timer != nil {
+			cw.timer.Stop()
+		}
+	case cw.timer == nil:
+		cw.timer = time.AfterFunc(wait, func() {
+			if err := cw.Flush(); err != nil {
+				slog.Error("flushing held back chunks", "err", err)
+			}
+		})
+	default:
+		cw.timer.Reset(wait)
+	}
+}
+
+// Flush sends any aggregated chunks. It must be called before other messages
+// are sent to remote, and at the end of the response.
+func (cw *chunkWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	if cw.pending.Len() == 0 {
+		return nil
+	}
+	content := cw.pending.String()
+	cw.pending.Reset()
+	return cw.sendChunk(content)
+}
+
+func (cw *chunkWriter) sendChunk(content string) error {
+	cw.last = time.Now()
+	return cw.send(Message{MsgType: msgTypeChunk, Content: content})
+}
+
+// boundaryIndex returns the length of the prefix of s that ends at the last
+// boundary, including the white space after it. Without a boundary that is
+// all of s.
+func boundaryIndex(s, boundary string) int {
+	if boundary != boundaryWord && boundary != boundarySentence {
+		return len(s)
+	}
+	n := 0
+	for i, r := range s {
+		if i == 0 || !unicode.IsSpace(r) {
+			continue
+		}
+		if boundary == boundarySentence && r != '\n' && !strings.ContainsAny(s[i-1:i], ".!?:") {
+			continue
+		}
+		n = i + utf8.RuneLen(r)
+	}
+	return n
+}
+
+// simulateStream hands a complete response to write word by word, at
+// perSecond words, or all at once if perSecond is 0. The rest is written at
+// once if ctx is done.
+func simulateStream(ctx context.Context, response string, perSecond int, write func(string)) {
+	if response == "" {
+		return
+	}
+	if perSecond <= 0 {
+		write(response)
+		return
+	}
+	interval := time.Second / time.Duration(perSecond)
+	for response != "" {
+		n := nextWord(response)
+		write(response[:n])
+		response = response[n:]
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			if response != "" {
+				write(response)
+			}
+			return
+		}
+	}
+}
+
+// nextWord returns the length of the first word of s including the white
+// space around it.
+func nextWord(s string) int {
+	start := len(s) - len(strings.TrimLeftFunc(s, unicode.IsSpace))
+	end := strings.IndexFunc(s[start:], unicode.IsSpace)
+	if end < 0 {
+		return len(s)
+	}
+	return len(s) - len(strings.TrimLeftFunc(s[start+end:], unicode.IsSpace))
+}
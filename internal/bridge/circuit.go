@@ -0,0 +1,62 @@
+package bridge
+
+import (
+	"time"
+)
+
+// circuitBreaker disables tools that keep failing. After threshold failures
+// in a row the circuit of a tool opens and calls are refused. Once cooldown
+// has passed, a single probe call is let through (half-open): success closes
+// the circuit, another failure opens it again.
+type circuitBreaker struct {
+	threshold int // 0 to disable
+	cooldown  time.Duration
+	circuits  map[string]*circuit // keyed by tool name
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time // zero while closed
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, circuits: map[string]*circuit{}}
+}
+
+// allow reports whether tool may be called now.
+func (b *circuitBreaker) allow(tool string) bool {
+	c, ok := b.circuits[tool]
+	if !ok || c.openedAt.IsZero() {
+		return true
+	}
+	if c.probing || time.Since(c.openedAt) < b.cooldown {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// record notes the outcome of a tool call and reports whether it opened the
+// circuit of the tool.
+func (b *circuitBreaker) record(tool string, failed bool) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+	c, ok := b.circuits[tool]
+	if !ok {
+		c = &circuit{}
+		b.circuits[tool] = c
+	}
+	if !failed {
+		*c = circuit{}
+		return false
+	}
+	c.failures++
+	if c.probing || (c.openedAt.IsZero() && c.failures >= b.threshold) {
+		c.openedAt = time.Now()
+		c.probing = false
+		return true
+	}
+	return false
+}
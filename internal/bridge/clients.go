@@ -0,0 +1,310 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// clients are the frontends attached in multi-client mode. They share the
+// conversation: their input is merged, and everything the bridge sends goes
+// to all of them. Only one prompt runs at a time, a prompt sent meanwhile is
+// held back until the bridge is ready again, so it cannot be taken for the
+// reply to a confirmation of the running prompt. Observers get the output
+// too, but their input is ignored.
+//
+// With Config.ReattachGrace, the work goes on for that long after the last
+// client detached, and the output meanwhile is kept for a client attaching
+// again to ask for with resume-stream.
+type clients struct {
+	b        *Bridge
+	done     <-chan struct{}
+	lines    chan inputLine // merged input of all clients
+	attached chan struct{}  // closed when the first client attaches
+
+	mu      sync.Mutex
+	conns   map[io.ReadWriteCloser]bool // true for observers
+	running bool                        // a prompt is running
+	session string                      // the session of the running prompt
+	idle    chan struct{}               // closed when the running prompt is done
+
+	grace  *time.Timer // disconnects when it runs out, nil while clients are attached
+	missed [][]byte    // lines sent during the grace period
+}
+
+// Serve runs the bridge for the frontends returned by accept until one of
+// them quits, closing host at the end. Frontends may attach and detach at any
+// time, if the last one that is not an observer detaches the work is
+// canceled and ErrConnectionLost returned, after Config.ReattachGrace.
+func (b *Bridge) Serve(ctx context.Context, host Host, accept func() (io.ReadWriteCloser, error)) error {
+	ctx, b.disconnect = context.WithCancelCause(ctx)
+	defer b.disconnect(nil)
+	b.clients = &clients{
+		b:        b,
+		done:     ctx.Done(),
+		lines:    make(chan inputLine),
+		attached: make(chan struct{}),
+		conns:    map[io.ReadWriteCloser]bool{},
+	}
+	defer b.clients.closeAll()
+	go b.clients.accept(accept)
+	select {
+	case <-b.clients.attached:
+	case <-ctx.Done():
+		host.Close()
+		return context.Cause(ctx)
+	}
+	return b.serve(ctx, host, b.clients.lines, b.clients)
+}
+
+func (c *clients) accept(accept func() (io.ReadWriteCloser, error)) {
+	for {
+		conn, err := accept()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				slog.Error("accepting frontend", "err", err)
+				c.b.disconnect(err)
+			}
+			return
+		}
+		c.add(conn)
+	}
+}
+
+func (c *clients) add(conn io.ReadWriteCloser) {
+	c.mu.Lock()
+	c.conns[conn] = false
+	idle := !c.running
+	if c.grace != nil {
+		c.grace.Stop()
+		c.grace = nil
+	}
+	c.mu.Unlock()
+	slog.Info("frontend attached")
+	select {
+	case <-c.attached:
+		// the others got the hello and ready messages already
+		if hello, err := c.b.helloMessage(); err == nil {
+			c.writeTo(conn, hello)
+		}
+		if idle {
+			if ready, err := c.b.readyMessage(); err == nil {
+				c.writeTo(conn, ready)
+			}
+		}
+	default:
+		close(c.attached)
+	}
+	go c.read(conn)
+}
+
+// read forwards the lines of conn to the bridge, holding prompts back while
+// another prompt runs.
+func (c *clients) read(conn io.ReadWriteCloser) {
+	defer c.remove(conn)
+	scanner := c.b.newScanner(conn, func(e bridgeError) { c.writeTo(conn, errorMessage(e)) })
+	for scanner.Scan() {
+		line := inputLine{line: append([]byte(nil), scanner.Bytes()...)}
+		var msg Message
+		if json.Unmarshal(line.line, &msg) == nil && msg.MsgType == msgTypeObserve {
+			c.observe(conn)
+			continue
+		}
+		if msg.MsgType == msgTypeResumeStream {
+			c.resume(conn)
+			continue
+		}
+		c.b.heartbeat.seen()
+		if msg.MsgType == msgTypePing {
+			c.writeTo(conn, Message{ID: msg.ID, MsgType: msgTypePong})
+			continue
+		}
+		if msg.MsgType == msgTypePong {
+			continue
+		}
+		observer, attached := c.role(conn)
+		if !attached {
+			return // dropped after failing
+		}
+		if observer {
+			slog.Warn("ignoring message of observer", "MsgType", msg.MsgType)
+			continue
+		}
+		if msg.MsgType == msgTypeCancelPrompt {
+			c.b.cancelPrompt()
+			continue
+		}
+		if msg.MsgType == msgTypePrompt && !c.hold(conn, msg.Session) {
+			return
+		}
+		select {
+		case c.lines <- line:
+		case <-c.done:
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Warn("reading from frontend", "err", err)
+	}
+}
+
+// hold waits until no prompt runs, telling conn that the session is locked
+// if one does, and then marks a prompt of session running. It returns false
+// if the bridge stops meanwhile.
+func (c *clients) hold(conn io.ReadWriteCloser, session string) bool {
+	c.mu.Lock()
+	for c.running {
+		idle, session := c.idle, c.session
+		c.mu.Unlock()
+		c.writeTo(conn, Message{MsgType: msgTypeSessionLocked, Session: session})
+		select {
+		case <-idle:
+		case <-c.done:
+			return false
+		}
+		c.mu.Lock()
+	}
+	c.running = true
+	c.session = session
+	c.idle = make(chan struct{})
+	c.mu.Unlock()
+	return true
+}
+
+// release lets the next prompt in, called when the bridge is ready again or
+// dropped the prompt.
+func (c *clients) release() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		c.running = false
+		c.session = ""
+		close(c.idle)
+	}
+}
+
+func (c *clients) observe(conn io.ReadWriteCloser) {
+	c.mu.Lock()
+	c.conns[conn] = true
+	c.mu.Unlock()
+	slog.Info("frontend observes")
+}
+
+func (c *clients) role(conn io.ReadWriteCloser) (observer, attached bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	observer, attached = c.conns[conn]
+	return observer, attached
+}
+
+func (c *clients) remove(conn io.ReadWriteCloser) {
+	c.mu.Lock()
+	observer, attached := c.conns[conn]
+	delete(c.conns, conn)
+	last := attached && !observer
+	for _, observer := range c.conns {
+		last = last && observer
+	}
+	c.mu.Unlock()
+	if !attached {
+		return
+	}
+	conn.Close()
+	slog.Info("frontend detached")
+	if !last {
+		return
+	}
+	grace := c.b.conf.ReattachGrace
+	if grace <= 0 {
+		c.b.disconnect(ErrConnectionLost)
+		return
+	}
+	slog.Info("waiting for a frontend to reattach", "grace", grace)
+	c.mu.Lock()
+	c.grace = time.AfterFunc(grace, func() { c.b.disconnect(ErrConnectionLost) })
+	c.mu.Unlock()
+}
+
+// resume sends conn the lines missed since the last client detached.
+func (c *clients) resume(conn io.ReadWriteCloser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, line := range c.missed {
+		if _, err := conn.Write(line); err != nil {
+			slog.Warn("writing to frontend", "err", err)
+			return
+		}
+	}
+	slog.Info("frontend resumed", "lines", len(c.missed))
+	c.missed = nil
+}
+
+// Write sends a line of output to all clients, dropping those that fail.
+func (c *clients) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.grace != nil {
+		c.missed = append(c.missed, bytes.Clone(p))
+	}
+	var failed []io.ReadWriteCloser
+	for conn := range c.conns {
+		if _, err := conn.Write(p); err != nil {
+			slog.Warn("writing to frontend", "err", err)
+			failed = append(failed, conn)
+		}
+	}
+	c.mu.Unlock()
+	for _, conn := range failed {
+		c.remove(conn)
+	}
+	return len(p), nil
+}
+
+// writeTo sends a message to one client only, bypassing the middlewares.
+func (c *clients) writeTo(conn io.ReadWriteCloser, msg Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		slog.Warn("writing to frontend", "err", err)
+	}
+}
+
+func (c *clients) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.Close()
+		delete(c.conns, conn)
+	}
+}
+
+// newScanner returns a scanner of the lines from remote. Lines over the size
+// limit are skipped and reported with report.
+func (b *Bridge) newScanner(in io.Reader, report func(bridgeError)) *bufio.Scanner {
+	limit := b.conf.MaxMessageSize
+	if limit <= 0 {
+		limit = defaultMaxMessage
+	}
+	scanner := bufio.NewScanner(in)
+	initial := 4096
+	if b.conf.LowMemory {
+		initial = lowMemoryBuffer
+	}
+	scanner.Buffer(make([]byte, 0, min(initial, limit)), limit)
+	splitter := &lineSplitter{max: limit, tooLarge: func(size int) {
+		slog.Warn("skipping message over the size limit", "size", size, "limit", limit)
+		report(bridgeError{Code: errorMessageTooLarge, Message: fmt.Sprintf("message of %d bytes skipped, the limit is %d", size, limit)})
+	}}
+	scanner.Split(splitter.split)
+	return scanner
+}
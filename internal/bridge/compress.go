@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+const (
+	encodingGzip = "gzip" // content is base64 encoded gzip data
+
+	maxDecodedContent = 32 << 20 // refuse to inflate content beyond 32 MiB
+)
+
+// compressContent gzips and base64 encodes the content of msg if it is at
+// least minSize bytes long and the result is actually smaller.
+func compressContent(msg Message, minSize int) (Message, error) {
+	if msg.Encoding != "" || len(msg.Content) < minSize {
+		return msg, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(msg.Content)); err != nil {
+		return msg, err
+	}
+	if err := zw.Close(); err != nil {
+		return msg, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) >= len(msg.Content) {
+		return msg, nil
+	}
+	msg.Content = encoded
+	msg.Encoding = encodingGzip
+	return msg, nil
+}
+
+// decompressContent reverses compressContent for messages sent by remote.
+func decompressContent(msg Message) (Message, error) {
+	switch msg.Encoding {
+	case "":
+		return msg, nil
+	case encodingGzip:
+		b, err := base64.StdEncoding.DecodeString(msg.Content)
+		if err != nil {
+			return msg, fmt.Errorf("decoding content: %w", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return msg, fmt.Errorf("decompressing content: %w", err)
+		}
+		defer zr.Close()
+		content, err := io.ReadAll(io.LimitReader(zr, maxDecodedContent+1))
+		if err != nil {
+			return msg, fmt.Errorf("decompressing content: %w", err)
+		}
+		if len(content) > maxDecodedContent {
+			return msg, fmt.Errorf("decompressed content exceeds %d bytes", maxDecodedContent)
+		}
+		msg.Content = string(content)
+		msg.Encoding = ""
+		return msg, nil
+	default:
+		return msg, fmt.Errorf("unsupported content encoding %q", msg.Encoding)
+	}
+}
@@ -0,0 +1,53 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// bridgeConfig holds settings of the bridge itself, kept separate from the
+// mcphost configuration so it works with any config file format.
+type bridgeConfig struct {
+	Servers     map[string]serverConfig    `json:"servers"`     // keyed by MCP server name
+	RiskClasses map[string]string          `json:"riskClasses"` // tool name pattern to risk class, passed to the policy
+	Retries     map[string]retryPolicy     `json:"retries"`     // tool name pattern to retry policy
+	Agents      map[string]agentProfile    `json:"agents"`      // specialized assistants, keyed by name
+	Router      string                     `json:"router"`      // model choosing the agent for prompts that name none
+	Reasoning   map[string]reasoningConfig `json:"reasoning"`   // model pattern to reasoning tags stripped from responses
+	Tools       map[string]toolDoc         `json:"tools"`       // tool name pattern to better docs for the model
+	Jobs        map[string]jobConfig       `json:"jobs"`        // prompts run on a schedule in service mode, keyed by name
+	Templates   map[string]promptTemplate  `json:"templates"`   // prompt templates with post-processing, keyed by name
+	ArgRules    map[string][]argRule       `json:"argRules"`    // tool name pattern to rewrites of its arguments
+	Summaries   map[string]string          `json:"summaries"`   // tool name pattern to text/template of the arguments, see toolSummary
+
+	ProviderGroups []providerGroup `json:"providerGroups"` // models failing over to each other
+}
+
+type serverConfig struct {
+	MaxParallelTools int    `json:"maxParallelTools"` // 0 for no limit
+	SELinux          string `json:"selinux"`          // SELinux context to launch the server in, with runcon
+	AppArmor         string `json:"apparmor"`         // AppArmor profile to launch the server in, with aa-exec
+	Trust            string `json:"trust"`            // trusted, ask or blocked, see serverTrust
+}
+
+func loadBridgeConfig(path string) (bridgeConfig, error) {
+	conf := bridgeConfig{}
+	if path == "" {
+		return conf, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	err = json.Unmarshal(b, &conf)
+	if err != nil {
+		return conf, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for name, server := range conf.Servers {
+		if err := checkTrust(name, server.Trust); err != nil {
+			return conf, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return conf, nil
+}
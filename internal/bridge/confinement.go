@@ -0,0 +1,207 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// confinement returns how server is to be confined, like "selinux:<context>",
+// or "" if it runs unconfined.
+func (s serverConfig) confinement() string {
+	switch {
+	case s.SELinux != "":
+		return "selinux:" + s.SELinux
+	case s.AppArmor != "":
+		return "apparmor:" + s.AppArmor
+	}
+	return ""
+}
+
+// confine returns cmd launched in the SELinux context or AppArmor profile of
+// the server. Both tools exec the command, so it keeps its process.
+func (s serverConfig) confine(cmd []string) []string {
+	switch {
+	case s.SELinux != "":
+		return append([]string{"runcon", s.SELinux}, cmd...)
+	case s.AppArmor != "":
+		return append([]string{"aa-exec", "-p", s.AppArmor, "--"}, cmd...)
+	}
+	return cmd
+}
+
+// confinedConfig returns an mcphost configuration like the one at path, with
+// the commands of the servers confined as configured. It is written to a
+// temporary file once and path returned unchanged if no server is confined.
+func (b *Bridge) confinedConfig(path string) (string, error) {
+	if path == "" {
+		return path, nil
+	}
+	if confined, ok := b.confined[path]; ok {
+		return confined, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// the references to environment variables are left for mcphost
+	var conf map[string]any
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return "", fmt.Errorf("parsing %s: %w", path, err)
+	}
+	servers, _ := conf["mcpServers"].(map[string]any)
+	changed := false
+	for name, entry := range servers {
+		server, ok := entry.(map[string]any)
+		sc := b.bridgeConf.Servers[name]
+		if !ok || sc.confinement() == "" {
+			continue
+		}
+		if sc.SELinux != "" && sc.AppArmor != "" {
+			return "", fmt.Errorf("server %s: both an SELinux context and an AppArmor profile configured", name)
+		}
+		switch command := server["command"].(type) {
+		case []any:
+			var cmd []string
+			for _, part := range command {
+				cmd = append(cmd, fmt.Sprint(part))
+			}
+			server["command"] = sc.confine(cmd)
+		case string: // legacy format with separate args
+			args, _ := server["args"].([]any)
+			cmd := sc.confine([]string{command})
+			server["command"] = cmd[0]
+			for _, arg := range slices.Backward(cmd[1:]) {
+				args = slices.Insert(args, 0, any(arg))
+			}
+			server["args"] = args
+		default:
+			return "", fmt.Errorf("server %s: confinement needs a local server with a command", name)
+		}
+		changed = true
+	}
+	if !changed {
+		b.confined[path] = path
+		return path, nil
+	}
+	f, err := os.CreateTemp("", "mcphost-cockpit-confined-*.json")
+	if err != nil {
+		return "", err
+	}
+	err = json.NewEncoder(f).Encode(conf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	b.confined[path] = f.Name()
+	return f.Name(), nil
+}
+
+func (b *Bridge) removeConfinedConfigs() {
+	for path, confined := range b.confined {
+		if confined != path {
+			os.Remove(confined)
+		}
+		delete(b.confined, path)
+	}
+}
+
+// serverStatus is the confinement of an MCP server, as configured and as
+// found on its processes.
+type serverStatus struct {
+	Server     string   `json:"server"`
+	Configured string   `json:"configured"` // like "selinux:<context>", empty if unconfined
+	Effective  []string `json:"effective"`  // security context of each process of the server found
+}
+
+// handleServerStatus sends the confinement of the servers of the default
+// agent.
+func (b *Bridge) handleServerStatus() error {
+	servers, err := loadMCPServers(b.conf.ConfigFile) // with the commands as exec'ed by runcon or aa-exec
+	if err != nil {
+		return err
+	}
+	procs := childProcesses()
+	statuses := []serverStatus{}
+	for _, name := range slices.Sorted(maps.Keys(servers)) {
+		status := serverStatus{Server: name, Configured: b.bridgeConf.Servers[name].confinement(), Effective: []string{}}
+		cmd := servers[name].command()
+		for _, p := range procs {
+			if len(cmd) > 0 && filepath.Base(p.cmdline[0]) == filepath.Base(cmd[0]) && slices.Equal(p.cmdline[1:], cmd[1:]) {
+				status.Effective = append(status.Effective, p.context)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeServerStatus, Content: string(data)})
+}
+
+type process struct {
+	cmdline []string
+	context string // SELinux context or AppArmor profile from /proc/<pid>/attr/current
+}
+
+// childProcesses returns the processes the bridge started. It finds none on
+// systems without /proc.
+func childProcesses() []process {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self := strconv.Itoa(os.Getpid())
+	var procs []process
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join("/proc", e.Name())
+		stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		if ppid, ok := statParent(stat); !ok || ppid != self {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		p := process{cmdline: strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), context: "unknown"}
+		if current, err := os.ReadFile(filepath.Join(dir, "attr", "current")); err == nil {
+			p.context = strings.TrimSpace(strings.TrimRight(string(current), "\x00"))
+		}
+		procs = append(procs, p)
+	}
+	return procs
+}
+
+// statParent returns the parent process ID from the contents of
+// /proc/<pid>/stat. The command name in parentheses before it may contain
+// anything, spaces and parentheses too, but the last ")" ends it.
+func statParent(stat []byte) (string, bool) {
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return "", false
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 2 {
+		return "", false
+	}
+	return fields[1], true
+}
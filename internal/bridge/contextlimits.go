@@ -0,0 +1,133 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// compactKeepTurns are the last turns kept as they are when older ones are
+// summarized, so the model still sees what it is working on in detail.
+const compactKeepTurns = 2
+
+// warnContextUsage is the code of the warning that the conversation fills a
+// share of the context window of the model, see Config.ContextWarnings.
+const warnContextUsage = "context-usage"
+
+// contextUsage is the meta.context of a context-usage warning.
+type contextUsage struct {
+	Tokens    int  `json:"tokens"` // estimated, like in done messages
+	Window    int  `json:"window"`
+	Percent   int  `json:"percent"`
+	Threshold int  `json:"threshold"` // the percentage crossed
+	Last      bool `json:"last"`      // of the thresholds, the hard limit
+}
+
+// parseContextWarnings returns the percentages of a comma separated list in
+// ascending order.
+func parseContextWarnings(list string) ([]int, error) {
+	var thresholds []int
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+		if s == "" {
+			continue
+		}
+		p, err := strconv.Atoi(s)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("context warning %q is no percentage", s)
+		}
+		thresholds = append(thresholds, p)
+	}
+	slices.Sort(thresholds)
+	return slices.Compact(thresholds), nil
+}
+
+// warnContext tells remote once per threshold of Config.ContextWarnings that
+// the conversation of host has grown past it, so the user may start a new
+// session before the model loses track. A conversation shrunk below a
+// threshold, e.g. by a summary, warns again when it crosses it once more.
+func (b *Bridge) warnContext(host Host, tokens int) {
+	window := b.conf.ContextWindow
+	thresholds, _ := parseContextWarnings(b.conf.ContextWarnings) // checked by Validate
+	if window <= 0 || len(thresholds) == 0 {
+		return
+	}
+	percent := tokens * 100 / window
+	crossed := 0
+	for _, t := range thresholds {
+		if percent >= t {
+			crossed = t
+		}
+	}
+	if b.contextWarned == nil {
+		b.contextWarned = map[Host]int{}
+	}
+	warned := b.contextWarned[host]
+	b.contextWarned[host] = crossed
+	if crossed == 0 || crossed <= warned {
+		return
+	}
+	last := crossed == thresholds[len(thresholds)-1]
+	msg := fmt.Sprintf("the conversation takes %d of the %d tokens of the context (%d%%), start a new session soon", tokens, window, percent)
+	if last {
+		msg = fmt.Sprintf("the conversation takes %d of the %d tokens of the context (%d%%), start a new session now, the model may lose track of it", tokens, window, percent)
+	}
+	slog.Warn(msg)
+	usage := contextUsage{Tokens: tokens, Window: window, Percent: percent, Threshold: crossed, Last: last}
+	if err := b.send(warningMessage(bridgeError{Code: warnContextUsage, Message: msg}).withMeta("context", usage)); err != nil {
+		slog.Error("sending message", "err", err)
+	}
+}
+
+// compaction is the meta.compaction of a context-compacted message.
+type compaction struct {
+	Turns        int `json:"turns"`        // summarized
+	TokensBefore int `json:"tokensBefore"` // estimated, like in done messages
+	TokensAfter  int `json:"tokensAfter"`
+}
+
+// compactContext summarizes the older turns of the conversation of host with
+// its own model once it takes Config.CompactAt percent of the context window,
+// and replaces them with the summary. Long sessions go on instead of failing
+// when the context runs full. Remote is told with a context-compacted message.
+func (b *Bridge) compactContext(ctx context.Context, host Host, session string) error {
+	window, at := b.conf.ContextWindow, b.conf.CompactAt
+	messages := host.Messages()
+	before := countContextTokens(messages)
+	if window <= 0 || at <= 0 || before.Total*100 < at*window || len(before.Turns) <= compactKeepTurns {
+		return nil
+	}
+	first := slices.IndexFunc(messages, func(m *schema.Message) bool { return m.Role != schema.System })
+	split := len(messages)
+	for kept := 0; kept < compactKeepTurns; {
+		split--
+		if messages[split].Role == schema.User {
+			kept++
+		}
+	}
+	if first < 0 || split <= first {
+		return nil
+	}
+	err := host.ReplaceMessages(messages[:split])
+	var summary string
+	if err == nil {
+		summary, err = b.summarize(ctx, host, "")
+	}
+	if err != nil {
+		slog.Warn("compacting the conversation", "err", err)
+		return host.ReplaceMessages(messages)
+	}
+	compacted := slices.Concat(messages[:first], summaryMessages(summary), messages[split:])
+	if err := host.ReplaceMessages(compacted); err != nil {
+		return err
+	}
+	info := compaction{Turns: len(before.Turns) - compactKeepTurns, TokensBefore: before.Total, TokensAfter: countContextTokens(compacted).Total}
+	slog.Info("compacted conversation", "session", session, "turns", info.Turns, "tokens", info.TokensBefore, "now", info.TokensAfter)
+	reply := Message{MsgType: msgTypeContextCompacted, Content: summary, Session: session}
+	return b.send(reply.withMeta("compaction", info))
+}
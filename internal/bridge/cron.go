@@ -0,0 +1,122 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is a cron-like job schedule: five fields for minute, hour, day of
+// month, month and day of week with *, lists, ranges and steps, or one of
+// @hourly, @daily, @weekly and "@every <duration>".
+type schedule struct {
+	fields [5]map[int]bool // nil for *
+	every  time.Duration
+}
+
+var scheduleAliases = map[string]string{
+	"@hourly": "0 * * * *",
+	"@daily":  "0 0 * * *",
+	"@weekly": "0 0 * * 0",
+}
+
+var scheduleRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseSchedule(spec string) (schedule, error) {
+	var s schedule
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return s, err
+		}
+		if every < time.Minute {
+			return s, fmt.Errorf("interval %s is less than a minute", every)
+		}
+		s.every = every
+		return s, nil
+	}
+	if alias, ok := scheduleAliases[spec]; ok {
+		spec = alias
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return s, fmt.Errorf("schedule %q does not have five fields", spec)
+	}
+	for i, field := range fields {
+		values, err := parseScheduleField(field, scheduleRanges[i][0], scheduleRanges[i][1])
+		if err != nil {
+			return s, fmt.Errorf("schedule %q: %w", spec, err)
+		}
+		s.fields[i] = values
+	}
+	if dow := s.fields[4]; dow[7] {
+		dow[0] = true // Sunday either way
+	}
+	return s, nil
+}
+
+// parseScheduleField returns the values of a field, or nil for *.
+func parseScheduleField(field string, lo, hi int) (map[int]bool, error) {
+	if field == "*" {
+		return nil, nil
+	}
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rng, step, hasStep := strings.Cut(part, "/")
+		by := 1
+		if hasStep {
+			var err error
+			by, err = strconv.Atoi(step)
+			if err != nil || by < 1 {
+				return nil, fmt.Errorf("bad step %q", step)
+			}
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			from, err = strconv.Atoi(first)
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q", first)
+			}
+			to = from
+			if isRange {
+				to, err = strconv.Atoi(last)
+				if err != nil {
+					return nil, fmt.Errorf("bad value %q", last)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += by {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// due reports whether a job on the schedule is to run at t, given that it last
+// ran at last.
+func (s schedule) due(t, last time.Time) bool {
+	if s.every > 0 {
+		return last.IsZero() || t.Sub(last) >= s.every
+	}
+	if t.Truncate(time.Minute).Equal(last.Truncate(time.Minute)) {
+		return false
+	}
+	match := func(i, v int) bool { return s.fields[i] == nil || s.fields[i][v] }
+	if !match(0, t.Minute()) || !match(1, t.Hour()) || !match(3, int(t.Month())) {
+		return false
+	}
+	// like cron, either day matches if both are restricted
+	dom, dow := match(2, t.Day()), match(4, int(t.Weekday()))
+	if s.fields[2] != nil && s.fields[4] != nil {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,156 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// Reasons a response ended, in done messages.
+const (
+	finishStop         = "stop"          // the model answered
+	finishCanceled     = "canceled"      // the prompt was canceled, see prompt-canceled
+	finishPlanRejected = "plan-rejected" // remote rejected the plan of the prompt
+	finishToolRefused  = "tool-refused"  // a tool call written as text was refused
+	finishBudget       = "budget"        // the response was cut off at Config.MaxOutputTokens
+	finishNotRun       = "not-run"       // the prompt was refused, see the error sent before
+)
+
+// turnStats follows the prompt being handled, for its done message.
+type turnStats struct {
+	start      time.Time
+	model      string    // of the host that ran the prompt last
+	firstToken time.Time // zero until the first chunk of the response
+	toolCalls  int
+	tools      []toolUsage // in the order first run
+	finish     string
+
+	// injection is the last tool output that looked like instructions, see
+	// inspectResult.
+	injection *injectionSuspect
+}
+
+// toolsUsed is the stats.tools of a done message, for remote to show what
+// ran in a turn like "used 3 tools in 4.2s".
+type toolsUsed struct {
+	Calls      int         `json:"calls"`
+	Failures   int         `json:"failures"`
+	DurationMs int64       `json:"durationMs"` // of all calls together
+	ByTool     []toolUsage `json:"byTool"`
+}
+
+type toolUsage struct {
+	Tool       string `json:"tool"`
+	Calls      int    `json:"calls"`
+	Failures   int    `json:"failures,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// toolRan notes a call of tool started at start, zero if it is not known.
+func (s *turnStats) toolRan(tool string, start time.Time, failed bool) {
+	var d time.Duration
+	if !start.IsZero() {
+		d = time.Since(start)
+	}
+	i := slices.IndexFunc(s.tools, func(u toolUsage) bool { return u.Tool == tool })
+	if i < 0 {
+		s.tools = append(s.tools, toolUsage{Tool: tool})
+		i = len(s.tools) - 1
+	}
+	s.tools[i].Calls++
+	s.tools[i].DurationMs += d.Milliseconds()
+	if failed {
+		s.tools[i].Failures++
+	}
+}
+
+// toolsUsed returns the summary of the tools run in the turn, nil if none.
+func (s *turnStats) toolsUsed() *toolsUsed {
+	if len(s.tools) == 0 {
+		return nil
+	}
+	used := &toolsUsed{ByTool: s.tools}
+	for _, u := range s.tools {
+		used.Calls += u.Calls
+		used.Failures += u.Failures
+		used.DurationMs += u.DurationMs
+	}
+	return used
+}
+
+// token notes that a chunk of the response was streamed.
+func (s *turnStats) token() {
+	if s.firstToken.IsZero() {
+		s.firstToken = time.Now()
+	}
+}
+
+// doneInfo is the content of a done message.
+type doneInfo struct {
+	Response     string    `json:"response"`
+	FinishReason string    `json:"finishReason"`
+	Stats        doneStats `json:"stats"`
+}
+
+type doneStats struct {
+	Model          string `json:"model"`
+	PromptTokens   int    `json:"promptTokens"`   // estimated, the SDK does not keep the token usage
+	ResponseTokens int    `json:"responseTokens"` // estimated
+	ToolCalls      int    `json:"toolCalls"`
+	FirstTokenMs   int64  `json:"firstTokenMs,omitempty"` // time to the first chunk, none if nothing was streamed
+	DurationMs     int64  `json:"durationMs"`
+
+	ToolResultTokens int `json:"toolResultTokens"` // estimated, of the results added to the conversation in the turn
+	ContextTokens    int `json:"contextTokens"`    // estimated, of the whole conversation after the turn
+
+	Memory *modelMemory `json:"memory,omitempty"` // of an Ollama model
+	Tools  *toolsUsed   `json:"tools,omitempty"`  // none if no tool ran
+}
+
+// sendDone sends the done message of the prompt handled by host, or by
+// another host of its agent that ran it.
+func (b *Bridge) sendDone(ctx context.Context, host Host, prompt, response string) error {
+	s := b.turn
+	if s.model == "" {
+		s.model = host.GetModelString()
+	}
+	info := doneInfo{
+		Response:     response,
+		FinishReason: s.finish,
+		Stats: doneStats{
+			Model:          s.model,
+			PromptTokens:   estimateTokens(prompt),
+			ResponseTokens: estimateTokens(response),
+			ToolCalls:      s.toolCalls,
+			DurationMs:     time.Since(s.start).Milliseconds(),
+			Tools:          s.toolsUsed(),
+		},
+	}
+	if !s.firstToken.IsZero() {
+		info.Stats.FirstTokenMs = s.firstToken.Sub(s.start).Milliseconds()
+		b.recordFirstToken(s.firstToken.Sub(s.start))
+	}
+	tokens := countContextTokens(host.Messages())
+	if n := len(tokens.Turns); n > 0 {
+		info.Stats.ToolResultTokens = tokens.Turns[n-1].ToolResults
+	}
+	info.Stats.ContextTokens = tokens.Total
+	b.warnContext(host, tokens.Total)
+	info.Stats.Memory = b.modelMemory(ctx, s.model)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeDone, Content: string(data)}.withMeta("tokens", tokens))
+}
+
+// sendNotRun ends a prompt refused with the error sendErr reports the
+// sending of, with the done message remote waits for after every prompt.
+func (b *Bridge) sendNotRun(ctx context.Context, host Host, prompt string, sendErr error) error {
+	if sendErr != nil {
+		return sendErr
+	}
+	b.turn = turnStats{start: time.Now(), finish: finishNotRun}
+	return b.sendDone(ctx, host, prompt, "")
+}
@@ -0,0 +1,40 @@
+package bridge
+
+import (
+	"encoding/json"
+	"log/slog"
+)
+
+// editedArgs returns the arguments of an allow-tool-run reply to a call with
+// args, if remote changed them. They must be a JSON object.
+func editedArgs(args string, edited json.RawMessage) (string, bool) {
+	if len(edited) == 0 {
+		return "", false
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(edited, &obj); err != nil || obj == nil {
+		slog.Warn("ignoring edited arguments, no JSON object", "args", string(edited))
+		return "", false
+	}
+	if canonicalArgs(string(edited)) == canonicalArgs(args) {
+		return "", false
+	}
+	return string(edited), true
+}
+
+// editOf returns the call to run instead of call, which remote allowed with
+// other arguments. The edited call goes through the same checks again, with
+// the edit taking the place of asking remote. Once it ran, editOf reports
+// false.
+func (b *Bridge) editOf(call textToolCall) (textToolCall, bool) {
+	if b.edit == nil || call.edited {
+		b.edit = nil
+		return textToolCall{}, false
+	}
+	return *b.edit, true
+}
+
+// editedCallNote tells the model that remote changed the arguments of call.
+func editedCallNote(call textToolCall) string {
+	return "The user changed the arguments of the call of the tool " + call.Name + " to " + call.Args + " before it ran.\n"
+}
@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sources of the decisions of get-policy, in the order authorizeTool
+// consults them
+const (
+	sourceServerTrust = "server-trust"   // the trust level of the server in the bridge configuration
+	sourceRegoPolicy  = "policy-file"    // the Rego policy of --policy, evaluated for a call without arguments
+	sourceToolPolicy  = "tool-policy"    // a pattern of the --tool-policy file
+	sourceAutoApprove = "auto-approve"   // the --auto-approve flag
+	sourceReadOnly    = "read-only"      // the readOnlyHint of the server with --auto-approve-read-only
+	sourceTeam        = "team"           // the --team-approvals
+	sourceGrant       = "session-grant"  // a reply of remote with scope session or duration
+	sourceApprovals   = "approvals-file" // a reply of remote with scope always
+	sourceDefault     = "default"        // nothing decides, remote is asked
+)
+
+// policyEntry is the effective policy for a tool in the content of a policy
+// message.
+type policyEntry struct {
+	Tool     string     `json:"tool"`
+	Decision string     `json:"decision"` // allow, ask or deny
+	Source   string     `json:"source"`
+	Detail   string     `json:"detail,omitempty"` // the trust level or pattern that decided
+	Until    *time.Time `json:"until,omitempty"`  // when a session grant with a duration expires
+	// AllowedCalls are the calls allowed with allow-tool-always for their
+	// arguments only. Other calls get the decision.
+	AllowedCalls int `json:"allowedCalls,omitempty"`
+}
+
+// effectivePolicy returns how authorizeTool decides on calls of tool in the
+// conversation of session, and why, without asking or telling remote. Calls
+// of an approved plan and ones outside the workdir are left out, as they
+// depend on the call.
+func (b *Bridge) effectivePolicy(ctx context.Context, tool, session string) policyEntry {
+	e := policyEntry{Tool: tool, Decision: policyAsk, Source: sourceDefault}
+	trust := b.serverTrust(tool)
+	if trust == trustBlocked {
+		e.Decision, e.Source, e.Detail = policyDeny, sourceServerTrust, trust
+		return e
+	}
+	if b.policy != nil {
+		if d, _ := b.policy.evaluate(ctx, tool, "{}"); d != policyAsk {
+			e.Decision, e.Source = d, sourceRegoPolicy
+		}
+	}
+	if byPattern, pattern := b.toolPolicy.decide(tool); byPattern == policyDeny || byPattern == policyAllow && e.Decision == policyAsk {
+		e.Decision, e.Source, e.Detail = byPattern, sourceToolPolicy, pattern
+	}
+	if e.Decision != policyAsk {
+		return e
+	}
+	approvals := b.sessionDecisions(session)
+	e.AllowedCalls = len(approvals.calls[tool])
+	switch {
+	case trust == trustAsk:
+		e.Source, e.Detail, e.AllowedCalls = sourceServerTrust, trust, 0 // remembered decisions do not apply
+		return e
+	case trust == trustTrusted:
+		e.Decision, e.Source, e.Detail = policyAllow, sourceServerTrust, trust
+		return e
+	case b.autoApproved(tool):
+		e.Decision, e.Source = policyAllow, sourceAutoApprove
+		return e
+	case b.readOnlyTool(ctx, tool):
+		e.Decision, e.Source = policyAllow, sourceReadOnly
+		return e
+	}
+	if b.team != nil {
+		if allow, found := b.team.lookup(ctx, tool); found {
+			e.Decision, e.Source = policyDeny, sourceTeam
+			if allow {
+				e.Decision = policyAllow
+			}
+			return e
+		}
+	}
+	if d, scope, found := approvals.grant(tool); found {
+		e.Decision, e.Source = policyDeny, sourceGrant
+		if d.Allow {
+			e.Decision = policyAllow
+		}
+		if scope == scopeAlways {
+			e.Source = sourceApprovals
+		}
+		if scope == scopeDuration {
+			e.Until = &d.Until
+		}
+	}
+	return e
+}
+
+// handleGetPolicy sends the effective policy for the tools of the MCP
+// servers the bridge connects to, in the conversation of msg.Session, to
+// remote. A comma separated list of tool patterns in content limits it to
+// those tools.
+func (b *Bridge) handleGetPolicy(ctx context.Context, msg Message) error {
+	entries := []policyEntry{}
+	for _, tool := range slices.Sorted(maps.Keys(b.getToolbox(ctx, b.options.ConfigFile).tools)) {
+		if strings.TrimSpace(msg.Content) != "" && !matchesToolPatterns(msg.Content, tool) {
+			continue
+		}
+		entries = append(entries, b.effectivePolicy(ctx, tool, msg.Session))
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypePolicy, Content: string(data), Session: msg.Session})
+}
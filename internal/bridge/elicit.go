@@ -0,0 +1,123 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// argRequest describes an argument of a tool call remote is asked for.
+type argRequest struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// requiredArgs returns the required arguments of tool and the schemas of its
+// arguments.
+func requiredArgs(tool mcp.Tool) ([]string, map[string]any) {
+	if len(tool.RawInputSchema) == 0 {
+		return tool.InputSchema.Required, tool.InputSchema.Properties
+	}
+	var schema mcp.ToolArgumentsSchema
+	if err := json.Unmarshal(tool.RawInputSchema, &schema); err != nil {
+		return nil, nil
+	}
+	return schema.Required, schema.Properties
+}
+
+// missingArgs returns the required arguments the call of tool with args
+// lacks. Arguments that are not a JSON object are left to the server to
+// reject.
+func missingArgs(tool mcp.Tool, args string) []argRequest {
+	given := map[string]any{}
+	if strings.TrimSpace(args) != "" {
+		if err := json.Unmarshal([]byte(args), &given); err != nil {
+			return nil
+		}
+	}
+	required, properties := requiredArgs(tool)
+	var missing []argRequest
+	for _, name := range required {
+		if given[name] != nil {
+			continue
+		}
+		req := argRequest{Name: name}
+		if prop, ok := properties[name].(map[string]any); ok {
+			req.Type, _ = prop["type"].(string)
+			req.Description, _ = prop["description"].(string)
+		}
+		missing = append(missing, req)
+	}
+	return missing
+}
+
+// lacksArgs reports whether a call of tool lacks required arguments remote
+// is to be asked for, and returns the full name of the tool.
+func (b *Bridge) lacksArgs(ctx context.Context, tool, args string) (string, bool) {
+	if !b.conf.ElicitArgs {
+		return "", false
+	}
+	tools := b.promptToolbox(ctx)
+	full, ok := tools.resolve(tool)
+	if !ok {
+		return "", false
+	}
+	return full, len(missingArgs(tools.tools[full], args)) > 0
+}
+
+// elicitArgs asks remote for the required arguments a tool call lacks and
+// returns the arguments with them added. It reports false if remote refused.
+func (b *Bridge) elicitArgs(ctx context.Context, call textToolCall) (string, bool) {
+	missing := missingArgs(b.promptToolbox(ctx).tools[call.Name], call.Args)
+	if len(missing) == 0 {
+		return call.Args, true
+	}
+	content, err := json.Marshal(missing)
+	if err != nil {
+		slog.Error("encoding missing arguments", "err", err)
+		return "", false
+	}
+	id, err := newID()
+	if err != nil {
+		slog.Error("creating message ID", "err", err)
+		return "", false
+	}
+	server, _, _ := strings.Cut(call.Name, "__")
+	err = b.send(Message{ID: id, MsgType: msgTypeElicitArgs, Content: string(content), Tool: call.Name, Server: server, Args: rawArgs(call.Args)})
+	if err != nil {
+		slog.Error("sending message", "err", err)
+		return "", false
+	}
+	msg, err := b.recvReply(ctx, id)
+	if err != nil {
+		slog.Error("receiving message", "err", err)
+		return "", false
+	}
+	if msg.MsgType != msgTypeProvideArgs {
+		slog.Info("arguments not provided", "tool", call.Name, "MsgType", msg.MsgType)
+		return "", false
+	}
+	args := map[string]any{}
+	if strings.TrimSpace(call.Args) != "" {
+		if err := json.Unmarshal([]byte(call.Args), &args); err != nil {
+			return "", false
+		}
+	}
+	var provided map[string]any
+	if err := json.Unmarshal(msg.Args, &provided); err != nil {
+		slog.Warn("parsing provided arguments", "err", err)
+		return "", false
+	}
+	for name, value := range provided {
+		args[name] = value
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
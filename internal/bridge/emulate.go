@@ -0,0 +1,67 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+const emulationInstruction = "You can use the tools listed below. To use a tool, answer with nothing but a JSON object " +
+	`like {"name": "<tool>", "arguments": {<arguments>}}. ` +
+	"You will get the result of the tool and can then use another tool or answer the request.\n\nTools:\n"
+
+// emulatesTools reports whether model is one of the models without native
+// tool calling given by the -emulate-tools patterns.
+func (b *Bridge) emulatesTools(model string) bool {
+	if b.conf.EmulateTools == "" {
+		return false
+	}
+	for _, pattern := range strings.Split(b.conf.EmulateTools, ",") {
+		if ok, _ := path.Match(strings.TrimSpace(pattern), model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// emulationPrompt describes the tools of the MCP servers for a prompt.
+func (b *Bridge) emulationPrompt(ctx context.Context) string {
+	tools := b.promptToolbox(ctx).tools
+	var list strings.Builder
+	list.WriteString(emulationInstruction)
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		schema, err := json.Marshal(tools[name].InputSchema)
+		if err != nil {
+			schema = []byte("{}")
+		}
+		fmt.Fprintf(&list, "- %s: %s\n  arguments: %s\n", name, b.toolDescription(name, tools[name].Description), schema)
+	}
+	list.WriteString("\nRequest:\n")
+	return list.String()
+}
+
+// withEmulatedTools calls run with a host for the model of base that has no
+// tools, so providers do not reject the request, handing the conversation of
+// base over to it and back afterwards. Tool calls are then made by the model
+// in its response, see runTextToolCall.
+func (b *Bridge) withEmulatedTools(ctx context.Context, base Host, run func(Host) error) error {
+	host, err := b.helperHost(ctx, base.GetModelString(), b.options.SystemPrompt)
+	if err != nil {
+		return err
+	}
+	defer host.ClearSession()
+	err = host.ReplaceMessages(base.Messages())
+	if err != nil {
+		return err
+	}
+	err = run(host)
+	if syncErr := base.ReplaceMessages(host.Messages()); syncErr != nil {
+		slog.Error("handing conversation back", "err", syncErr)
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// Codes of the error messages to remote.
+const (
+	errorModelTimeout = "model-timeout" // the model did not answer in time
+	errorModelFailed  = "model-failed"  // the model or its provider failed
+	errorServerFailed = "server-failed" // an MCP server could not be started or reached
+	errorBadConfig    = "bad-config"    // a configuration file could not be read
+	errorBadTemplate  = "bad-template"  // the prompt template could not be expanded
+	errorPullFailed   = "pull-failed"   // a model could not be pulled
+	errorDeleteFailed = "delete-failed" // a model could not be deleted
+	// a message from remote over the size limit was skipped
+	errorMessageTooLarge = "message-too-large"
+	// the model does not exist, with the models the provider has
+	errorModelNotFound = "model-not-found"
+	// the tool of a retry-tool message cannot be run by the bridge
+	errorRetryFailed = "retry-failed"
+	// the export to resume was replaced by a newer one
+	errorExportExpired = "export-expired"
+	// an attachment of a prompt refers by ID to none the session has
+	errorUnknownAttachment = "unknown-attachment"
+	// the saved conversation could not be resumed
+	errorResumeFailed = "resume-failed"
+	// the level of a set-verbosity message is none of verbosities
+	errorUnknownVerbosity = "unknown-verbosity"
+	// the format of an export-transcript message is neither markdown nor json
+	errorUnknownFormat = "unknown-format"
+	// a prompt was not run, or its response cut off, over a token budget
+	errorBudgetExceeded = "budget-exceeded"
+	// a rollback-to-checkpoint message names no checkpoint of the conversation
+	errorUnknownCheckpoint = "unknown-checkpoint"
+	// the model of a switch-model message could not take the conversation over
+	errorSwitchFailed = "switch-failed"
+	// a prompt names a session that was never opened or is closed
+	errorUnknownSession = "unknown-session"
+)
+
+// bridgeError is the content of an error message.
+type bridgeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Server  string `json:"server,omitempty"` // the MCP server that failed
+
+	// Models are the models there are for model-not-found, the closest to
+	// the missing one first.
+	Models []string `json:"models,omitempty"`
+	// Budget is the token budget of budget-exceeded.
+	Budget *budgetExceeded `json:"budget,omitempty"`
+}
+
+// sendError reports a failure the bridge recovers from to remote.
+func (b *Bridge) sendError(e bridgeError) error {
+	return b.send(errorMessage(e))
+}
+
+// warningMessage returns a message telling remote of a likely problem, with
+// a code and message like an error message.
+func warningMessage(e bridgeError) Message {
+	msg := errorMessage(e)
+	msg.MsgType = msgTypeWarning
+	return msg
+}
+
+func errorMessage(e bridgeError) Message {
+	data, _ := json.Marshal(e) // only strings and numbers
+	return Message{MsgType: msgTypeError, Content: string(data)}
+}
+
+// reportError sends a failed prompt to remote as error message. It returns
+// false if the failure ends the bridge, as remote went away or ctx is done.
+func (b *Bridge) reportError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrConnectionLost) {
+		return false
+	}
+	slog.Error("running prompt", "err", err)
+	var notFound *modelNotFoundError
+	if errors.As(err, &notFound) {
+		return b.sendError(bridgeError{Code: errorModelNotFound, Message: err.Error(), Models: notFound.Available}) == nil
+	}
+	code := errorModelFailed
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout() {
+		code = errorModelTimeout
+	}
+	return b.sendError(bridgeError{Code: code, Message: err.Error()}) == nil
+}
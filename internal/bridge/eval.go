@@ -0,0 +1,232 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// evalSuite is a set of prompts with the behavior expected of the model, in
+// YAML or JSON.
+type evalSuite struct {
+	Models       []string   `yaml:"models"`       // compared against each other, the configured model if empty
+	SystemPrompt string     `yaml:"systemPrompt"` // replaces the configured one if set
+	Cases        []evalCase `yaml:"cases"`
+}
+
+type evalCase struct {
+	Name        string   `yaml:"name"`
+	Prompt      string   `yaml:"prompt"`
+	Tools       []string `yaml:"tools"`   // to be called, by full name or without the server prefix
+	NoTools     bool     `yaml:"noTools"` // no tool is to be called
+	Contains    []string `yaml:"contains"`
+	NotContains []string `yaml:"notContains"`
+	Matches     string   `yaml:"matches"` // regular expression the answer must match
+	// RunTools lets the tools run so the answer can be checked. Otherwise
+	// the first tool call ends the case unrun, which is all the scoring of
+	// the tool selection needs.
+	RunTools bool `yaml:"runTools"`
+}
+
+// checksTools reports whether the case scores the tool selection.
+func (c evalCase) checksTools() bool {
+	return len(c.Tools) > 0 || c.NoTools
+}
+
+// checksAnswer reports whether the case scores the answer.
+func (c evalCase) checksAnswer() bool {
+	return len(c.Contains) > 0 || len(c.NotContains) > 0 || c.Matches != ""
+}
+
+func loadEvalSuite(path string) (evalSuite, error) {
+	var suite evalSuite
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return suite, err
+	}
+	// JSON is YAML as well
+	if err := yaml.Unmarshal(data, &suite); err != nil {
+		return suite, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, c := range suite.Cases {
+		if c.Name == "" {
+			suite.Cases[i].Name = fmt.Sprintf("case %d", i+1)
+		}
+		if c.Prompt == "" {
+			return suite, fmt.Errorf("%s: no prompt", suite.Cases[i].Name)
+		}
+		if c.Matches != "" {
+			if _, err := regexp.Compile(c.Matches); err != nil {
+				return suite, fmt.Errorf("%s: %w", suite.Cases[i].Name, err)
+			}
+		}
+		if !c.RunTools && c.checksAnswer() && !c.NoTools {
+			slog.Warn("answer checks of a case whose tool calls do not run", "case", suite.Cases[i].Name)
+		}
+	}
+	return suite, nil
+}
+
+// evalScore counts the passed checks of a model.
+type evalScore struct {
+	toolsPassed, toolsChecked   int
+	answerPassed, answerChecked int
+}
+
+func (s evalScore) passed() bool {
+	return s.toolsPassed == s.toolsChecked && s.answerPassed == s.answerChecked
+}
+
+func evalRatio(passed, checked int) string {
+	if checked == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d (%d%%)", passed, checked, passed*100/checked)
+}
+
+// Eval runs the cases of the suite at path against each of its models with
+// the configured tools and writes the results to out. It reports whether all
+// checks passed.
+func (b *Bridge) Eval(ctx context.Context, path string, out io.Writer) (bool, error) {
+	suite, err := loadEvalSuite(path)
+	if err != nil {
+		return false, err
+	}
+	models := suite.Models
+	if len(models) == 0 {
+		models = []string{b.conf.Model}
+	}
+	opts := b.options
+	opts.Streaming = false
+	if suite.SystemPrompt != "" {
+		opts.SystemPrompt = b.withToolDocs(suite.SystemPrompt)
+	}
+	allPassed := true
+	for _, model := range models {
+		opts.Model = model
+		host, err := b.newHost(ctx, &opts)
+		if err != nil {
+			return false, fmt.Errorf("creating host for %s: %w", model, err)
+		}
+		fmt.Fprintf(out, "model %s\n", model)
+		var score evalScore
+		for _, c := range suite.Cases {
+			if err := b.evalCase(ctx, host, c, &score, out); err != nil {
+				host.Close()
+				return false, err
+			}
+		}
+		host.Close()
+		fmt.Fprintf(out, "tool selection: %s, answers: %s\n\n",
+			evalRatio(score.toolsPassed, score.toolsChecked), evalRatio(score.answerPassed, score.answerChecked))
+		allPassed = allPassed && score.passed()
+	}
+	return allPassed, nil
+}
+
+// evalCase runs c on host, adds its checks to score and writes what failed
+// to out.
+func (b *Bridge) evalCase(ctx context.Context, host Host, c evalCase, score *evalScore, out io.Writer) error {
+	host.ClearSession()
+	caseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var called []string
+	stopped := false
+	answer, err := host.PromptWithCallbacks(caseCtx, c.Prompt,
+		func(name, _ string) {
+			called = append(called, name)
+			if !c.RunTools {
+				stopped = true
+				cancel()
+			}
+		},
+		func(string, string, string, bool) {},
+		func(string) {})
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case stopped:
+		err = errors.New("the tool call did not run")
+	case err != nil:
+		slog.Warn("running eval case", "case", c.Name, "err", err)
+	}
+
+	var failed []string
+	if c.checksTools() {
+		score.toolsChecked++
+		if problem := toolSelectionProblem(c, called); problem != "" {
+			failed = append(failed, problem)
+		} else {
+			score.toolsPassed++
+		}
+	}
+	if c.checksAnswer() {
+		score.answerChecked++
+		if problems := answerProblems(c, answer, err); len(problems) > 0 {
+			failed = append(failed, problems...)
+		} else {
+			score.answerPassed++
+		}
+	}
+	if len(failed) == 0 {
+		fmt.Fprintf(out, "  PASS %s\n", c.Name)
+		return nil
+	}
+	fmt.Fprintf(out, "  FAIL %s: %s\n", c.Name, strings.Join(failed, "; "))
+	return nil
+}
+
+// toolSelectionProblem returns what is wrong with the tools called for c,
+// or "".
+func toolSelectionProblem(c evalCase, called []string) string {
+	if c.NoTools {
+		if len(called) > 0 {
+			return "called " + strings.Join(called, ", ")
+		}
+		return ""
+	}
+	var missing []string
+	for _, want := range c.Tools {
+		if !slices.ContainsFunc(called, func(name string) bool { return name == want || strings.HasSuffix(name, "__"+want) }) {
+			missing = append(missing, want)
+		}
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+	if len(called) == 0 {
+		return "did not call " + strings.Join(missing, ", ")
+	}
+	return "did not call " + strings.Join(missing, ", ") + ", called " + strings.Join(called, ", ")
+}
+
+// answerProblems returns what is wrong with the answer to c.
+func answerProblems(c evalCase, answer string, err error) []string {
+	if err != nil {
+		return []string{"no answer: " + err.Error()}
+	}
+	var problems []string
+	lower := strings.ToLower(answer)
+	for _, s := range c.Contains {
+		if !strings.Contains(lower, strings.ToLower(s)) {
+			problems = append(problems, fmt.Sprintf("answer lacks %q", s))
+		}
+	}
+	for _, s := range c.NotContains {
+		if strings.Contains(lower, strings.ToLower(s)) {
+			problems = append(problems, fmt.Sprintf("answer contains %q", s))
+		}
+	}
+	if c.Matches != "" && !regexp.MustCompile(c.Matches).MatchString(answer) {
+		problems = append(problems, fmt.Sprintf("answer does not match %q", c.Matches))
+	}
+	return problems
+}
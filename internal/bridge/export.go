@@ -0,0 +1,192 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// exportChunkSize is the bytes of the transcript per export-chunk message.
+// Escaped as a JSON string, the lines stay below the 64 KiB many line
+// readers take, like bufio.Scanner by default.
+const exportChunkSize = 16 << 10
+
+// transcriptExport is a transcript sent to remote in chunks. It is kept until
+// the next export, so remote can resume one that broke off.
+type transcriptExport struct {
+	id   string
+	data []byte // the conversation as JSON array, like in history messages
+}
+
+// exportChunk is the meta of an export-chunk message.
+type exportChunk struct {
+	Export string `json:"export"`
+	Offset int    `json:"offset"` // of the chunk in the transcript, in bytes
+	Size   int    `json:"size"`   // of the whole transcript, in bytes
+	Resume string `json:"resume"` // token to ask for the rest from after the chunk
+	Last   bool   `json:"last"`
+}
+
+// resumeToken returns the token to resume export at offset.
+func (e *transcriptExport) resumeToken(offset int) string {
+	return e.id + ":" + strconv.Itoa(offset)
+}
+
+// chunkEnd returns the end of the chunk starting at offset, not splitting a
+// UTF-8 sequence as the chunks are sent as strings.
+func (e *transcriptExport) chunkEnd(offset int) int {
+	end := min(offset+exportChunkSize, len(e.data))
+	for end < len(e.data) && end > offset+1 && !utf8.RuneStart(e.data[end]) {
+		end--
+	}
+	return end
+}
+
+// handleExport sends the conversation of the session or agent of msg to
+// remote as a sequence of export-chunk messages. Content empty starts an
+// export, a resume token of an earlier chunk continues it after the chunk.
+func (b *Bridge) handleExport(host Host, msg Message) error {
+	offset := 0
+	if msg.Content == "" {
+		if h, _, ok := b.sessionHost(msg.Session); ok {
+			host = h
+		} else if h, ok := b.agentHosts[msg.Agent]; ok {
+			host = h
+		}
+		data, err := json.Marshal(conversationHistory(host))
+		if err != nil {
+			return err
+		}
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		b.export = &transcriptExport{id: id, data: data}
+	} else {
+		id, at, _ := strings.Cut(msg.Content, ":")
+		var err error
+		offset, err = strconv.Atoi(at)
+		if b.export == nil || b.export.id != id || err != nil || offset < 0 || offset > len(b.export.data) {
+			return b.sendError(bridgeError{Code: errorExportExpired,
+				Message: fmt.Sprintf("no export to resume with %q, start a new one", msg.Content)})
+		}
+	}
+	e := b.export
+	for {
+		end := e.chunkEnd(offset)
+		chunk := exportChunk{Export: e.id, Offset: offset, Size: len(e.data), Resume: e.resumeToken(end), Last: end == len(e.data)}
+		reply := Message{MsgType: msgTypeExportChunk, Content: string(e.data[offset:end]), Session: msg.Session}
+		if err := b.send(reply.withMeta("export", chunk)); err != nil {
+			return err
+		}
+		if chunk.Last {
+			return nil
+		}
+		offset = end
+	}
+}
+
+// formats of export-transcript
+const (
+	formatMarkdown = "markdown" // the default
+	formatJSON     = "json"
+)
+
+// chatTranscript is a conversation exported with export-transcript.
+type chatTranscript struct {
+	Model    string         `json:"model"`
+	Session  string         `json:"session,omitempty"`
+	Agent    string         `json:"agent,omitempty"`
+	Exported time.Time      `json:"exported"`
+	Messages []historyEntry `json:"messages"`
+}
+
+// transcriptFile is the meta.file of a transcript message, for remote to
+// offer the transcript as download.
+type transcriptFile struct {
+	Format   string `json:"format"`
+	MIMEType string `json:"mimeType"`
+	Name     string `json:"name"`
+}
+
+// roleTitles head the messages of a Markdown transcript.
+var roleTitles = map[string]string{
+	"system":    "System",
+	"user":      "User",
+	"assistant": "Assistant",
+	"tool":      "Tool result",
+}
+
+// fenced returns text in a Markdown code block, with a fence longer than any
+// run of backticks in it.
+func fenced(text, lang string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fence + lang + "\n" + strings.TrimSuffix(text, "\n") + "\n" + fence + "\n"
+}
+
+// markdown renders t for reading, tool calls and results in code blocks.
+func (t chatTranscript) markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Chat with %s\n\nExported %s\n", t.Model, t.Exported.Format(time.RFC1123))
+	for _, e := range t.Messages {
+		title, ok := roleTitles[e.Role]
+		if !ok {
+			title = e.Role
+		}
+		fmt.Fprintf(&sb, "\n## %s\n\n", title)
+		switch {
+		case e.Role == "tool":
+			sb.WriteString(fenced(e.Content, ""))
+		case e.Content != "":
+			sb.WriteString(strings.TrimSuffix(e.Content, "\n") + "\n")
+		}
+		for _, tc := range e.ToolCalls {
+			fmt.Fprintf(&sb, "\nCalls `%s`:\n\n%s", tc.Name, fenced(string(tc.Arguments), "json"))
+		}
+	}
+	return sb.String()
+}
+
+// handleExportTranscript sends the conversation of the session or agent of
+// msg to remote in a single transcript message, rendered as Markdown or JSON
+// as asked for in content.
+func (b *Bridge) handleExportTranscript(host Host, msg Message) error {
+	format := strings.TrimSpace(msg.Content)
+	if format == "" {
+		format = formatMarkdown
+	}
+	if format != formatMarkdown && format != formatJSON {
+		return b.sendError(bridgeError{Code: errorUnknownFormat,
+			Message: fmt.Sprintf("unknown transcript format %q, use %s or %s", format, formatMarkdown, formatJSON)})
+	}
+	if h, _, ok := b.sessionHost(msg.Session); ok {
+		host = h
+	} else if h, ok := b.agentHosts[msg.Agent]; ok {
+		host = h
+	}
+	t := chatTranscript{Model: host.GetModelString(), Session: msg.Session, Agent: msg.Agent, Exported: time.Now(), Messages: conversationHistory(host)}
+	name := "chat-" + t.Exported.Format("2006-01-02-150405")
+	file := transcriptFile{Format: format, MIMEType: "text/markdown", Name: name + ".md"}
+	content := t.markdown()
+	if format == formatJSON {
+		data, err := json.MarshalIndent(t, "", "  ")
+		if err != nil {
+			return err
+		}
+		file.MIMEType, file.Name, content = "application/json", name+".json", string(data)
+	}
+	reply := Message{MsgType: msgTypeTranscript, Content: content, Session: msg.Session}
+	return b.send(reply.withMeta("file", file))
+}
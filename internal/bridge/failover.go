@@ -0,0 +1,274 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	healthWeight        = 0.3 // weight of the latest prompt in the moving averages of a model's health
+	defaultMaxErrorRate = 0.5
+)
+
+// providerGroup lists models of different providers that stand in for each
+// other, like a local Ollama model and a cloud backup. Prompts for any of the
+// models go to the current one of the group while it is healthy.
+type providerGroup struct {
+	Models       []string `json:"models"`       // in order of preference
+	MaxLatency   string   `json:"maxLatency"`   // time to the first token above which a model is unhealthy, e.g. "20s", no limit if empty
+	MaxErrorRate float64  `json:"maxErrorRate"` // rate of failed prompts above which a model is unhealthy, 0.5 if 0
+}
+
+// providerHealth is what a group knows about a model from its prompts.
+type providerHealth struct {
+	prompts   int
+	latency   time.Duration // moving average of the time to the first token
+	errorRate float64       // moving average of failures
+}
+
+// failoverGroup is a provider group with the health of its models and the
+// model currently used. The choice is sticky: it only changes if the model
+// fails or turns unhealthy.
+type failoverGroup struct {
+	providerGroup
+	maxLatency time.Duration
+	current    string
+	health     map[string]*providerHealth // keyed by model
+}
+
+func newFailoverGroups(groups []providerGroup) []*failoverGroup {
+	var fg []*failoverGroup
+	for _, g := range groups {
+		if len(g.Models) == 0 {
+			continue
+		}
+		maxLatency, _ := time.ParseDuration(g.MaxLatency)
+		if g.MaxErrorRate <= 0 {
+			g.MaxErrorRate = defaultMaxErrorRate
+		}
+		fg = append(fg, &failoverGroup{
+			providerGroup: g,
+			maxLatency:    maxLatency,
+			current:       g.Models[0],
+			health:        map[string]*providerHealth{},
+		})
+	}
+	return fg
+}
+
+// providerGroupOf returns the group of model, or nil if it has none.
+func (b *Bridge) providerGroupOf(model string) *failoverGroup {
+	for _, g := range b.providerGroups {
+		if slices.Contains(g.Models, model) {
+			return g
+		}
+	}
+	return nil
+}
+
+func (g *failoverGroup) healthy(model string) bool {
+	h, ok := g.health[model]
+	if !ok {
+		return true // untried
+	}
+	return h.errorRate <= g.MaxErrorRate && (g.maxLatency == 0 || h.latency <= g.maxLatency)
+}
+
+// score orders the models of a group, lower being healthier.
+func (g *failoverGroup) score(model string) float64 {
+	h, ok := g.health[model]
+	if !ok {
+		return 0
+	}
+	return h.errorRate + h.latency.Seconds()/60
+}
+
+// record notes the outcome of a prompt of model, latency being the time to
+// its first token.
+func (g *failoverGroup) record(model string, latency time.Duration, failed bool) {
+	h, ok := g.health[model]
+	if !ok {
+		h = &providerHealth{}
+		g.health[model] = h
+	}
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	if h.prompts == 0 {
+		h.errorRate = failure
+		if !failed {
+			h.latency = latency
+		}
+	} else {
+		h.errorRate += healthWeight * (failure - h.errorRate)
+		if !failed {
+			h.latency += time.Duration(healthWeight * float64(latency-h.latency))
+		}
+	}
+	h.prompts++
+}
+
+// candidates returns the models to try in turn: the current one if healthy,
+// the other healthy ones, and the unhealthy ones as last resort, each by
+// score and then preference.
+func (g *failoverGroup) candidates() []string {
+	models := slices.Clone(g.Models)
+	slices.SortStableFunc(models, func(a, b string) int {
+		switch {
+		case g.healthy(a) != g.healthy(b):
+			if g.healthy(a) {
+				return -1
+			}
+			return 1
+		case a == g.current || b == g.current:
+			if a == g.current {
+				return -1
+			}
+			return 1
+		case g.score(a) < g.score(b):
+			return -1
+		case g.score(a) > g.score(b):
+			return 1
+		}
+		return 0
+	})
+	return models
+}
+
+// providerSwitch is the content of a model-switched message.
+type providerSwitch struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"` // unhealthy, failed if the prompt is run again with the new model, or requested with switch-model
+}
+
+// runWithFailover calls run with the host of the current model of group,
+// handing the conversation of base over to it and back afterwards. If the
+// prompt fails, it is run again with the next model.
+func (b *Bridge) runWithFailover(ctx context.Context, base Host, agent string, group *failoverGroup, run func(Host) error) error {
+	var err error
+	reason := "unhealthy"
+	for _, model := range group.candidates() {
+		if model != group.current {
+			slog.Info("switching model", "from", group.current, "to", model, "reason", reason)
+			if sendErr := b.sendProviderSwitch(providerSwitch{From: group.current, To: model, Reason: reason}); sendErr != nil {
+				return sendErr
+			}
+			group.current = model
+		}
+		reason = "failed"
+		var host Host
+		host, err = b.failoverHost(ctx, base, agent, model)
+		if err != nil {
+			slog.Warn("creating host of provider group", "model", model, "err", err)
+			group.record(model, 0, true)
+			continue
+		}
+		if host != base {
+			if err = host.ReplaceMessages(base.Messages()); err != nil {
+				return err
+			}
+		}
+		timed := &timedHost{Host: host}
+		err = run(timed)
+		if host != base {
+			if syncErr := base.ReplaceMessages(host.Messages()); syncErr != nil {
+				slog.Error("handing conversation back", "err", syncErr)
+			}
+		}
+		group.record(model, timed.latency(), err != nil)
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrConnectionLost) {
+			return err
+		}
+		slog.Warn("prompt failed, failing over", "model", model, "err", err)
+	}
+	return err
+}
+
+// failoverHost returns the host of agent for model, base if it has that
+// model. Hosts of other models are created on first use.
+func (b *Bridge) failoverHost(ctx context.Context, base Host, agent, model string) (Host, error) {
+	if base.GetModelString() == model {
+		return base, nil
+	}
+	key := [2]string{agent, model}
+	if host, ok := b.backupHosts[key]; ok {
+		return host, nil
+	}
+	opts, err := b.agentOptions(agent)
+	if err != nil {
+		return nil, err
+	}
+	opts.Model = model
+	host, err := b.newHost(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+	b.backupHosts[key] = host
+	return host, nil
+}
+
+func (b *Bridge) closeBackupHosts() {
+	for key, host := range b.backupHosts {
+		host.Close()
+		delete(b.backupHosts, key)
+	}
+}
+
+func (b *Bridge) sendProviderSwitch(s providerSwitch) error {
+	content, err := providerSwitchContent(s)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeModelSwitched, Content: content})
+}
+
+func providerSwitchContent(s providerSwitch) (string, error) {
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+// timedHost measures the time to the first token or tool call of a prompt.
+type timedHost struct {
+	Host
+	start, first time.Time
+}
+
+func (h *timedHost) PromptWithCallbacks(ctx context.Context, message string,
+	onToolCall func(name, args string),
+	onToolResult func(name, args, result string, isError bool),
+	onStreaming func(chunk string)) (string, error) {
+	h.start, h.first = time.Now(), time.Time{}
+	mark := func() {
+		if h.first.IsZero() {
+			h.first = time.Now()
+		}
+	}
+	return h.Host.PromptWithCallbacks(ctx, message,
+		func(name, args string) {
+			mark()
+			onToolCall(name, args)
+		},
+		onToolResult,
+		func(chunk string) {
+			mark()
+			onStreaming(chunk)
+		})
+}
+
+// latency returns the time to the first token of the last prompt, or its
+// whole time if nothing was streamed.
+func (h *timedHost) latency() time.Duration {
+	if h.start.IsZero() {
+		return 0
+	}
+	if h.first.IsZero() {
+		return time.Since(h.start)
+	}
+	return h.first.Sub(h.start)
+}
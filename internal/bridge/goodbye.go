@@ -0,0 +1,42 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+)
+
+// reasons of goodbye messages
+const (
+	goodbyeQuit           = "quit"            // remote sent quit
+	goodbyeSignal         = "signal"          // the bridge was stopped, as main does on SIGINT and SIGTERM
+	goodbyeConnectionLost = "connection-lost" // remote went away or stopped answering pings
+	goodbyeError          = "error"           // a failure the bridge cannot go on after
+)
+
+// goodbye is the content of a goodbye message.
+type goodbye struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"` // of the error, or the lost connection
+}
+
+// sayGoodbye tells remote why the bridge stops, after chatLoop returned err,
+// so it can show that instead of just a closed connection. Remote may have
+// gone already, failing to send is no error.
+func (b *Bridge) sayGoodbye(ctx context.Context, err error) {
+	bye := goodbye{Reason: goodbyeQuit} // remote may close its end right after quit
+	switch cause := context.Cause(ctx); {
+	case err == nil:
+	case errors.Is(cause, ErrConnectionLost):
+		bye = goodbye{Reason: goodbyeConnectionLost, Message: cause.Error()}
+	case ctx.Err() != nil:
+		bye.Reason = goodbyeSignal
+	default:
+		bye = goodbye{Reason: goodbyeError, Message: err.Error()}
+	}
+	data, _ := json.Marshal(bye) // only strings
+	if err := b.send(Message{MsgType: msgTypeGoodbye, Content: string(data)}); err != nil {
+		slog.Debug("sending goodbye", "err", err)
+	}
+}
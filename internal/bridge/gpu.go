@@ -0,0 +1,225 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// warnModelExceedsVRAM is the code of the warning that the model is larger
+// than the memory of the GPUs, so Ollama runs it partly or wholly on the CPU.
+const warnModelExceedsVRAM = "model-exceeds-vram"
+
+// gpuInfo is a GPU found with nvidia-smi or rocm-smi.
+type gpuInfo struct {
+	Name      string `json:"name"`
+	VRAMTotal int64  `json:"vramTotal"` // bytes
+	VRAMUsed  int64  `json:"vramUsed"`  // bytes, when detected
+}
+
+// detectGPUs returns the NVIDIA and AMD GPUs of the system, found with the
+// tools of their drivers, or none if neither tool is installed.
+func detectGPUs(ctx context.Context) []gpuInfo {
+	gpus, err := nvidiaGPUs(ctx)
+	if err != nil {
+		slog.Debug("detecting NVIDIA GPUs", "err", err)
+	}
+	amd, err := amdGPUs(ctx)
+	if err != nil {
+		slog.Debug("detecting AMD GPUs", "err", err)
+	}
+	return append(gpus, amd...)
+}
+
+func nvidiaGPUs(ctx context.Context) ([]gpuInfo, error) {
+	out, err := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu=name,memory.total,memory.used",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, err
+	}
+	var gpus []gpuInfo
+	for line := range strings.Lines(string(out)) {
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			continue
+		}
+		total, err1 := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		used, err2 := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("unexpected nvidia-smi output %q", line)
+		}
+		gpus = append(gpus, gpuInfo{Name: strings.TrimSpace(fields[0]), VRAMTotal: total << 20, VRAMUsed: used << 20})
+	}
+	return gpus, nil
+}
+
+func amdGPUs(ctx context.Context) ([]gpuInfo, error) {
+	out, err := exec.CommandContext(ctx, "rocm-smi", "--showmeminfo", "vram", "--json").Output()
+	if err != nil {
+		return nil, err
+	}
+	var cards map[string]map[string]string
+	if err := json.Unmarshal(out, &cards); err != nil {
+		return nil, fmt.Errorf("parsing rocm-smi output: %w", err)
+	}
+	var gpus []gpuInfo
+	for name, info := range cards {
+		total, err := strconv.ParseInt(info["VRAM Total Memory (B)"], 10, 64)
+		if err != nil {
+			continue
+		}
+		used, _ := strconv.ParseInt(info["VRAM Total Used Memory (B)"], 10, 64)
+		gpus = append(gpus, gpuInfo{Name: name, VRAMTotal: total, VRAMUsed: used})
+	}
+	slices.SortFunc(gpus, func(a, b gpuInfo) int { return strings.Compare(a.Name, b.Name) })
+	return gpus, nil
+}
+
+// totalVRAM returns the memory of all gpus, as Ollama splits models across
+// them.
+func totalVRAM(gpus []gpuInfo) int64 {
+	var total int64
+	for _, g := range gpus {
+		total += g.VRAMTotal
+	}
+	return total
+}
+
+// modelList is the content of models messages.
+type modelList struct {
+	Models []modelInfo `json:"models"`
+	GPUs   []gpuInfo   `json:"gpus"`
+}
+
+type modelInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`               // bytes
+	FitsVRAM *bool  `json:"fitsVram,omitempty"` // unknown if no GPU was found
+}
+
+// handleListModels sends the pulled Ollama models to remote, with whether
+// they fit into the memory of the GPUs.
+func (b *Bridge) handleListModels(ctx context.Context) error {
+	list := modelList{Models: []modelInfo{}, GPUs: detectGPUs(ctx)}
+	client, err := ollamaClient()
+	var resp *api.ListResponse
+	if err == nil {
+		resp, err = client.List(ctx)
+	}
+	if err != nil {
+		slog.Warn("listing Ollama models", "err", err)
+	} else {
+		vram := totalVRAM(list.GPUs)
+		for _, m := range resp.Models {
+			info := modelInfo{Name: "ollama:" + m.Name, Size: m.Size}
+			if vram > 0 {
+				fits := m.Size <= vram
+				info.FitsVRAM = &fits
+			}
+			list.Models = append(list.Models, info)
+		}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeModels, Content: string(data)})
+}
+
+// warnIfExceedsVRAM warns remote if model is an Ollama model larger than
+// the memory of the GPUs. Nothing is said if no GPU was found, as then the
+// model runs on the CPU by design.
+func (b *Bridge) warnIfExceedsVRAM(ctx context.Context, model string) {
+	name, ok := ollamaModel(model)
+	if !ok {
+		return
+	}
+	vram := totalVRAM(detectGPUs(ctx))
+	if vram == 0 {
+		return
+	}
+	client, err := ollamaClient()
+	if err != nil {
+		return
+	}
+	resp, err := client.List(ctx)
+	if err != nil {
+		slog.Debug("listing Ollama models", "err", err)
+		return
+	}
+	i := slices.IndexFunc(resp.Models, func(m api.ListModelResponse) bool {
+		return m.Name == name || m.Name == name+":latest"
+	})
+	if i < 0 || resp.Models[i].Size <= vram {
+		return
+	}
+	msg := fmt.Sprintf("model %s has %d MiB but the GPUs only %d MiB, it will run partly on the CPU and slowly",
+		model, resp.Models[i].Size>>20, vram>>20)
+	slog.Warn(msg)
+	if err := b.send(warningMessage(bridgeError{Code: warnModelExceedsVRAM, Message: msg})); err != nil {
+		slog.Error("sending message", "err", err)
+	}
+}
+
+// modelMemory is how much of a loaded model is in the memory of the GPUs, in
+// the statistics of done messages.
+type modelMemory struct {
+	Size     int64 `json:"size"`     // bytes
+	SizeVRAM int64 `json:"sizeVram"` // bytes, less than Size if the model runs partly on the CPU
+}
+
+// memoryTTL is how long the memory of a model is reported in done messages
+// without asking Ollama again.
+const memoryTTL = 30 * time.Second
+
+// memoryReport is the memory of a model as Ollama reported it.
+type memoryReport struct {
+	model   string
+	memory  *modelMemory
+	fetched time.Time
+}
+
+// modelMemory returns the memory of model for a done message, asking Ollama
+// only for its own models and not more often than every memoryTTL.
+func (b *Bridge) modelMemory(ctx context.Context, model string) *modelMemory {
+	if _, ok := ollamaModel(model); !ok {
+		return nil
+	}
+	r := &b.memory
+	if r.model != model || time.Since(r.fetched) >= memoryTTL {
+		*r = memoryReport{model: model, memory: loadedModelMemory(ctx, model), fetched: time.Now()}
+	}
+	return r.memory
+}
+
+// loadedModelMemory returns the memory of model if it is an Ollama model
+// that is loaded, or nil.
+func loadedModelMemory(ctx context.Context, model string) *modelMemory {
+	name, ok := ollamaModel(model)
+	if !ok {
+		return nil
+	}
+	client, err := ollamaClient()
+	if err != nil {
+		return nil
+	}
+	resp, err := client.ListRunning(ctx)
+	if err != nil {
+		slog.Debug("listing running Ollama models", "err", err)
+		return nil
+	}
+	for _, m := range resp.Models {
+		if m.Name == name || m.Name == name+":latest" {
+			return &modelMemory{Size: m.Size, SizeVRAM: m.SizeVRAM}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+)
+
+// protocolVersion is raised with every change of the messages that older
+// frontends cannot ignore.
+//
+//  1. the handshake
+//  2. replies echo the ID of the message they reply to
+//  3. pings need a pong
+const protocolVersion = 3
+
+// accepted are the message types the bridge understands from remote.
+var accepted = []string{
+	msgTypePrompt, msgTypeQuit, msgTypeAllow, msgTypeDeny, msgTypeApprovePlan, msgTypeRejectPlan,
+	msgTypeEmbed, msgTypeSummarize, msgTypeGetHistory, msgTypeEstimateTokens, msgTypeForkSession,
+	msgTypePin, msgTypeUnpin, msgTypeListPins, msgTypeListJobResults,
+	msgTypeListTemplates, msgTypeComplete, msgTypeReadResource, msgTypeGetServerStatus,
+	msgTypeVersion, msgTypeCancelPrompt, msgTypePing, msgTypePong, msgTypeProvideArgs,
+	msgTypePullModel, msgTypeAllowAlways, msgTypeListModels, msgTypeRetryTool,
+	msgTypeExport, msgTypeBatchDecisions, msgTypeResumeSession, msgTypeClearContext,
+	msgTypeSetVerbosity, msgTypeOpenSession, msgTypeCloseSession, msgTypeExportTranscript,
+	msgTypeCheckpoint, msgTypeRollback, msgTypeSetSystemPrompt, msgTypeGetPolicy,
+	msgTypeSwitchModel,
+}
+
+// hello announces the bridge to remote when it connects.
+type hello struct {
+	Protocol int      `json:"protocol"`
+	Messages []string `json:"messages"` // message types accepted from remote
+
+	// Compress are the content encodings the bridge compresses large content
+	// with, if remote lists them in its version reply.
+	Compress []string `json:"compress,omitempty"`
+}
+
+// remoteVersion is the reply of remote to hello. Frontends older than the
+// handshake do not reply, they are taken for protocol 0.
+type remoteVersion struct {
+	Protocol int    `json:"protocol"`
+	Version  string `json:"version"`
+
+	// Compress are the content encodings remote decompresses.
+	Compress []string `json:"compress,omitempty"`
+}
+
+func (b *Bridge) helloMessage() (Message, error) {
+	h := hello{Protocol: protocolVersion, Messages: slices.Clone(accepted)}
+	if b.clients != nil {
+		h.Messages = append(h.Messages, msgTypeObserve, msgTypeResumeStream)
+	}
+	if b.conf.Admin {
+		h.Messages = append(h.Messages, msgTypeSetLogLevel, msgTypeAdminMetrics, msgTypeSelfTest, msgTypeRestartServer, msgTypeDeleteModel)
+	}
+	if b.conf.Compress != "" {
+		h.Compress = []string{b.conf.Compress}
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{MsgType: msgTypeHello, Content: string(data)}, nil
+}
+
+// handleVersion records the version remote replied with.
+func (b *Bridge) handleVersion(content string) {
+	var v remoteVersion
+	if err := json.Unmarshal([]byte(content), &v); err != nil {
+		slog.Warn("parsing version of remote", "err", err)
+		return
+	}
+	b.remote = v
+	slog.Info("remote connected", "protocol", v.Protocol, "version", v.Version)
+	if b.conf.Compress != "" && slices.Contains(v.Compress, b.conf.Compress) {
+		b.sendMu.Lock()
+		b.encoding = b.conf.Compress
+		b.sendMu.Unlock()
+	}
+	if v.Protocol > protocolVersion {
+		slog.Warn("remote speaks a newer protocol, messages it expects may be missing", "protocol", v.Protocol, "bridge", protocolVersion)
+	}
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const heartbeatMisses = 3 // intervals without a line from remote after which it is taken for dead
+
+// heartbeat notes when remote was last heard of, for pings to detect a dead
+// frontend.
+type heartbeat struct {
+	last atomic.Int64 // unix nanoseconds
+}
+
+// seen notes that a line came from remote.
+func (h *heartbeat) seen() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+func (h *heartbeat) silence() time.Duration {
+	return time.Since(time.Unix(0, h.last.Load()))
+}
+
+// startHeartbeat pings remote every interval until ctx is done. If remote
+// sends nothing, not even a pong, for heartbeatMisses intervals, the work
+// for it is canceled as if the connection was lost.
+func (b *Bridge) startHeartbeat(ctx context.Context, interval time.Duration) {
+	b.heartbeat.seen()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if silence := b.heartbeat.silence(); silence > heartbeatMisses*interval {
+				slog.Warn("remote does not answer pings", "silence", silence)
+				b.disconnect(fmt.Errorf("%w: no pong for %s", ErrConnectionLost, silence.Round(time.Second)))
+				return
+			}
+			id, err := newID()
+			if err != nil {
+				slog.Error("creating message ID", "err", err)
+				continue
+			}
+			if err := b.send(Message{ID: id, MsgType: msgTypePing}); err != nil {
+				slog.Error("sending message", "err", err)
+			}
+		}
+	}()
+}
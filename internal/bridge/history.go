@@ -0,0 +1,149 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+const interruptedMarker = "\n\n[interrupted]"
+
+// keepInterrupted adds a canceled prompt and the partial response streamed
+// so far to the history of host, so the model knows what it already said.
+// It returns the number of bytes of the response retained.
+func keepInterrupted(host Host, prompt, partial string) (int, error) {
+	if partial == "" {
+		return 0, nil
+	}
+	err := host.AddMessages([]*schema.Message{
+		schema.UserMessage(prompt),
+		schema.AssistantMessage(partial+interruptedMarker, nil),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(partial), nil
+}
+
+// keepRedirected adds a prompt canceled for the bridge to run a tool call and
+// the response so far to the history of host. The result of the tool is then
+// sent as the next prompt.
+func keepRedirected(host Host, prompt, partial string) error {
+	return host.AddMessages([]*schema.Message{
+		schema.UserMessage(prompt),
+		schema.AssistantMessage(partial, nil),
+	})
+}
+
+// historyEntry is a message of the conversation as sent to remote.
+type historyEntry struct {
+	ID         string            `json:"id"`
+	Role       string            `json:"role"`
+	Content    string            `json:"content"`
+	ToolCalls  []historyToolCall `json:"toolCalls,omitempty"`
+	ToolCallID string            `json:"toolCallId,omitempty"` // of tool results
+	Timestamp  time.Time         `json:"timestamp"`
+	Tokens     int               `json:"tokens"` // estimated, the SDK does not keep the token usage
+}
+
+type historyToolCall struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// estimateTokens guesses the tokens of text at about four bytes per token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+func conversationHistory(host Host) []historyEntry {
+	entries := []historyEntry{}
+	info := host.MessageInfo()
+	for i, m := range host.Messages() {
+		e := historyEntry{
+			Role:       string(m.Role),
+			Content:    m.Content,
+			ToolCallID: m.ToolCallID,
+			Tokens:     messageTokens(m),
+		}
+		if i < len(info) {
+			e.ID, e.Timestamp = info[i].ID, info[i].Timestamp
+		}
+		for _, tc := range m.ToolCalls {
+			e.ToolCalls = append(e.ToolCalls, historyToolCall{ID: tc.ID, Name: tc.Function.Name, Arguments: rawArgs(tc.Function.Arguments)})
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// handleGetHistory sends the conversation of the session or agent of msg, or
+// of the default agent if it has not been used yet, to remote.
+func (b *Bridge) handleGetHistory(host Host, msg Message) error {
+	if h, _, ok := b.sessionHost(msg.Session); ok {
+		host = h
+	} else if h, ok := b.agentHosts[msg.Agent]; ok {
+		host = h
+	}
+	data, err := json.Marshal(conversationHistory(host))
+	if err != nil {
+		return err
+	}
+	reply := Message{MsgType: msgTypeHistory, Content: string(data), Session: msg.Session}
+	return b.send(reply.withMeta("tokens", countContextTokens(host.Messages())))
+}
+
+// handleClearContext starts the conversation of the session or agent of msg
+// anew, keeping the host and its MCP servers running, and tells remote how
+// many tokens went.
+func (b *Bridge) handleClearContext(host Host, msg Message) error {
+	if h, _, ok := b.sessionHost(msg.Session); ok {
+		host = h
+	} else if h, ok := b.agentHosts[msg.Agent]; ok {
+		host = h
+	}
+	removed := countContextTokens(host.Messages()).Total
+	host.ClearSession()
+	delete(b.contextWarned, host)
+	clear(b.attachmentStore(msg.Session))
+	slog.Info("cleared conversation", "session", msg.Session, "agent", msg.Agent, "tokens", removed)
+	reply := Message{MsgType: msgTypeContextCleared, Session: msg.Session, Agent: msg.Agent}
+	return b.send(reply.withMeta("removedTokens", removed))
+}
+
+// tokenCount is the reply to estimate-tokens. Exact is false if the count is
+// estimated because the tokenizer of the model is not available.
+type tokenCount struct {
+	Tokens int    `json:"tokens"`
+	Exact  bool   `json:"exact"`
+	Model  string `json:"model"`
+}
+
+// handleEstimateTokens sends the number of tokens of text with the model of
+// agent, or of the default agent, to remote.
+func (b *Bridge) handleEstimateTokens(ctx context.Context, host Host, agent, text string) error {
+	model := host.GetModelString()
+	if agent != "" && agent != defaultAgent {
+		// the agent's model is known without creating its host
+		if opts, err := b.agentOptions(agent); err == nil {
+			model = opts.Model
+		}
+	}
+	count := tokenCount{Tokens: estimateTokens(text), Model: model}
+	if _, ok := ollamaModel(model); ok {
+		if tokens, err := countTokens(ctx, model, text); err != nil {
+			slog.Debug("counting tokens", "model", model, "err", err)
+		} else {
+			count.Tokens, count.Exact = tokens, true
+		}
+	}
+	data, err := json.Marshal(count)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeTokenCount, Content: string(data)})
+}
@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+	"github.com/mark3labs/mcphost/sdk"
+)
+
+// Host is the part of the mcphost SDK the bridge uses, so tests can replace
+// it.
+type Host interface {
+	Prompt(ctx context.Context, message string) (string, error)
+	PromptWithCallbacks(ctx context.Context, message string,
+		onToolCall func(name, args string),
+		onToolResult func(name, args, result string, isError bool),
+		onStreaming func(chunk string)) (string, error)
+	GetModelString() string
+	ClearSession()
+	Close() error
+
+	Messages() []*schema.Message
+	ReplaceMessages(messages []*schema.Message) error
+	AddMessages(messages []*schema.Message) error
+	MessageInfo() []MessageInfo // in the order of Messages
+}
+
+// MessageInfo is what the session keeps about a message besides its content.
+type MessageInfo struct {
+	ID        string
+	Timestamp time.Time
+}
+
+// HostFactory creates a host, like sdk.New.
+type HostFactory func(ctx context.Context, opts *sdk.Options) (Host, error)
+
+// sdkHost adapts an sdk.MCPHost to Host.
+type sdkHost struct {
+	*sdk.MCPHost
+}
+
+// NewSDKHost creates a host with the mcphost SDK.
+func NewSDKHost(ctx context.Context, opts *sdk.Options) (Host, error) {
+	host, err := sdk.New(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sdkHost{host}, nil
+}
+
+func (h sdkHost) Messages() []*schema.Message {
+	return h.GetSessionManager().GetMessages()
+}
+
+func (h sdkHost) ReplaceMessages(messages []*schema.Message) error {
+	return h.GetSessionManager().ReplaceAllMessages(messages)
+}
+
+func (h sdkHost) AddMessages(messages []*schema.Message) error {
+	return h.GetSessionManager().AddMessages(messages)
+}
+
+func (h sdkHost) MessageInfo() []MessageInfo {
+	var info []MessageInfo
+	for _, m := range h.GetSessionManager().GetSession().Messages {
+		info = append(info, MessageInfo{ID: m.ID, Timestamp: m.Timestamp})
+	}
+	return info
+}
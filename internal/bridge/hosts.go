@@ -0,0 +1,47 @@
+package bridge
+
+import (
+	"context"
+	"os"
+
+	"github.com/mark3labs/mcphost/sdk"
+)
+
+// helperHost returns a host for model without tools, creating it on first use.
+func (b *Bridge) helperHost(ctx context.Context, model, systemPrompt string) (Host, error) {
+	key := [2]string{model, systemPrompt}
+	if host, ok := b.helperHosts[key]; ok {
+		return host, nil
+	}
+	f, err := os.CreateTemp("", "mcphost-cockpit-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"mcpServers": {}}`)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	host, err := b.newHost(ctx, &sdk.Options{
+		Model:        model,
+		ConfigFile:   f.Name(),
+		SystemPrompt: systemPrompt,
+		Streaming:    false,
+		Quiet:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.helperHosts[key] = host
+	return host, nil
+}
+
+func (b *Bridge) closeHelperHosts() {
+	for key, host := range b.helperHosts {
+		host.Close()
+		delete(b.helperHosts, key)
+	}
+}
@@ -0,0 +1,230 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+const maxJobResults = 100 // results kept of all jobs, older ones are dropped
+
+// jobConfig is a prompt run on a schedule in service mode. Nobody is there
+// to confirm tool calls, so tools not allowed stop the job. The calls go
+// through the policies like those of prompts, AllowTools taking the place
+// of remote.
+type jobConfig struct {
+	Schedule   string   `json:"schedule"` // see parseSchedule
+	Prompt     string   `json:"prompt"`
+	Agent      string   `json:"agent"`      // agent profile running the prompt, the default agent if empty
+	AllowTools []string `json:"allowTools"` // tool name patterns run without confirmation
+}
+
+// jobResult is the outcome of a job run as sent to remote.
+type jobResult struct {
+	Job      string    `json:"job"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Response string    `json:"response"`
+	Tools    []string  `json:"tools,omitempty"`  // tools run
+	Denied   string    `json:"denied,omitempty"` // tool not allowed that stopped the job
+	Error    string    `json:"error,omitempty"`
+}
+
+type job struct {
+	name     string
+	conf     jobConfig
+	schedule schedule
+	host     Host
+	last     time.Time
+}
+
+// jobScheduler runs the jobs of the bridge config in the background.
+type jobScheduler struct {
+	jobs []*job
+	stop context.CancelFunc
+	done chan struct{}
+
+	mu      sync.Mutex
+	results []jobResult
+}
+
+func newJobScheduler(confs map[string]jobConfig) (*jobScheduler, error) {
+	s := &jobScheduler{}
+	for _, name := range slices.Sorted(maps.Keys(confs)) {
+		sched, err := parseSchedule(confs[name].Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %w", name, err)
+		}
+		s.jobs = append(s.jobs, &job{name: name, conf: confs[name], schedule: sched})
+	}
+	return s, nil
+}
+
+// StartJobs starts running the scheduled jobs of the bridge config until the
+// bridge is closed. It is meant for service mode, where the bridge keeps
+// running without a user watching.
+func (b *Bridge) StartJobs(ctx context.Context) error {
+	if len(b.jobs.jobs) == 0 || b.jobs.stop != nil {
+		return nil
+	}
+	for _, j := range b.jobs.jobs {
+		opts, err := b.agentOptions(j.agent())
+		if err != nil {
+			return fmt.Errorf("job %s: %w", j.name, err)
+		}
+		j.host, err = b.newHost(ctx, &opts)
+		if err != nil {
+			return fmt.Errorf("job %s: %w", j.name, err)
+		}
+	}
+	ctx, b.jobs.stop = context.WithCancel(ctx)
+	b.jobs.done = make(chan struct{})
+	go b.jobs.run(ctx, b.runJob)
+	return nil
+}
+
+func (j *job) agent() string {
+	if j.conf.Agent == "" {
+		return defaultAgent
+	}
+	return j.conf.Agent
+}
+
+// run checks every minute for due jobs and runs them one after the other
+// with runJob.
+func (s *jobScheduler) run(ctx context.Context, runJob func(context.Context, *job) jobResult) {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, j := range s.jobs {
+				if ctx.Err() == nil && j.schedule.due(now, j.last) {
+					j.last = now
+					s.add(runJob(ctx, j))
+				}
+			}
+		}
+	}
+}
+
+// runJob prompts the host of j in a fresh conversation. Its tool calls are
+// authorized like those of prompts, without telling remote, and the ones
+// nothing else decides on run if j allows them.
+func (b *Bridge) runJob(ctx context.Context, j *job) jobResult {
+	slog.Info("running job", "job", j.name)
+	res := jobResult{Job: j.name, Started: time.Now()}
+	j.host.ClearSession()
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	caller := toolCaller{
+		confirm: func(_ context.Context, name, _ string) (bool, string) { return j.allows(name), "" },
+		quiet:   true,
+	}
+	var toolStart time.Time
+	toolRunning := ""
+	response, err := j.host.PromptWithCallbacks(jobCtx, j.conf.Prompt,
+		func(name, args string) {
+			if allow, _ := b.authorizeCall(jobCtx, caller, name, args, false); !allow {
+				slog.Warn("job called a tool not allowed", "job", j.name, "tool", name)
+				res.Denied = name
+				cancel()
+				return
+			}
+			// jobs run beside prompts and each other, so they share the limits
+			if err := b.limiter.acquire(jobCtx, name); err != nil {
+				slog.Warn("job waiting for tool slot", "job", j.name, "err", err)
+				return
+			}
+			toolRunning = name
+			res.Tools = append(res.Tools, name)
+			toolStart = time.Now()
+		},
+		func(name, args, _ string, isError bool) {
+			if toolRunning != "" {
+				b.limiter.release(toolRunning)
+				toolRunning = ""
+			}
+			status := auditOK
+			switch {
+			case isError:
+				status = auditFailed
+			case errors.Is(jobCtx.Err(), context.Canceled):
+				status = auditCanceled
+			}
+			b.recordToolRun(name, args, toolStart, status)
+		}, nil)
+	res.Finished = time.Now()
+	res.Response = response
+	if res.Denied != "" {
+		res.Error = fmt.Sprintf("tool %s is not allowed", res.Denied)
+	} else if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (j *job) allows(tool string) bool {
+	for _, pattern := range j.conf.AllowTools {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jobScheduler) add(res jobResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, res)
+	if len(s.results) > maxJobResults {
+		s.results = slices.Delete(s.results, 0, len(s.results)-maxJobResults)
+	}
+}
+
+// resultsOf returns the results of job, or of all jobs if job is empty,
+// oldest first.
+func (s *jobScheduler) resultsOf(job string) []jobResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := []jobResult{}
+	for _, res := range s.results {
+		if job == "" || res.Job == job {
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+func (b *Bridge) handleListJobResults(job string) error {
+	data, err := json.Marshal(b.jobs.resultsOf(job))
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeJobResults, Content: string(data)})
+}
+
+// close stops the scheduler, waiting for a running job, and closes the job
+// hosts.
+func (s *jobScheduler) close() {
+	if s.stop != nil {
+		s.stop()
+		<-s.done
+	}
+	for _, j := range s.jobs {
+		if j.host != nil {
+			j.host.Close()
+			j.host = nil
+		}
+	}
+}
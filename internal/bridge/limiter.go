@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"context"
+	"strings"
+)
+
+// toolLimiter bounds the number of tools executing at the same time, both
+// overall and per MCP server. A prompt runs its calls one after the other,
+// the calls that overlap are those of background tools, scheduled jobs and
+// prompts running meanwhile.
+type toolLimiter struct {
+	all     chan struct{} // nil for no overall limit
+	servers map[string]chan struct{}
+}
+
+func newToolLimiter(maxParallel int, servers map[string]serverConfig) *toolLimiter {
+	l := &toolLimiter{servers: map[string]chan struct{}{}}
+	if maxParallel > 0 {
+		l.all = make(chan struct{}, maxParallel)
+	}
+	for name, s := range servers {
+		if s.MaxParallelTools > 0 {
+			l.servers[name] = make(chan struct{}, s.MaxParallelTools)
+		}
+	}
+	return l
+}
+
+// serverName extracts the MCP server from a tool name as prefixed by mcphost,
+// "" if it has no prefix.
+func serverName(tool string) string {
+	server, _, found := strings.Cut(tool, "__")
+	if !found {
+		return ""
+	}
+	return server
+}
+
+// acquire blocks until the tool may run or ctx is done.
+func (l *toolLimiter) acquire(ctx context.Context, tool string) error {
+	if l.all != nil {
+		select {
+		case l.all <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if sem, ok := l.servers[serverName(tool)]; ok {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			if l.all != nil {
+				<-l.all
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (l *toolLimiter) release(tool string) {
+	if sem, ok := l.servers[serverName(tool)]; ok {
+		<-sem
+	}
+	if l.all != nil {
+		<-l.all
+	}
+}
@@ -0,0 +1,168 @@
+package bridge
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/cloudwego/eino/schema"
+	"github.com/mark3labs/mcphost/sdk"
+)
+
+const (
+	lowMemoryHistory = 20  // messages kept of each conversation in low memory mode
+	lowMemoryBuffer  = 512 // initial size of the buffer for messages from remote
+)
+
+// trimHistory drops old messages of host beyond keep, starting the kept
+// part with a user message so no tool result loses its call. The system
+// message stays, and so does the last user turn even if it is longer.
+func trimHistory(host Host, keep int) error {
+	messages := host.Messages()
+	if len(messages) <= keep {
+		return nil
+	}
+	var system []*schema.Message
+	if messages[0].Role == schema.System {
+		system, messages = messages[:1], messages[1:]
+	}
+	first := max(0, len(messages)-keep+len(system))
+	start := first
+	for start < len(messages) && messages[start].Role != schema.User {
+		start++
+	}
+	if start == len(messages) {
+		// the last turn is longer than keep, so it is kept whole
+		start = first - 1
+		for start >= 0 && messages[start].Role != schema.User {
+			start--
+		}
+		if start < 0 {
+			return nil // no turn to keep
+		}
+	}
+	if start == 0 {
+		return nil
+	}
+	return host.ReplaceMessages(append(slices.Clone(system), messages[start:]...))
+}
+
+// shed frees what the bridge can recreate after a request in low memory
+// mode: the helper and preset hosts.
+func (b *Bridge) shed(hosts ...Host) {
+	for _, host := range hosts {
+		if err := trimHistory(host, lowMemoryHistory); err != nil {
+			slog.Warn("trimming history", "err", err)
+		}
+	}
+	b.closeHelperHosts()
+	b.closePresetHosts()
+}
+
+// lazyHost creates its host on first use, so the MCP servers and the model
+// connection are only set up once remote sends the first prompt.
+type lazyHost struct {
+	ctx     context.Context
+	opts    sdk.Options
+	newHost HostFactory
+
+	mu   sync.Mutex
+	host Host
+}
+
+// get creates the host unless it exists. Failures are not kept, so a model
+// pulled meanwhile is found on the next use.
+func (h *lazyHost) get() (Host, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.host != nil {
+		return h.host, nil
+	}
+	host, err := h.newHost(h.ctx, &h.opts)
+	if err != nil {
+		return nil, err
+	}
+	h.host = host
+	return host, nil
+}
+
+func (h *lazyHost) Prompt(ctx context.Context, message string) (string, error) {
+	host, err := h.get()
+	if err != nil {
+		return "", err
+	}
+	return host.Prompt(ctx, message)
+}
+
+func (h *lazyHost) PromptWithCallbacks(ctx context.Context, message string,
+	onToolCall func(name, args string),
+	onToolResult func(name, args, result string, isError bool),
+	onStreaming func(chunk string)) (string, error) {
+	host, err := h.get()
+	if err != nil {
+		return "", err
+	}
+	return host.PromptWithCallbacks(ctx, message, onToolCall, onToolResult, onStreaming)
+}
+
+// loaded returns the host if it was created, nil otherwise.
+func (h *lazyHost) loaded() Host {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.host
+}
+
+func (h *lazyHost) GetModelString() string {
+	host := h.loaded()
+	if host == nil {
+		return h.opts.Model
+	}
+	return host.GetModelString()
+}
+
+func (h *lazyHost) ClearSession() {
+	if host := h.loaded(); host != nil {
+		host.ClearSession()
+	}
+}
+
+func (h *lazyHost) Close() error {
+	host := h.loaded()
+	if host == nil {
+		return nil
+	}
+	return host.Close()
+}
+
+func (h *lazyHost) Messages() []*schema.Message {
+	host := h.loaded()
+	if host == nil {
+		return nil
+	}
+	return host.Messages()
+}
+
+func (h *lazyHost) ReplaceMessages(messages []*schema.Message) error {
+	host, err := h.get()
+	if err != nil {
+		return err
+	}
+	return host.ReplaceMessages(messages)
+}
+
+func (h *lazyHost) AddMessages(messages []*schema.Message) error {
+	host, err := h.get()
+	if err != nil {
+		return err
+	}
+	return host.AddMessages(messages)
+}
+
+func (h *lazyHost) MessageInfo() []MessageInfo {
+	host := h.loaded()
+	if host == nil {
+		return nil
+	}
+	return host.MessageInfo()
+}
@@ -0,0 +1,123 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Middleware transforms protocol messages exchanged with remote, e.g. for
+// redaction, logging or translation. Returning false drops the message.
+// Deployments can add their own by calling registerMiddleware from an init
+// function in a separate file, they apply to every Bridge created after.
+type Middleware interface {
+	Inbound(msg Message) (Message, bool, error)  // messages received from remote
+	Outbound(msg Message) (Message, bool, error) // messages about to be sent to remote
+}
+
+var middlewares []Middleware
+
+func registerMiddleware(m Middleware) {
+	middlewares = append(middlewares, m)
+}
+
+func (b *Bridge) applyInbound(msg Message) (Message, bool, error) {
+	for _, m := range b.middlewares {
+		var keep bool
+		var err error
+		msg, keep, err = m.Inbound(msg)
+		if err != nil || !keep {
+			return msg, false, err
+		}
+	}
+	return msg, true, nil
+}
+
+func (b *Bridge) applyOutbound(msg Message) (Message, bool, error) {
+	for _, m := range b.middlewares {
+		var keep bool
+		var err error
+		msg, keep, err = m.Outbound(msg)
+		if err != nil || !keep {
+			return msg, false, err
+		}
+	}
+	return msg, true, nil
+}
+
+type filterRequest struct {
+	Direction string  `json:"direction"` // "in" or "out"
+	Message   Message `json:"message"`
+}
+
+// filterProcess is a Middleware backed by an external process. For each
+// message it gets a filterRequest as a JSON line on stdin and must reply with
+// one line holding the resulting message, or null to drop it.
+type filterProcess struct {
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	scanner *bufio.Scanner
+}
+
+func startFilterProcess(command string) (*filterProcess, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty filter command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &filterProcess{cmd: cmd, in: in, scanner: bufio.NewScanner(out)}, nil
+}
+
+func (f *filterProcess) filter(direction string, msg Message) (Message, bool, error) {
+	err := json.NewEncoder(f.in).Encode(filterRequest{Direction: direction, Message: msg})
+	if err != nil {
+		return msg, false, fmt.Errorf("writing to filter: %w", err)
+	}
+	if !f.scanner.Scan() {
+		err := f.scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return msg, false, fmt.Errorf("reading from filter: %w", err)
+	}
+	var result *Message
+	err = json.Unmarshal(f.scanner.Bytes(), &result)
+	if err != nil {
+		return msg, false, fmt.Errorf("parsing filter output: %w", err)
+	}
+	if result == nil {
+		return msg, false, nil
+	}
+	return *result, true, nil
+}
+
+func (f *filterProcess) Inbound(msg Message) (Message, bool, error) {
+	return f.filter("in", msg)
+}
+
+func (f *filterProcess) Outbound(msg Message) (Message, bool, error) {
+	return f.filter("out", msg)
+}
+
+func (f *filterProcess) Close() error {
+	f.in.Close()
+	return f.cmd.Wait()
+}
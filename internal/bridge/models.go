@@ -0,0 +1,216 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcphost/sdk"
+	"github.com/ollama/ollama/api"
+)
+
+// pullProgressInterval is how often the progress of a pull is sent to
+// remote while its status stays the same. Ollama reports it many times a
+// second.
+const pullProgressInterval = 500 * time.Millisecond
+
+// modelNotFoundError is returned for a host whose model does not exist, with
+// the models the provider has instead.
+type modelNotFoundError struct {
+	Model     string
+	Available []string // the closest to Model first
+}
+
+func (e *modelNotFoundError) Error() string {
+	msg := "model " + e.Model + " not found"
+	if _, ok := ollamaModel(e.Model); ok {
+		msg += ", pull it with pull-model"
+	}
+	if len(e.Available) > 0 {
+		msg += ", available are " + strings.Join(e.Available, ", ")
+	}
+	return msg
+}
+
+// checkModel returns a modelNotFoundError if model is an Ollama model that
+// was not pulled. The SDK would pull it itself, without telling remote and
+// with progress bars on the terminal. Other providers are left to the SDK.
+func checkModel(ctx context.Context, model string) error {
+	name, ok := ollamaModel(model)
+	if !ok {
+		return nil
+	}
+	client, err := ollamaClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.Show(ctx, &api.ShowRequest{Model: name})
+	var statusErr api.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		return nil // found, or Ollama fails in a way the SDK reports as well
+	}
+	notFound := &modelNotFoundError{Model: model}
+	list, err := client.List(ctx)
+	if err != nil {
+		slog.Warn("listing Ollama models", "err", err)
+		return notFound
+	}
+	for _, m := range list.Models {
+		notFound.Available = append(notFound.Available, "ollama:"+m.Name)
+	}
+	slices.SortStableFunc(notFound.Available, func(a, b string) int {
+		return editDistance(a, model) - editDistance(b, model)
+	})
+	return notFound
+}
+
+// editDistance returns the Levenshtein distance of a and b in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range len(a) {
+		cur := make([]int, len(b)+1)
+		cur[0] = i + 1
+		for j := range len(b) {
+			cost := 1
+			if a[i] == b[j] {
+				cost = 0
+			}
+			cur[j+1] = min(prev[j+1]+1, cur[j]+1, prev[j]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// newCheckedHost creates a host after checking that its model exists.
+func (b *Bridge) newCheckedHost(ctx context.Context, opts *sdk.Options) (Host, error) {
+	if err := checkModel(ctx, opts.Model); err != nil {
+		return nil, err
+	}
+	return b.newHost(ctx, opts)
+}
+
+// pullProgress is the content of pull-progress messages.
+type pullProgress struct {
+	Model string `json:"model"`
+	api.ProgressResponse
+}
+
+// ollamaName returns the Ollama name of model, whose ollama: prefix is
+// optional.
+func ollamaName(model string) string {
+	name, _ := ollamaModel(model)
+	return name
+}
+
+// pullModel pulls an Ollama model, passing the progress to fn. Updates with
+// the same status come at most every pullProgressInterval.
+func pullModel(ctx context.Context, name string, fn func(api.ProgressResponse) error) error {
+	client, err := ollamaClient()
+	if err != nil {
+		return err
+	}
+	var status string
+	var sent time.Time
+	return client.Pull(ctx, &api.PullRequest{Model: name}, func(p api.ProgressResponse) error {
+		if p.Status == status && time.Since(sent) < pullProgressInterval {
+			return nil
+		}
+		status, sent = p.Status, time.Now()
+		return fn(p)
+	})
+}
+
+// deleteModel deletes a pulled Ollama model.
+func deleteModel(ctx context.Context, name string) error {
+	client, err := ollamaClient()
+	if err != nil {
+		return err
+	}
+	return client.Delete(ctx, &api.DeleteRequest{Model: name})
+}
+
+// PullModel pulls an Ollama model for the pull-model command, writing the
+// progress to out.
+func PullModel(ctx context.Context, model string, out io.Writer) error {
+	return pullModel(ctx, ollamaName(model), func(p api.ProgressResponse) error {
+		if p.Total > 0 {
+			_, err := fmt.Fprintf(out, "%s: %d%%\n", p.Status, p.Completed*100/p.Total)
+			return err
+		}
+		_, err := fmt.Fprintln(out, p.Status)
+		return err
+	})
+}
+
+// DeleteModel deletes a pulled Ollama model for the delete-model command.
+func DeleteModel(ctx context.Context, model string) error {
+	return deleteModel(ctx, ollamaName(model))
+}
+
+// handlePullModel pulls the Ollama model named in content, or the configured
+// model if empty, sending the progress to remote. Remote stops the pull with
+// cancel-prompt, as it blocks the other messages until done.
+func (b *Bridge) handlePullModel(ctx context.Context, content string) error {
+	model := content
+	if model == "" {
+		model = b.conf.Model
+		if _, ok := ollamaModel(model); !ok {
+			return b.sendError(bridgeError{Code: errorPullFailed, Message: "only Ollama models can be pulled, not " + model})
+		}
+	}
+	name := ollamaName(model)
+	pullCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b.canceler.start(cancel)
+	err := pullModel(pullCtx, name, func(p api.ProgressResponse) error {
+		data, err := json.Marshal(pullProgress{Model: "ollama:" + name, ProgressResponse: p})
+		if err != nil {
+			return err
+		}
+		return b.send(Message{MsgType: msgTypePullProgress, Content: string(data)})
+	})
+	if b.canceler.stop() && ctx.Err() == nil {
+		// the client takes the stream cut short for the end of the pull
+		slog.Info("pull canceled by remote", "model", name)
+		return b.sendError(bridgeError{Code: errorPullFailed, Message: "pull of " + name + " canceled"})
+	}
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrConnectionLost) {
+			return err
+		}
+		slog.Warn("pulling model", "model", name, "err", err)
+		return b.sendError(bridgeError{Code: errorPullFailed, Message: err.Error()})
+	}
+	slog.Info("model pulled", "model", name)
+	return nil
+}
+
+// handleDeleteModel deletes the Ollama model named in content and tells
+// remote. Like the admin messages it is ignored unless Config.Admin is set.
+func (b *Bridge) handleDeleteModel(ctx context.Context, content string) error {
+	if !b.conf.Admin {
+		slog.Warn("admin messages are not enabled", "MsgType", msgTypeDeleteModel)
+		return nil
+	}
+	if content == "" {
+		return b.sendError(bridgeError{Code: errorDeleteFailed, Message: "no model to delete"})
+	}
+	name := ollamaName(content)
+	if err := deleteModel(ctx, name); err != nil {
+		slog.Warn("deleting model", "model", name, "err", err)
+		return b.sendError(bridgeError{Code: errorDeleteFailed, Message: err.Error()})
+	}
+	slog.Info("model deleted", "model", name)
+	return b.send(Message{MsgType: msgTypeModelDeleted, Content: "ollama:" + name})
+}
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ollamaModel returns the Ollama model name of an mcphost model string like
+// ollama:qwen2.5:3b, or false for other providers.
+func ollamaModel(model string) (string, bool) {
+	return strings.CutPrefix(model, "ollama:")
+}
+
+// ollamaClient connects to OLLAMA_HOST, or the default local Ollama, like
+// mcphost itself does.
+func ollamaClient() (*api.Client, error) {
+	return api.ClientFromEnvironment()
+}
+
+func embed(ctx context.Context, model, text string) ([]float32, error) {
+	name, ok := ollamaModel(model)
+	if !ok {
+		return nil, fmt.Errorf("embeddings are only supported with ollama models, not %s", model)
+	}
+	client, err := ollamaClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Embed(ctx, &api.EmbedRequest{Model: name, Input: text})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Embeddings) == 0 {
+		return nil, errors.New("no embedding returned")
+	}
+	return resp.Embeddings[0], nil
+}
+
+// countTokens returns the number of tokens of text with the tokenizer of an
+// Ollama model, taken from the prompt evaluation count of an embedding.
+func countTokens(ctx context.Context, model, text string) (int, error) {
+	name, ok := ollamaModel(model)
+	if !ok {
+		return 0, fmt.Errorf("token counts are only supported with ollama models, not %s", model)
+	}
+	client, err := ollamaClient()
+	if err != nil {
+		return 0, err
+	}
+	truncate := false
+	resp, err := client.Embed(ctx, &api.EmbedRequest{Model: name, Input: text, Truncate: &truncate})
+	if err != nil {
+		return 0, err
+	}
+	if resp.PromptEvalCount == 0 && text != "" {
+		return 0, errors.New("no token count returned")
+	}
+	return resp.PromptEvalCount, nil
+}
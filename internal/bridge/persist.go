@@ -0,0 +1,113 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// historyFile keeps the main conversation on disk, see Config.HistoryFile, so
+// a restarted bridge can go on with it.
+type historyFile struct {
+	path    string
+	saved   []*schema.Message // the messages last saved, to write only changes
+	resumed bool
+}
+
+// savedHistory is the content of a history file.
+type savedHistory struct {
+	Model    string            `json:"model"` // the conversation was with
+	Saved    time.Time         `json:"saved"`
+	Messages []*schema.Message `json:"messages"`
+}
+
+// save writes the conversation of host to the file if it changed since last
+// time, replacing the file at once so it is never half written.
+func (f *historyFile) save(host Host) error {
+	messages := host.Messages()
+	if slices.Equal(messages, f.saved) {
+		return nil
+	}
+	data, err := json.Marshal(savedHistory{Model: host.GetModelString(), Saved: time.Now(), Messages: messages})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path) // CreateTemp made it private
+	}
+	if err != nil {
+		return err
+	}
+	f.saved = slices.Clone(messages)
+	return nil
+}
+
+// resume replaces the conversation of host with the one in the file. A file
+// not there yet is no error, the conversation starts anew.
+func (f *historyFile) resume(host Host) error {
+	f.resumed = true
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedHistory
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("parsing %s: %w", f.path, err)
+	}
+	if saved.Model != host.GetModelString() {
+		slog.Info("resuming conversation of another model", "saved", saved.Model, "model", host.GetModelString())
+	}
+	if err := host.ReplaceMessages(saved.Messages); err != nil {
+		return err
+	}
+	f.saved = slices.Clone(host.Messages())
+	slog.Info("resumed conversation", "path", f.path, "messages", len(saved.Messages), "saved", saved.Saved)
+	return nil
+}
+
+// saveHistory saves the main conversation, if Config.HistoryFile is set.
+// Failures are logged, the conversation goes on.
+func (b *Bridge) saveHistory(host Host) {
+	if b.history == nil {
+		return
+	}
+	if err := b.history.save(host); err != nil {
+		slog.Warn("saving conversation", "path", b.history.path, "err", err)
+	}
+}
+
+// handleResumeSession continues the conversation saved in the history file,
+// unless the bridge already did, and sends it to remote like get-history, so
+// a reloaded frontend can show it again.
+func (b *Bridge) handleResumeSession(host Host, msg Message) error {
+	if b.history == nil {
+		return b.sendError(bridgeError{Code: errorResumeFailed, Message: "the bridge keeps no history file"})
+	}
+	if !b.history.resumed && len(host.Messages()) == 0 {
+		if err := b.history.resume(host); err != nil {
+			slog.Warn("resuming conversation", "err", err)
+			return b.sendError(bridgeError{Code: errorResumeFailed, Message: err.Error()})
+		}
+	}
+	return b.handleGetHistory(host, Message{})
+}
@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// pin is a snippet of text remote wants the model to see with every prompt.
+type pin struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// pinnedPrompt returns prompt with the pinned snippets before it. They are
+// sent with every prompt instead of kept in the history, so they survive
+// compaction and trimming.
+func (b *Bridge) pinnedPrompt(prompt string) string {
+	return b.pinBlock() + prompt
+}
+
+func (b *Bridge) pinBlock() string {
+	if len(b.pins) == 0 {
+		return ""
+	}
+	var block strings.Builder
+	block.WriteString("Pinned context:\n")
+	for _, p := range b.pins {
+		block.WriteString("\n" + p.Text + "\n")
+	}
+	block.WriteString("\nRequest:\n")
+	return block.String()
+}
+
+// unpinHistory removes the pinned snippets from the prompts in the history
+// of host, so they are not kept once per prompt.
+func (b *Bridge) unpinHistory(host Host) {
+	block := b.pinBlock()
+	if block == "" {
+		return
+	}
+	messages := host.Messages()
+	changed := false
+	for i, m := range messages {
+		if m.Role == schema.User && strings.HasPrefix(m.Content, block) {
+			unpinned := *m
+			unpinned.Content = strings.TrimPrefix(m.Content, block)
+			messages[i] = &unpinned
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := host.ReplaceMessages(messages); err != nil {
+		slog.Warn("removing pins from history", "err", err)
+	}
+}
+
+// handlePins adds or removes a pin for a pin or unpin message and sends the
+// pins to remote.
+func (b *Bridge) handlePins(msg Message) error {
+	switch msg.MsgType {
+	case msgTypePin:
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		b.pins = append(b.pins, pin{ID: id, Text: msg.Content})
+	case msgTypeUnpin:
+		b.pins = slices.DeleteFunc(b.pins, func(p pin) bool { return p.ID == msg.Content })
+	}
+	data, err := json.Marshal(append([]pin{}, b.pins...))
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypePins, Content: string(data)})
+}
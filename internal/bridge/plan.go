@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+)
+
+const planInstruction = "Do not call any tools yet. First list the tool calls you intend to make for the request below, " +
+	`as a JSON array of objects with the fields "tool", "args" and "reason". Answer with the JSON array only. ` +
+	"Answer with [] if no tools are needed.\n\nRequest:\n"
+
+type planStep struct {
+	Tool   string          `json:"tool"`
+	Args   json.RawMessage `json:"args,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+// makePlan asks the model for the tool calls it intends to make for prompt.
+// Tool calls are refused and the exchange is not kept in the history.
+func makePlan(ctx context.Context, host Host, prompt string) ([]planStep, error) {
+	messages := host.Messages()
+	defer func() {
+		err := host.ReplaceMessages(messages)
+		if err != nil {
+			slog.Error("restoring history after plan", "err", err)
+		}
+	}()
+	planCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	answer, err := host.PromptWithCallbacks(planCtx, planInstruction+prompt,
+		func(name, args string) {
+			slog.Warn("model tried to call a tool while planning", "tool", name)
+			cancel()
+		}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlan(answer)
+}
+
+// parsePlan extracts the JSON array of plan steps from a model answer,
+// tolerating surrounding text and code fences.
+func parsePlan(answer string) ([]planStep, error) {
+	start := strings.Index(answer, "[")
+	end := strings.LastIndex(answer, "]")
+	if start < 0 || end < start {
+		return nil, errors.New("no plan in answer")
+	}
+	var steps []planStep
+	err := json.Unmarshal([]byte(answer[start:end+1]), &steps)
+	return steps, err
+}
+
+// approvePlan sends the plan to remote and waits for its approval, or for
+// ctx to be canceled.
+func (b *Bridge) approvePlan(ctx context.Context, steps []planStep) (bool, error) {
+	data, err := json.Marshal(steps)
+	if err != nil {
+		return false, err
+	}
+	id, err := newID()
+	if err != nil {
+		return false, err
+	}
+	err = b.send(Message{ID: id, MsgType: msgTypePlan, Content: string(data)})
+	if err != nil {
+		return false, err
+	}
+	msg, err := b.recvReply(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	switch msg.MsgType {
+	case msgTypeApprovePlan:
+		return true, nil
+	case msgTypeRejectPlan:
+		return false, nil
+	default:
+		slog.Warn("expected approve or reject plan, got", "MsgType", msg.MsgType)
+		return false, nil
+	}
+}
+
+// plannedTools counts the calls per tool of an approved plan. Models often
+// leave out the server prefix mcphost adds to tool names, so take tool calls
+// out with take.
+type plannedTools map[string]int
+
+func newPlannedTools(steps []planStep) plannedTools {
+	p := plannedTools{}
+	for _, s := range steps {
+		p[s.Tool]++
+	}
+	return p
+}
+
+// take reports whether a call of tool was planned and counts it off.
+func (p plannedTools) take(tool string) bool {
+	_, short, _ := strings.Cut(tool, "__")
+	for _, name := range []string{tool, short} {
+		if p[name] > 0 {
+			p[name]--
+			return true
+		}
+	}
+	return false
+}
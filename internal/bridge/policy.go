@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os/user"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// decisions of a tool policy
+const (
+	policyAllow = "allow" // run the tool without asking remote
+	policyDeny  = "deny"  // do not run the tool
+	policyAsk   = "ask"   // ask remote for confirmation
+)
+
+const maxToolHistory = 50 // tool calls passed to the policy as history
+
+type toolEvent struct {
+	Tool     string          `json:"tool"`
+	Args     json.RawMessage `json:"args"`
+	Decision string          `json:"decision"`
+}
+
+type policyInput struct {
+	Tool    string          `json:"tool"`
+	Server  string          `json:"server"`
+	Args    json.RawMessage `json:"args"`
+	User    string          `json:"user"`
+	Risk    string          `json:"risk"`
+	History []toolEvent     `json:"history"`
+}
+
+// regoPolicy evaluates tool calls against a Rego policy with embedded OPA.
+// The policy is a file or a directory of them, or a URL to share it across
+// hosts. Its query is prepared once and again when the policy changes.
+type regoPolicy struct {
+	file     string
+	remote   *sharedFile // if file is a URL
+	query    string
+	user     string
+	risks    map[string]string // tool name pattern to risk class
+	mu       sync.Mutex        // guards the fields below, scheduled jobs evaluate calls as well
+	prepared rego.PreparedEvalQuery
+	stamp    string // of the policy files prepared is of
+	history  []toolEvent
+}
+
+// newRegoPolicy returns the policy at file with query prepared, so a broken
+// local policy stops the bridge instead of every tool call. A shared policy
+// is fetched and prepared on first use.
+func newRegoPolicy(file, query string, risks map[string]string) (*regoPolicy, error) {
+	p := &regoPolicy{file: file, query: query, risks: risks}
+	if u, err := user.Current(); err == nil {
+		p.user = u.Username
+	}
+	if isURL(file) {
+		var err error
+		p.remote, err = newSharedFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if err := p.prepare(context.Background(), file); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// prepare prepares the query against the policy files at file unless it is
+// prepared against them as they are already. The caller holds p.mu.
+func (p *regoPolicy) prepare(ctx context.Context, file string) error {
+	stamp, err := policyStamp(file)
+	if err != nil {
+		return err
+	}
+	if stamp == p.stamp {
+		return nil
+	}
+	prepared, err := rego.New(rego.Query(p.query), rego.Load([]string{file}, nil)).PrepareForEval(ctx)
+	if err != nil {
+		return fmt.Errorf("preparing policy query %s: %w", p.query, err)
+	}
+	p.prepared, p.stamp = prepared, stamp
+	return nil
+}
+
+// policyStamp returns a string that changes when the files at path, a file
+// or a directory, do.
+func policyStamp(path string) (string, error) {
+	var stamp strings.Builder
+	err := filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&stamp, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return stamp.String(), err
+}
+
+// rawArgs returns args as JSON, quoting them if the model produced garbage.
+func rawArgs(args string) json.RawMessage {
+	if json.Valid([]byte(args)) {
+		return json.RawMessage(args)
+	}
+	b, _ := json.Marshal(args)
+	return b
+}
+
+// riskClass returns the class of the first pattern, in sorted order, that
+// matches tool.
+func riskClass(tool string, classes map[string]string) string {
+	for _, pattern := range slices.Sorted(maps.Keys(classes)) {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return classes[pattern]
+		}
+	}
+	return "unknown"
+}
+
+// evaluate returns the policy decision for a tool call. Anything but a
+// valid allow or deny, including an undefined result, means ask.
+func (p *regoPolicy) evaluate(ctx context.Context, tool, args string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	input := policyInput{
+		Tool:    tool,
+		Server:  serverName(tool),
+		Args:    rawArgs(args),
+		User:    p.user,
+		Risk:    riskClass(tool, p.risks),
+		History: p.history,
+	}
+	b, err := json.Marshal(input)
+	if err != nil {
+		return policyAsk, err
+	}
+	parsed, err := ast.ValueFromReader(bytes.NewReader(b))
+	if err != nil {
+		return policyAsk, err
+	}
+	file := p.file
+	if p.remote != nil {
+		file, err = p.remote.local(ctx)
+		if err != nil {
+			return policyAsk, err
+		}
+	}
+	if err := p.prepare(ctx, file); err != nil {
+		return policyAsk, err
+	}
+	result, err := p.prepared.Eval(ctx, rego.EvalParsedInput(parsed))
+	if err != nil {
+		return policyAsk, fmt.Errorf("evaluating policy: %w", err)
+	}
+	if len(result) == 0 || len(result[0].Expressions) == 0 {
+		return policyAsk, nil
+	}
+	switch value := result[0].Expressions[0].Value; value {
+	case policyAllow, policyDeny, policyAsk:
+		return value.(string), nil
+	default:
+		return policyAsk, fmt.Errorf("unexpected policy decision %v", value)
+	}
+}
+
+// remember adds a tool call and its final decision to the history passed to
+// later evaluations.
+func (p *regoPolicy) remember(tool, args, decision string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.history = append(p.history, toolEvent{Tool: tool, Args: rawArgs(args), Decision: decision})
+	if len(p.history) > maxToolHistory {
+		p.history = p.history[len(p.history)-maxToolHistory:]
+	}
+}
@@ -0,0 +1,146 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/cloudwego/eino/schema"
+	"github.com/mark3labs/mcphost/sdk"
+	"github.com/spf13/viper"
+)
+
+// generationParams are the sampling parameters mcphost reads from viper when
+// creating a host.
+type generationParams struct {
+	Temperature float64
+	TopP        float64
+	TopK        int
+}
+
+// named parameter bundles, balanced being the mcphost defaults
+var presets = map[string]generationParams{
+	"precise":  {Temperature: 0.1, TopP: 0.5, TopK: 10},
+	"balanced": {Temperature: 0.7, TopP: 0.95, TopK: 40},
+	"creative": {Temperature: 1.0, TopP: 0.98, TopK: 100},
+}
+
+func currentParams() generationParams {
+	return generationParams{
+		Temperature: viper.GetFloat64("temperature"),
+		TopP:        viper.GetFloat64("top-p"),
+		TopK:        viper.GetInt("top-k"),
+	}
+}
+
+func setParams(p generationParams) {
+	viper.Set("temperature", p.Temperature)
+	viper.Set("top-p", p.TopP)
+	viper.Set("top-k", p.TopK)
+}
+
+// presetKey identifies a host of presetHosts.
+type presetKey struct {
+	agent     string
+	config    string // of the session, empty for the one of agent
+	model     string // of the session, or switched to for agent, empty for the configured one
+	preset    string
+	verbosity string
+}
+
+// presetHost is a host of presetHosts with the system prompt it was created
+// with.
+type presetHost struct {
+	Host
+	system string
+}
+
+// newHostWithPreset creates a host with the parameters of a preset and
+// verbosity, leaving the parameters used for other hosts unchanged. An empty
+// preset keeps the configured parameters.
+func (b *Bridge) newHostWithPreset(ctx context.Context, opts sdk.Options, preset, verbosity string) (*presetHost, error) {
+	p := currentParams()
+	if preset != "" {
+		var ok bool
+		p, ok = presets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q", preset)
+		}
+	}
+	v, ok := verbosities[verbosity]
+	if !ok && verbosity != "" { // empty is normal, like Config.Verbosity
+		return nil, fmt.Errorf("unknown verbosity %q", verbosity)
+	}
+	opts.SystemPrompt = strings.TrimSuffix(opts.SystemPrompt, verbosities[b.conf.Verbosity].note) + v.note
+	saved, savedMaxTokens := currentParams(), viper.GetInt("max-tokens")
+	setParams(p)
+	if v.maxTokens > 0 {
+		viper.Set("max-tokens", v.maxTokens)
+	}
+	defer func() {
+		setParams(saved)
+		viper.Set("max-tokens", savedMaxTokens)
+	}()
+	host, err := b.newHost(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &presetHost{Host: host, system: opts.SystemPrompt}, nil
+}
+
+// runWithPreset calls run with a host of agent, in session, using preset and
+// verbosity, handing the conversation of base over to it and back afterwards.
+// The conversation goes over with the system prompt of the host, and back
+// with the one of base, for the note on verbosity to apply. If that host
+// cannot be created, base is used.
+func (b *Bridge) runWithPreset(ctx context.Context, base Host, agent, session, preset, verbosity string, run func(Host) error) error {
+	key := presetKey{agent: agent, model: b.models[agent], preset: preset, verbosity: verbosity}
+	s, inSession := b.sessions[session]
+	if inSession {
+		key.config, key.model = s.config, s.model
+	}
+	host, ok := b.presetHosts[key]
+	if !ok {
+		opts, err := b.agentOptions(agent)
+		if err == nil && key.config != "" {
+			opts.ConfigFile = s.config
+			opts.SystemPrompt += workdirNote(s.workdir)
+		}
+		if key.model != "" {
+			opts.Model = key.model
+		}
+		if err == nil {
+			host, err = b.newHostWithPreset(ctx, opts, preset, verbosity)
+		}
+		if err != nil {
+			slog.Warn("using default preset and verbosity", "preset", preset, "verbosity", verbosity, "err", err)
+			return run(base)
+		}
+		b.presetHosts[key] = host
+	}
+	messages := base.Messages()
+	var baseSystem *schema.Message // nil lets the SDK add the one of base
+	if len(messages) > 0 && messages[0].Role == schema.System {
+		baseSystem = messages[0]
+	}
+	if host.system != "" {
+		messages = withSystemMessage(messages, schema.SystemMessage(host.system))
+	}
+	err := host.ReplaceMessages(messages)
+	if err != nil {
+		return err
+	}
+	err = run(host.Host)
+	if syncErr := base.ReplaceMessages(withSystemMessage(host.Messages(), baseSystem)); syncErr != nil {
+		slog.Error("handing conversation back", "err", syncErr)
+	}
+	return err
+}
+
+func (b *Bridge) closePresetHosts() {
+	for key, host := range b.presetHosts {
+		host.Close()
+		delete(b.presetHosts, key)
+	}
+}
@@ -0,0 +1,389 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+)
+
+const (
+	msgTypeHello          = "hello"                  // the protocol version and the accepted message types as JSON object to remote, sent first
+	msgTypeVersion        = "version"                // remote replies to hello with its protocol version as JSON object
+	msgTypeReady          = "ready"                  // inform remote that we are ready for a prompt, with the warm-up state if enabled
+	msgTypePrompt         = "prompt"                 // remote is sending a prompt message
+	msgTypeQuit           = "quit"                   // remote is sending a quit message
+	msgTypeGoodbye        = "goodbye"                // the reason the bridge exits as JSON object with reason and message to remote, sent last
+	msgTypePing           = "ping"                   // ask the other side to answer with a pong echoing the ID, sent both ways
+	msgTypePong           = "pong"                   // answer to a ping, sent both ways
+	msgTypeEmbed          = "embed"                  // remote asks for the embedding vector of a text
+	msgTypeEmbedding      = "embedding"              // embedding vector as JSON array to remote, empty on failure
+	msgTypeSummarize      = "summarize-conversation" // remote asks for a summary, content "replace" to also compact the history
+	msgTypeSummary        = "conversation-summary"   // summary of the conversation to remote, empty on failure, with meta.removedTokens if it replaced the history
+	msgTypeChunk          = "chunk"                  // a chunk in a streaming response to remote
+	msgTypeThinking       = "thinking-chunk"         // a chunk of reasoning stripped from the response to remote
+	msgTypeCancelPrompt   = "cancel-prompt"          // remote asks to stop generating the response to the running prompt
+	msgTypePromptCanceled = "prompt-canceled"        // inform remote that the prompt was canceled, content is the bytes of response kept
+	msgTypeDone           = "done"                   // the whole response with its finish reason and statistics as JSON object to remote, last for a prompt, tokens by turn in meta.tokens
+	msgTypeConfirm        = "confirm-tool-run"       // ask remote for permission to run msg.Tool of msg.Server with msg.Args
+	msgTypeAllow          = "allow-tool-run"         // remote gives permission to run tool
+	msgTypeDeny           = "deny-tool-run"          // remote denies permission to run tool, with the reason for the model if any
+	msgTypeConfirmBatch   = "confirm-batch"          // ask remote for permission to run several tool calls as JSON array of objects with tool, server, args and summary
+	msgTypeBatchDecisions = "batch-decisions"        // remote answers a confirm-batch with a JSON array of objects with allow and reason, in the order of the calls
+	msgTypeAllowAlways    = "allow-tool-always"      // remote allows the tool call and, until the bridge exits, identical ones, or those whose arguments match the patterns in msg.Args
+	msgTypeToolDenied     = "tool-denied"            // inform remote that a tool was denied without asking, with meta.pattern if by the tool policy, meta.reason and meta.paths if outside the working directory of the session, meta.reason server-blocked if its server is
+	msgTypeArgsRejected   = "tool-args-rejected"     // inform remote that a call of msg.Tool was not run, content is what is wrong with its arguments
+	msgTypeElicitArgs     = "elicit-args"            // ask remote for the missing arguments of msg.Tool as JSON array, msg.Args being the given ones
+	msgTypeProvideArgs    = "provide-args"           // remote provides the missing arguments in msg.Args, any other reply refuses
+	msgTypeResultOK       = "tool-result-ok"         // inform remote that the tool ran okay, with the content of the result in msg.Items
+	msgTypeResultFailed   = "tool-result-failed"     // inform remote that the tool run failed, with the error in msg.Items, and meta.retryable if retry-tool can run it again
+	msgTypeResultCanceled = "tool-result-canceled"   // inform remote that the tool call was canceled
+	msgTypeResultRetry    = "tool-result-retry"      // inform remote that the bridge runs a failed tool call again
+	msgTypeResultPending  = "tool-result-pending"    // inform remote that the tool runs in the background, with meta.pending identifying it
+	msgTypeResultAsync    = "tool-result-async"      // the result of a tool run in the background to remote, with meta.pending and meta.failed
+	msgTypeUnavailable    = "tool-unavailable"       // inform remote that a tool is disabled after repeated failures
+	msgTypeArtifact       = "artifact"               // inform remote about a file saved from the response
+	msgTypeCodeArtifact   = "code-artifact"          // a code block from the response to remote
+	msgTypeAgent          = "agent"                  // inform remote which agent handles the prompt
+	msgTypePlan           = "plan"                   // intended tool calls as JSON array to remote for approval
+	msgTypeApprovePlan    = "approve-plan"           // remote approves the plan, its tools run without confirmation
+	msgTypeRejectPlan     = "reject-plan"            // remote rejects the plan, the prompt is dropped
+	msgTypeGetHistory     = "get-history"            // remote asks for the conversation, of msg.Agent if set
+	msgTypeHistory        = "history"                // the conversation as JSON array to remote, its tokens by turn in meta.tokens
+	msgTypeEstimateTokens = "estimate-tokens"        // remote asks for the tokens of a text with the model of msg.Agent
+	msgTypeTokenCount     = "token-count"            // tokens of the text as JSON object to remote
+	msgTypeForkSession    = "fork-session"           // remote asks to copy the conversation of msg.Session, or of msg.Agent, into a new session
+	msgTypeSessionForked  = "session-forked"         // ID of the new session to remote, empty on failure
+	msgTypeOpenSession    = "open-session"           // remote asks for a new empty conversation of msg.Agent under the ID in msg.Session
+	msgTypeSessionOpened  = "session-opened"         // ID of the opened session to remote, empty on failure
+	msgTypeCloseSession   = "close-session"          // remote is done with msg.Session, the bridge frees its host
+	msgTypeSessionClosed  = "session-closed"         // inform remote that msg.Session was closed
+	msgTypePin            = "pin"                    // remote asks to send a snippet of text with every prompt
+	msgTypeUnpin          = "unpin"                  // remote asks to drop the pin with the ID in content
+	msgTypeListPins       = "list-pins"              // remote asks for the pins
+	msgTypePins           = "pins"                   // the pins as JSON array to remote, in reply to pin, unpin and list-pins
+	msgTypeListJobResults = "list-job-results"       // remote asks for the results of scheduled jobs, of the job in content if set
+	msgTypeJobResults     = "job-results"            // the job results as JSON array to remote, oldest first
+	msgTypeTemplateResult = "template-result"        // output of the post-processing of a prompt template as JSON object to remote
+	msgTypeSetLogLevel    = "admin-set-log-level"    // remote sets the log level in content, like debug or info
+	msgTypeAdminMetrics   = "admin-metrics"          // remote turns metrics on or off with content, or asks for them if empty
+	msgTypeSelfTest       = "admin-self-test"        // remote asks to check the model and the MCP servers
+	msgTypeRestartServer  = "admin-restart-server"   // remote asks to restart the MCP server named in content
+	msgTypeAdminResult    = "admin-result"           // result of an admin message as JSON object to remote
+	msgTypeSources        = "sources"                // the tool results the response is based on as JSON array to remote
+	msgTypeSessionLocked  = "session-locked"         // inform remote that its prompt waits for the running prompt in msg.Session
+	msgTypeObserve        = "observe"                // remote only watches in multi-client mode, its messages are ignored from now on
+	msgTypeResumeStream   = "resume-stream"          // remote attaching again asks for the messages sent while no frontend was attached
+	msgTypeChunksDropped  = "chunks-dropped"         // inform remote that the number of chunks in content were dropped as it read too slowly
+	msgTypeModelSwitched  = "model-switched"         // inform remote that prompts go to another model of the provider group, or the one of switch-model, as JSON object
+	msgTypeError          = "error"                  // a failure the bridge recovered from as JSON object with code and message to remote
+	msgTypePullModel      = "pull-model"             // remote asks to pull the Ollama model in content, the configured one if empty
+	msgTypePullProgress   = "pull-progress"          // progress of pulling a model as JSON object to remote, with status success at the end
+	msgTypeDeleteModel    = "delete-model"           // remote asks to delete the Ollama model in content
+	msgTypeModelDeleted   = "model-deleted"          // inform remote that the model in content was deleted
+	msgTypeListModels     = "list-models"            // remote asks for the pulled Ollama models and the GPUs
+	msgTypeModels         = "models"                 // the Ollama models with their size and whether they fit into the GPUs as JSON object to remote
+	msgTypeWarning        = "warning"                // a likely problem, like a model too large for the GPUs, as JSON object with code and message to remote, meta.context with code context-usage, meta.latency with first-token-slo
+	msgTypeRetryTool      = "retry-tool"             // remote asks to run msg.Tool with msg.Args again and let the model go on with the result
+	msgTypeExport         = "export"                 // remote asks for the conversation in chunks, of msg.Agent if set, content is a resume token to continue an export
+	msgTypeExportChunk    = "export-chunk"           // a piece of the conversation as JSON array to remote, with meta.export telling the offset, size and resume token
+	msgTypeClearContext   = "clear-context"          // remote asks to start the conversation of msg.Session, or of msg.Agent, anew
+	msgTypeContextCleared = "context-cleared"        // inform remote that the conversation was cleared, with meta.removedTokens
+	msgTypeResumeSession  = "resume-session"         // remote asks to go on with the saved conversation, the bridge replies with history
+	msgTypeSetVerbosity   = "set-verbosity"          // remote asks to answer in msg.Session, or the main conversation, terse, normal or detailed as in content
+	msgTypeVerbositySet   = "verbosity-set"          // inform remote of the verbosity in effect for msg.Session
+
+	// resources of the MCP servers
+	msgTypeListTemplates = "list-resource-templates" // remote asks for the resource templates
+	msgTypeTemplates     = "resource-templates"      // the resource templates as JSON array to remote
+	msgTypeComplete      = "complete"                // remote asks for completions of a resource template argument, a JSON object
+	msgTypeCompletion    = "completion"              // the completion values as JSON object to remote, empty on failure
+	msgTypeReadResource  = "read-resource"           // remote asks for the resource of a JSON object with server and uri
+	msgTypeResource      = "resource"                // the resource contents as JSON array to remote, empty on failure
+
+	// state of the MCP servers
+	msgTypeGetServerStatus = "get-server-status" // remote asks for the confinement of the MCP servers
+	msgTypeServerStatus    = "server-status"     // the MCP servers with their confinement as JSON array to remote
+
+	// managing the context window
+	msgTypeContextCompacted = "context-compacted" // the summary that replaced older turns of msg.Session to remote, with meta.compaction telling the turns and tokens
+
+	// transcripts to download
+	msgTypeExportTranscript = "export-transcript" // remote asks for the conversation of msg.Session, or of msg.Agent, as markdown or json as in content
+	msgTypeTranscript       = "transcript"        // the whole conversation rendered to remote, with meta.file telling format, MIME type and a file name
+
+	// checkpoints to roll back to
+	msgTypeCheckpoint      = "checkpoint"             // remote asks to save the conversation of msg.Session, or of msg.Agent, with its approvals under the name in content
+	msgTypeCheckpointSaved = "checkpoint-saved"       // to remote once saved, with meta.checkpoint
+	msgTypeRollback        = "rollback-to-checkpoint" // remote asks to restore the conversation to the checkpoint named in content
+	msgTypeRolledBack      = "rolled-back"            // to remote once restored, with meta.checkpoint telling the messages removed
+
+	// changing the persona
+	msgTypeSetSystemPrompt = "set-system-prompt" // remote asks to make content the system prompt of msg.Session, or of msg.Agent, empty for the configured one
+	msgTypeSystemPromptSet = "system-prompt-set" // to remote once set, with the system prompt in content
+
+	// explaining tool decisions
+	msgTypeGetPolicy = "get-policy" // remote asks for the effective policy of the tools, in msg.Session, of the tool patterns in content or all
+	msgTypePolicy    = "policy"     // the decision and its source for each tool as JSON array to remote
+
+	// changing the model
+	msgTypeSwitchModel = "switch-model" // remote asks to go on with the conversation of msg.Session, or of msg.Agent, on the model in content, answered with model-switched
+)
+
+type Message struct {
+	ID       string `json:"id,omitempty"` // of a message awaiting a reply, echoed by the reply
+	MsgType  string `json:"msg_type"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty"` // set if Content is compressed
+	Scope    string `json:"scope,omitempty"`    // how long an allow or deny reply applies
+	Duration string `json:"duration,omitempty"` // for scope duration, e.g. "10m"
+	Tool     string `json:"tool,omitempty"`     // tool to confirm, or "*" to apply a scoped reply to all tools
+	Agent    string `json:"agent,omitempty"`    // agent profile to handle a prompt
+	Preset   string `json:"preset,omitempty"`   // generation preset for a prompt
+	Session  string `json:"session,omitempty"`  // forked or opened session a message applies to, the main conversation if empty
+	Template string `json:"template,omitempty"` // prompt template expanding the content of a prompt
+	Workdir  string `json:"workdir,omitempty"`  // in fork-session, the directory the tools of the session are scoped to
+
+	Items  []resultItem    `json:"items,omitempty"`  // content of the result in tool-result-ok and tool-result-failed
+	Server string          `json:"server,omitempty"` // MCP server of the tool to confirm
+	Args   json.RawMessage `json:"args,omitempty"`   // arguments of the tool to confirm, or to run it with in allow-tool-run
+
+	// Attachments are files sent with a prompt, see attachPrompt.
+	Attachments []attachment `json:"attachments,omitempty"`
+
+	// Env is how a tool ran, in tool-result-ok and tool-result-failed if
+	// Config.ToolEnvironment is set.
+	Env *toolEnvironment `json:"env,omitempty"`
+
+	// Meta is data added to a message beyond its type, like the MCP server
+	// of a tool result. Parsers ignore the keys they do not know, so new
+	// ones need no new message type or field. Typed fields take precedence.
+	Meta map[string]any `json:"meta,omitempty"`
+}
+
+// withMeta returns m with value set for key in its meta data.
+func (m Message) withMeta(key string, value any) Message {
+	meta := make(map[string]any, len(m.Meta)+1)
+	maps.Copy(meta, m.Meta)
+	meta[key] = value
+	m.Meta = meta
+	return m
+}
+
+func (m Message) String() string {
+	s := "MsgType: " + m.MsgType
+	if m.Content != "" {
+		s += ", Content: " + m.Content
+	}
+	return s
+}
+
+// inputLine is a line from remote, or the error that ended the input.
+type inputLine struct {
+	line []byte
+	err  error
+}
+
+// ErrConnectionLost is returned by Run if remote went away without quitting.
+var ErrConnectionLost = errors.New("connection to remote lost")
+
+// readLines sends the lines of scanner to lines until the input ends or done
+// is closed, so waits for remote can be canceled. Lines intercept handles are
+// not sent. At the end of the input it calls ended, so work for remote stops
+// at once.
+func readLines(scanner *bufio.Scanner, lines chan<- inputLine, done <-chan struct{}, intercept func([]byte) bool, ended func()) {
+	defer close(lines)
+	defer ended()
+	for scanner.Scan() {
+		line := inputLine{line: bytes.Clone(scanner.Bytes())}
+		if intercept(line.line) {
+			continue
+		}
+		select {
+		case lines <- line:
+		case <-done:
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		select {
+		case lines <- inputLine{err: err}:
+		case <-done:
+		}
+	}
+}
+
+// defaultMaxMessage is the size limit of messages from remote, see
+// Config.MaxMessageSize.
+const defaultMaxMessage = 32 << 20
+
+// lineSplitter splits like bufio.ScanLines, but skips lines over max bytes
+// instead of failing, as the scanner cannot go on after an error.
+type lineSplitter struct {
+	max      int
+	skipped  int // bytes of the line being skipped
+	tooLarge func(size int)
+}
+
+func (s *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	i := bytes.IndexByte(data, '\n')
+	switch {
+	case s.skipped > 0 && (i >= 0 || atEOF):
+		if i < 0 {
+			i = len(data)
+		}
+		size := s.skipped + i
+		s.skipped = 0
+		s.tooLarge(size)
+		return min(i+1, len(data)), nil, nil
+	case s.skipped > 0:
+		s.skipped += len(data)
+		return len(data), nil, nil
+	case i < 0 && len(data) >= s.max:
+		s.skipped = len(data)
+		return len(data), nil, nil
+	}
+	return bufio.ScanLines(data, atEOF)
+}
+
+// intercept handles line at once if it is a message that must not wait
+// until the bridge reads from remote again, like cancel-prompt while the
+// model generates, and reports whether it was.
+func (b *Bridge) intercept(line []byte) bool {
+	b.heartbeat.seen()
+	if !bytes.Contains(line, []byte(msgTypeCancelPrompt)) && !bytes.Contains(line, []byte(msgTypePing)) &&
+		!bytes.Contains(line, []byte(msgTypePong)) {
+		return false
+	}
+	var msg Message
+	if json.Unmarshal(line, &msg) != nil {
+		return false
+	}
+	switch msg.MsgType {
+	case msgTypeCancelPrompt:
+		b.cancelPrompt()
+	case msgTypePing:
+		if err := b.send(Message{ID: msg.ID, MsgType: msgTypePong}); err != nil {
+			slog.Error("sending message", "err", err)
+		}
+	case msgTypePong:
+	default:
+		return false
+	}
+	return true
+}
+
+// recvContext receives the next message from remote, or returns the error of
+// ctx if it is canceled first.
+func (b *Bridge) recvContext(ctx context.Context) (Message, error) {
+	return b.recvOrWake(ctx, nil)
+}
+
+// recvOrWake is recvContext returning errWoken if wake fires before remote
+// sends a message.
+func (b *Bridge) recvOrWake(ctx context.Context, wake <-chan struct{}) (Message, error) {
+	for {
+		msg := Message{}
+		var in inputLine
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return msg, ctx.Err()
+		case <-wake:
+			return msg, errWoken
+		case in, ok = <-b.in:
+		}
+		if !ok {
+			return msg, ErrConnectionLost
+		}
+		if in.err != nil {
+			return msg, in.err
+		}
+		line := bytes.TrimSpace(in.line) // also drops the \r of Windows line endings
+		if len(line) == 0 {
+			continue
+		}
+		err := json.Unmarshal(line, &msg)
+		if err != nil {
+			return msg, err
+		}
+		msg, err = decompressContent(msg)
+		if err != nil {
+			return msg, err
+		}
+		prompt := msg.MsgType == msgTypePrompt
+		msg, keep, err := b.applyInbound(msg)
+		if err != nil {
+			return msg, err
+		}
+		if keep {
+			slog.Debug("received from stdin", "Message", msg)
+			return msg, nil
+		}
+		slog.Debug("inbound message dropped by middleware")
+		if prompt {
+			b.clients.release() // it was the prompt let in
+		}
+	}
+}
+
+// setRequest sets the ID of the message from remote being handled.
+func (b *Bridge) setRequest(id string) {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	b.request = id
+}
+
+// recvReply receives the reply to the message with id. Replies with another
+// ID are dropped, as are those without if remote knows IDs.
+func (b *Bridge) recvReply(ctx context.Context, id string) (Message, error) {
+	for {
+		msg, err := b.recvContext(ctx)
+		if err != nil || msg.ID == id || msg.ID == "" && b.remote.Protocol < 2 {
+			return msg, err
+		}
+		slog.Warn("dropping reply to another message", "MsgType", msg.MsgType, "id", msg.ID, "want", id)
+	}
+}
+
+// send writes a message to remote, unless the middlewares drop it. A message
+// without ID gets the one of the request being handled.
+func (b *Bridge) send(msg Message) error {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	if msg.ID == "" {
+		msg.ID = b.request
+	}
+	msg, keep, err := b.applyOutbound(msg)
+	if err != nil {
+		return err
+	}
+	if !keep {
+		slog.Debug("outbound message dropped by middleware", "Message", msg)
+		return nil
+	}
+	slog.Debug("sending to stdout", "Message", msg)
+	if b.encoding != "" {
+		msg, err = compressContent(msg, b.conf.CompressMinSize)
+		if err != nil {
+			return err
+		}
+	}
+	if b.queue != nil {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return b.queue.push(append(line, '\n'), msg.MsgType == msgTypeChunk || msg.MsgType == msgTypeThinking)
+	}
+	err = json.NewEncoder(b.out).Encode(msg) // appends a newline
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+		b.disconnect(err)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	overflowBlock      = "block"       // wait for room in the queue
+	overflowDropChunks = "drop-chunks" // drop the oldest chunks, leaving a chunks-dropped marker
+)
+
+// outQueue decouples sending messages from writing them to remote, so a slow
+// reader does not stall the callbacks of the SDK. It holds up to size lines,
+// what happens when it is full depends on the overflow policy.
+type outQueue struct {
+	out        io.Writer
+	size       int
+	dropChunks bool
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	lines   []queuedLine
+	err     error // of the last write, returned from then on
+	closed  bool
+	done    chan struct{} // closed when the writer stopped
+}
+
+// queuedLine is a message encoded for remote. Markers stand in for dropped
+// chunks and are encoded when written.
+type queuedLine struct {
+	line    []byte
+	chunk   bool
+	dropped int // chunks dropped in place of a marker
+}
+
+func newOutQueue(out io.Writer, size int, overflow string) *outQueue {
+	q := &outQueue{out: out, size: size, dropChunks: overflow == overflowDropChunks, done: make(chan struct{})}
+	q.changed = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues a line, waiting for room as the overflow policy says, and
+// returns the error of the last write if it failed.
+func (q *outQueue) push(line []byte, chunk bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.err == nil && len(q.lines) >= q.size {
+		if q.dropChunks && q.dropChunk() {
+			continue
+		}
+		q.changed.Wait()
+	}
+	if q.err != nil {
+		return q.err
+	}
+	q.lines = append(q.lines, queuedLine{line: line, chunk: chunk})
+	q.changed.Broadcast()
+	return nil
+}
+
+// dropChunk replaces the oldest queued chunk with a marker, or adds it to the
+// marker before it. It reports false if there is no chunk to drop.
+func (q *outQueue) dropChunk() bool {
+	for i, l := range q.lines {
+		if !l.chunk {
+			continue
+		}
+		if i > 0 && q.lines[i-1].dropped > 0 {
+			q.lines[i-1].dropped++
+			q.lines = append(q.lines[:i], q.lines[i+1:]...)
+		} else {
+			q.lines[i] = queuedLine{dropped: 1}
+		}
+		return true
+	}
+	return false
+}
+
+// run writes the queued lines until the queue is closed and empty. If a
+// write fails it calls failed and stops.
+func (q *outQueue) run(failed func(error)) {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		for len(q.lines) == 0 && !q.closed {
+			q.changed.Wait()
+		}
+		if len(q.lines) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		l := q.lines[0]
+		q.lines = q.lines[1:]
+		q.changed.Broadcast()
+		q.mu.Unlock()
+
+		line := l.line
+		if l.dropped > 0 {
+			line, _ = json.Marshal(Message{MsgType: msgTypeChunksDropped, Content: strconv.Itoa(l.dropped)})
+			line = append(line, '\n')
+		}
+		if _, err := q.out.Write(line); err != nil {
+			err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+			q.mu.Lock()
+			q.err = err
+			q.lines = nil
+			q.changed.Broadcast()
+			q.mu.Unlock()
+			failed(err)
+			return
+		}
+	}
+}
+
+// close writes the lines still queued and waits for the writer to stop.
+func (q *outQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.changed.Broadcast()
+	q.mu.Unlock()
+	<-q.done
+}
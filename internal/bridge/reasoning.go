@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+var defaultReasoningTags = []string{"think", "thinking", "reasoning"}
+
+type reasoningConfig struct {
+	Tags    []string `json:"tags"`    // tag names without brackets, defaults to defaultReasoningTags
+	Forward bool     `json:"forward"` // send the stripped text as thinking-chunk messages
+}
+
+// reasoningConfigFor returns the configuration of the first pattern, in sorted
+// order, that matches model.
+func reasoningConfigFor(model string, configs map[string]reasoningConfig) (reasoningConfig, bool) {
+	for _, pattern := range slices.Sorted(maps.Keys(configs)) {
+		if ok, _ := path.Match(pattern, model); ok {
+			return configs[pattern], true
+		}
+	}
+	return reasoningConfig{}, false
+}
+
+// reasoningFilter removes reasoning spans like <think>…</think> from a
+// streamed response. Tags may be split across chunks, so text that could be
+// the start of a tag is held back until the next chunk.
+type reasoningFilter struct {
+	tags    []string
+	closing string // closing tag of the span we are in, empty outside
+	pending string
+}
+
+func newReasoningFilter(conf reasoningConfig) *reasoningFilter {
+	tags := conf.Tags
+	if len(tags) == 0 {
+		tags = defaultReasoningTags
+	}
+	return &reasoningFilter{tags: tags}
+}
+
+// write filters chunk, calling emit for the visible text and the reasoning
+// text in order of appearance.
+func (f *reasoningFilter) write(chunk string, emit func(text string, reasoning bool)) {
+	s := f.pending + chunk
+	f.pending = ""
+	for s != "" {
+		if f.closing != "" {
+			i := strings.Index(s, f.closing)
+			if i < 0 {
+				keep := partialTagLen(s, []string{f.closing})
+				emitNonEmpty(emit, s[:len(s)-keep], true)
+				f.pending = s[len(s)-keep:]
+				return
+			}
+			emitNonEmpty(emit, s[:i], true)
+			s = s[i+len(f.closing):]
+			f.closing = ""
+			continue
+		}
+		i, tag := f.openingTag(s)
+		if i < 0 {
+			keep := partialTagLen(s, f.openingTags())
+			emitNonEmpty(emit, s[:len(s)-keep], false)
+			f.pending = s[len(s)-keep:]
+			return
+		}
+		emitNonEmpty(emit, s[:i], false)
+		s = s[i+len("<"+tag+">"):]
+		f.closing = "</" + tag + ">"
+	}
+}
+
+// flush emits held back text at the end of the response.
+func (f *reasoningFilter) flush(emit func(text string, reasoning bool)) {
+	emitNonEmpty(emit, f.pending, f.closing != "")
+	f.pending = ""
+	f.closing = ""
+}
+
+func (f *reasoningFilter) openingTags() []string {
+	tags := make([]string, len(f.tags))
+	for i, tag := range f.tags {
+		tags[i] = "<" + tag + ">"
+	}
+	return tags
+}
+
+// openingTag returns the position and name of the first opening tag in s.
+func (f *reasoningFilter) openingTag(s string) (int, string) {
+	first, name := -1, ""
+	for _, tag := range f.tags {
+		i := strings.Index(s, "<"+tag+">")
+		if i >= 0 && (first < 0 || i < first) {
+			first, name = i, tag
+		}
+	}
+	return first, name
+}
+
+// partialTagLen returns the length of the longest suffix of s that is a
+// proper prefix of one of tags.
+func partialTagLen(s string, tags []string) int {
+	n := 0
+	for _, tag := range tags {
+		for l := min(len(tag)-1, len(s)); l > n; l-- {
+			if strings.HasSuffix(s, tag[:l]) {
+				n = l
+				break
+			}
+		}
+	}
+	return n
+}
+
+func emitNonEmpty(emit func(string, bool), text string, reasoning bool) {
+	if text != "" {
+		emit(text, reasoning)
+	}
+}
+
+// stripReasoning removes the reasoning spans from a complete response.
+func stripReasoning(response string, conf reasoningConfig) string {
+	var b strings.Builder
+	f := newReasoningFilter(conf)
+	visible := func(text string, reasoning bool) {
+		if !reasoning {
+			b.WriteString(text)
+		}
+	}
+	f.write(response, visible)
+	f.flush(visible)
+	return strings.TrimSpace(b.String())
+}
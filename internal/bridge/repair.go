@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+const repairerPrompt = "You fix the arguments of tool calls so they match the input schema of the tool. " +
+	"Answer with the corrected arguments as a single JSON object and nothing else."
+
+// validateCall validates the arguments of a call of tool, named name. If they
+// are invalid and there is a repair model, it is asked to correct them. It
+// returns the arguments, repaired if needed, and what is wrong with them
+// beyond repair.
+func (b *Bridge) validateCall(ctx context.Context, tool mcp.Tool, name, args string) (string, []string) {
+	repaired, errs := validateToolArgs(tool, args)
+	if len(errs) == 0 || b.conf.RepairModel == "" {
+		return repaired, errs
+	}
+	fixed, err := b.repairToolArgs(ctx, tool, name, args, errs)
+	if err != nil {
+		slog.Warn("repairing tool arguments", "tool", name, "err", err)
+		return repaired, errs
+	}
+	fixed, fixedErrs := validateToolArgs(tool, fixed)
+	if len(fixedErrs) > 0 {
+		slog.Info("repair model did not fix the arguments", "tool", name, "errors", fixedErrs)
+		return repaired, errs
+	}
+	slog.Info("repair model fixed the arguments", "tool", name)
+	return fixed, nil
+}
+
+// repairToolArgs asks the repair model for the arguments of a call of tool
+// corrected for errs. Its exchange is not kept.
+func (b *Bridge) repairToolArgs(ctx context.Context, tool mcp.Tool, name, args string, errs []string) (string, error) {
+	repairer, err := b.helperHost(ctx, b.conf.RepairModel, repairerPrompt)
+	if err != nil {
+		return "", err
+	}
+	defer repairer.ClearSession()
+	schema, err := json.Marshal(toolSchema(tool))
+	if err != nil {
+		return "", err
+	}
+	var request strings.Builder
+	fmt.Fprintf(&request, "Tool: %s\n", name)
+	if tool.Description != "" {
+		fmt.Fprintf(&request, "Description: %s\n", tool.Description)
+	}
+	fmt.Fprintf(&request, "Input schema: %s\nArguments: %s\nErrors:\n", schema, args)
+	for _, e := range errs {
+		fmt.Fprintf(&request, "- %s\n", e)
+	}
+	answer, err := repairer.Prompt(ctx, request.String())
+	if err != nil {
+		return "", err
+	}
+	// small models wrap the object in code fences or sentences anyway
+	start, end := strings.Index(answer, "{"), strings.LastIndex(answer, "}")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("answer is no JSON object: %q", answer)
+	}
+	return answer[start : end+1], nil
+}
@@ -0,0 +1,154 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+const maxCompletions = 100 // like MCP allows in a completion result
+
+// resourceTemplate is a templated resource of an MCP server as sent to
+// remote.
+type resourceTemplate struct {
+	Server      string `json:"server"`
+	URITemplate string `json:"uriTemplate"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MIMEType    string `json:"mimeType,omitempty"`
+}
+
+// completionQuery asks for values of an argument of a resource template.
+type completionQuery struct {
+	Server      string `json:"server"`
+	URITemplate string `json:"uriTemplate"`
+	Argument    string `json:"argument"`
+	Value       string `json:"value"` // typed so far
+}
+
+type completion struct {
+	Values      []string `json:"values"`
+	Total       int      `json:"total,omitempty"`
+	HasMore     bool     `json:"hasMore,omitempty"`
+	FromHistory bool     `json:"fromHistory,omitempty"` // the server does not complete, values are from earlier tool calls
+}
+
+// resourceQuery asks for a resource of an MCP server.
+type resourceQuery struct {
+	Server string `json:"server"`
+	URI    string `json:"uri"`
+}
+
+func (b *Bridge) resourceTemplates(ctx context.Context) []resourceTemplate {
+	tools := b.getToolbox(ctx, b.options.ConfigFile)
+	templates := []resourceTemplate{}
+	for _, server := range slices.Sorted(maps.Keys(tools.clients)) {
+		c := tools.clients[server]
+		if c.GetServerCapabilities().Resources == nil {
+			continue
+		}
+		list, err := c.ListResourceTemplates(ctx, mcp.ListResourceTemplatesRequest{})
+		if err != nil {
+			slog.Warn("listing resource templates", "server", server, "err", err)
+			continue
+		}
+		for _, t := range list.ResourceTemplates {
+			rt := resourceTemplate{Server: server, Name: t.Name, Description: t.Description, MIMEType: t.MIMEType}
+			if t.URITemplate != nil && t.URITemplate.Template != nil {
+				rt.URITemplate = t.URITemplate.Raw()
+			}
+			templates = append(templates, rt)
+		}
+	}
+	return templates
+}
+
+// complete asks the server of q for completions, falling back to the values
+// the argument had in earlier tool calls of the conversation of host.
+func (b *Bridge) complete(ctx context.Context, host Host, q completionQuery) completion {
+	if c, ok := b.getToolbox(ctx, b.options.ConfigFile).clients[q.Server]; ok {
+		req := mcp.CompleteRequest{}
+		req.Params.Ref = mcp.ResourceReference{Type: "ref/resource", URI: q.URITemplate}
+		req.Params.Argument.Name = q.Argument
+		req.Params.Argument.Value = q.Value
+		res, err := c.Complete(ctx, req)
+		if err == nil {
+			return completion{Values: res.Completion.Values, Total: res.Completion.Total, HasMore: res.Completion.HasMore}
+		}
+		slog.Debug("completing from history", "server", q.Server, "err", err)
+	}
+	return completion{Values: usedValues(host, q.Argument, q.Value), FromHistory: true}
+}
+
+// usedValues returns the string values with prefix that argument had in the
+// tool calls of the conversation of host, most recent first.
+func usedValues(host Host, argument, prefix string) []string {
+	values := []string{}
+	messages := host.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		for _, tc := range messages[i].ToolCalls {
+			var args map[string]any
+			if json.Unmarshal([]byte(tc.Function.Arguments), &args) != nil {
+				continue
+			}
+			v, ok := args[argument].(string)
+			if ok && strings.HasPrefix(v, prefix) && !slices.Contains(values, v) && len(values) < maxCompletions {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+func (b *Bridge) readResource(ctx context.Context, q resourceQuery) ([]mcp.ResourceContents, error) {
+	c, ok := b.getToolbox(ctx, b.options.ConfigFile).clients[q.Server]
+	if !ok {
+		return nil, fmt.Errorf("unknown server %q", q.Server)
+	}
+	req := mcp.ReadResourceRequest{}
+	req.Params.URI = q.URI
+	res, err := c.ReadResource(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Contents, nil
+}
+
+// handleResources answers the resource messages of remote. Failures are
+// answered with an empty content.
+func (b *Bridge) handleResources(ctx context.Context, host Host, msg Message) error {
+	var reply any
+	var replyType string
+	var err error
+	switch msg.MsgType {
+	case msgTypeListTemplates:
+		replyType, reply = msgTypeTemplates, b.resourceTemplates(ctx)
+	case msgTypeComplete:
+		replyType = msgTypeCompletion
+		var q completionQuery
+		if err = json.Unmarshal([]byte(msg.Content), &q); err == nil {
+			reply = b.complete(ctx, host, q)
+		}
+	case msgTypeReadResource:
+		replyType = msgTypeResource
+		var q resourceQuery
+		if err = json.Unmarshal([]byte(msg.Content), &q); err == nil {
+			reply, err = b.readResource(ctx, q)
+		}
+	}
+	if err != nil {
+		slog.Warn("answering "+msg.MsgType, "err", err)
+		return b.send(Message{MsgType: replyType})
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: replyType, Content: string(data)})
+}
@@ -0,0 +1,164 @@
+package bridge
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// resultItem is a content item of a tool result. Binary data is not sent
+// but saved to the artifact store, if there is one.
+type resultItem struct {
+	Type     string        `json:"type"` // text, image, audio, resource or resource_link
+	Text     string        `json:"text,omitempty"`
+	MIMEType string        `json:"mimeType,omitempty"`
+	URI      string        `json:"uri,omitempty"`  // of a resource
+	Name     string        `json:"name,omitempty"` // of a resource link
+	Size     int           `json:"size,omitempty"` // bytes of binary data
+	Artifact *artifactInfo `json:"artifact,omitempty"`
+	Omitted  int           `json:"omitted,omitempty"` // bytes cut off the text, see Config.MaxResultText
+}
+
+// parseToolResult returns the content of a tool result the way mcphost
+// passes it on, a CallToolResult as JSON. Other results are taken as text.
+func parseToolResult(result string) []mcp.Content {
+	var res struct {
+		Content []json.RawMessage `json:"content"`
+	}
+	text := []mcp.Content{mcp.NewTextContent(result)}
+	if err := json.Unmarshal([]byte(result), &res); err != nil || len(res.Content) == 0 {
+		return text
+	}
+	var contents []mcp.Content
+	for _, raw := range res.Content {
+		// mcp.UnmarshalContent cannot fill in the interface of embedded resources
+		var embedded struct {
+			Type     string         `json:"type"`
+			Resource map[string]any `json:"resource"`
+		}
+		if err := json.Unmarshal(raw, &embedded); err == nil && embedded.Type == mcp.ContentTypeResource {
+			resource, err := mcp.ParseResourceContents(embedded.Resource)
+			if err != nil {
+				return text
+			}
+			contents = append(contents, mcp.EmbeddedResource{Type: embedded.Type, Resource: resource})
+			continue
+		}
+		c, err := mcp.UnmarshalContent(raw)
+		if err != nil {
+			return text
+		}
+		contents = append(contents, c)
+	}
+	return contents
+}
+
+// resultItems converts the content of a tool result, saving binary data.
+func (b *Bridge) resultItems(contents []mcp.Content) []resultItem {
+	items := make([]resultItem, 0, len(contents))
+	for _, c := range contents {
+		var item resultItem
+		switch c := c.(type) {
+		case mcp.TextContent:
+			item = resultItem{Type: mcp.ContentTypeText, Text: c.Text}
+		case mcp.ImageContent:
+			item = b.binaryItem(mcp.ContentTypeImage, c.MIMEType, "", c.Data)
+		case mcp.AudioContent:
+			item = b.binaryItem(mcp.ContentTypeAudio, c.MIMEType, "", c.Data)
+		case mcp.ResourceLink:
+			item = resultItem{Type: mcp.ContentTypeLink, URI: c.URI, Name: c.Name, MIMEType: c.MIMEType, Text: c.Description}
+		case mcp.EmbeddedResource:
+			switch r := c.Resource.(type) {
+			case mcp.TextResourceContents:
+				item = resultItem{Type: mcp.ContentTypeResource, URI: r.URI, MIMEType: r.MIMEType, Text: r.Text}
+			case mcp.BlobResourceContents:
+				item = b.binaryItem(mcp.ContentTypeResource, r.MIMEType, r.URI, r.Blob)
+			}
+		default:
+			slog.Debug("skipping unknown content of tool result", "content", c)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (b *Bridge) binaryItem(kind, mimeType, uri, data string) resultItem {
+	item := resultItem{Type: kind, MIMEType: mimeType, URI: uri}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		slog.Warn("decoding binary content of tool result", "err", err)
+		return item
+	}
+	item.Size = len(decoded)
+	if b.artifacts == nil {
+		return item
+	}
+	ext := ""
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		ext = exts[0]
+	}
+	info, err := b.artifacts.save("", ext, string(decoded))
+	if err != nil {
+		slog.Warn("saving binary content of tool result", "err", err)
+		return item
+	}
+	item.Artifact = &info
+	return item
+}
+
+// sentItems returns the items as sent to remote, with their text cut to
+// Config.MaxResultText.
+func (b *Bridge) sentItems(items []resultItem) []resultItem {
+	limit := b.conf.MaxResultText
+	if limit <= 0 {
+		return items
+	}
+	sent := slices.Clone(items)
+	for i, item := range sent {
+		if len(item.Text) <= limit {
+			continue
+		}
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(item.Text[cut]) {
+			cut--
+		}
+		sent[i].Text, sent[i].Omitted = item.Text[:cut], len(item.Text)-cut
+	}
+	return sent
+}
+
+// itemsText returns the items as text for a model, noting binary items.
+func itemsText(items []resultItem) string {
+	var parts []string
+	for _, item := range items {
+		switch {
+		case item.Size > 0 && item.Artifact != nil:
+			parts = append(parts, fmt.Sprintf("[%s %s saved as %s]", item.MIMEType, item.Type, item.Artifact.Path))
+		case item.Size > 0:
+			parts = append(parts, fmt.Sprintf("[%s %s of %d bytes]", item.MIMEType, item.Type, item.Size))
+		case item.Type == mcp.ContentTypeLink:
+			parts = append(parts, fmt.Sprintf("[resource %s %s]", item.Name, item.URI))
+		default:
+			parts = append(parts, item.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// resultMessage returns the message of a result of tool, with the MCP server
+// of the tool in its meta data.
+func resultMessage(msgType, tool string, items []resultItem, ran *toolEnvironment) Message {
+	msg := Message{MsgType: msgType, Content: tool, Items: items, Env: ran}
+	if server, _, ok := strings.Cut(tool, "__"); ok {
+		msg = msg.withMeta("server", server)
+	}
+	return msg
+}
@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// retryPolicy says how often the bridge runs failed calls of a tool again.
+// Calls of tools with a policy run through the bridge instead of the SDK, so
+// the model only gets the failure of the last attempt.
+type retryPolicy struct {
+	Count   int      `json:"count"`   // retries after the first failure
+	Backoff string   `json:"backoff"` // delay before the first retry, doubled for each further one
+	RetryOn []string `json:"retryOn"` // regular expressions matched against the error, any error if empty
+}
+
+// retryPolicyFor returns the policy of the first pattern, in sorted order,
+// that matches tool.
+func retryPolicyFor(tool string, policies map[string]retryPolicy) (retryPolicy, bool) {
+	for _, pattern := range slices.Sorted(maps.Keys(policies)) {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return policies[pattern], true
+		}
+	}
+	return retryPolicy{}, false
+}
+
+func (p retryPolicy) matches(result string) bool {
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	for _, expr := range p.RetryOn {
+		if ok, _ := regexp.MatchString(expr, result); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d, err := time.ParseDuration(p.Backoff)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return d << (attempt - 1)
+}
+
+// callWithRetries calls a tool of the toolbox, calling it again after the
+// backoff delay while it fails as its retry policy says, and tells remote of
+// each retry. The failure of the last attempt is returned.
+func (b *Bridge) callWithRetries(ctx context.Context, call textToolCall) ([]mcp.Content, bool, error) {
+	p, retries := retryPolicyFor(call.Name, b.bridgeConf.Retries)
+	tools := b.promptToolbox(ctx)
+	for attempt := 1; ; attempt++ {
+		contents, isError, err := tools.call(ctx, call.Name, call.Args)
+		if !retries || !isError && err == nil || attempt > p.Count || !p.matches(failureText(contents, err)) {
+			return contents, isError, err
+		}
+		slog.Info("retrying tool call", "tool", call.Name, "attempt", attempt)
+		if err := b.send(Message{MsgType: msgTypeResultRetry, Content: call.Name}.withMeta("attempt", attempt)); err != nil {
+			slog.Error("sending message", "err", err)
+		}
+		select {
+		case <-time.After(p.delay(attempt)):
+		case <-ctx.Done():
+			return contents, isError, err
+		}
+	}
+}
+
+// failureText returns the error of a failed call for matching retryOn.
+func failureText(contents []mcp.Content, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	var parts []string
+	for _, c := range contents {
+		if text, ok := c.(mcp.TextContent); ok {
+			parts = append(parts, text.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// retryable reports whether the bridge can run tool again for retry-tool,
+// which it can unless its server runs inside mcphost.
+func (b *Bridge) retryable(tool string) bool {
+	server, _, found := strings.Cut(tool, "__")
+	if !found {
+		return false
+	}
+	servers, err := loadMCPServers(b.options.ConfigFile)
+	if err != nil {
+		return false
+	}
+	s, ok := servers[server]
+	if !ok {
+		return false
+	}
+	kind := s.Type
+	if s.Transport != "" {
+		kind = s.Transport
+	}
+	return kind != "builtin" && kind != "inprocess"
+}
+
+// failedResult returns a tool-result-failed message of tool, marked with
+// meta.retryable if remote may run it again with retry-tool.
+func (b *Bridge) failedResult(tool string, items []resultItem, ran *toolEnvironment) Message {
+	msg := resultMessage(msgTypeResultFailed, tool, items, ran)
+	if b.retryable(tool) {
+		msg = msg.withMeta("retryable", true)
+	}
+	return msg
+}
+
+// handleRetryTool runs a call of msg.Tool with msg.Args again, typically one
+// that failed, possibly with edited arguments. The call goes through the same
+// checks as the first time, and the model goes on with the new result like
+// after a prompt.
+func (b *Bridge) handleRetryTool(ctx context.Context, host Host, msg Message) error {
+	b.workdir = b.sessionWorkdir(msg.Session)
+	b.approvals = b.sessionDecisions(msg.Session)
+	b.session = msg.Session
+	name, ok := b.promptToolbox(ctx).resolve(msg.Tool)
+	if !ok {
+		return b.sendError(bridgeError{Code: errorRetryFailed, Message: "tool " + msg.Tool + " cannot be run by the bridge"})
+	}
+	args := string(msg.Args)
+	if strings.TrimSpace(args) == "" {
+		args = "{}"
+	}
+	note, ok := b.runTextToolCall(ctx, textToolCall{Name: name, Args: args}, nil)
+	if !ok {
+		slog.Info("retry of tool refused", "tool", name)
+		return nil
+	}
+	return b.handlePromptMessage(ctx, host, Message{
+		MsgType: msgTypePrompt,
+		Content: "The user ran the tool call again. " + note + "\n\nContinue with the request.",
+		Agent:   msg.Agent,
+		Session: msg.Session,
+	})
+}
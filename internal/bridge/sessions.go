@@ -0,0 +1,210 @@
+package bridge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// session is a conversation forked from another, or opened by remote, with a
+// host of its own.
+type session struct {
+	host    Host
+	agent   string
+	workdir string   // tools are confined to, empty for none
+	config  string   // temporary mcphost configuration scoped to workdir
+	tools   *toolbox // connected to the servers of config on first use by Bridge.promptToolbox
+
+	attachments map[string]attachment // sent with prompts, keyed by ID
+	verbosity   string                // empty for the one of the main conversation
+	model       string                // of host
+	decisions   *decisionCache        // approvals with scope session apply to the session only
+	spent       int                   // tokens sent to and received from the model, see Bridge.spend
+}
+
+// newID returns a random ID for sessions, pins and messages.
+func newID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// forkSession copies the conversation of from into a new session and returns
+// its ID. An empty from forks the conversation of agent. The tools of the
+// session are scoped to workdir, which a fork of a session inherits unless
+// given. It starts with the approvals of from, but keeps its own.
+func (b *Bridge) forkSession(ctx context.Context, host Host, from, agent, workdir string) (string, error) {
+	if from != "" {
+		s, ok := b.sessions[from]
+		if !ok {
+			return "", fmt.Errorf("unknown session %q", from)
+		}
+		host, agent = s.host, s.agent
+		if workdir == "" {
+			workdir = s.workdir
+		}
+	} else if agent != "" && agent != defaultAgent {
+		h, ok := b.agentHosts[agent]
+		if !ok {
+			return "", fmt.Errorf("agent %q has no conversation", agent)
+		}
+		host = h
+	} else {
+		agent = defaultAgent
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	err = b.openSession(ctx, id, agent, workdir, host.Messages(), maps.Clone(b.attachmentStore(from)), b.sessionDecisions(from).clone())
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// openSession adds a session of agent with a host of its own under id,
+// going on with messages, attachments and decisions. Its tools are scoped to
+// workdir unless empty.
+func (b *Bridge) openSession(ctx context.Context, id, agent, workdir string, messages []*schema.Message, attachments map[string]attachment, decisions *decisionCache) error {
+	opts, err := b.agentOptions(agent)
+	if err != nil {
+		return err
+	}
+	s := &session{agent: agent, model: opts.Model, attachments: attachments, decisions: decisions}
+	if workdir != "" {
+		s.workdir, err = checkWorkdir(workdir)
+		if err != nil {
+			return err
+		}
+		s.config, err = workdirConfig(opts.ConfigFile, s.workdir)
+		if err != nil {
+			return err
+		}
+		opts.ConfigFile = s.config
+		opts.SystemPrompt += workdirNote(s.workdir)
+	}
+	s.host, err = b.newHost(ctx, &opts)
+	if err == nil {
+		if s.workdir != "" {
+			// the system message of the conversation lacks the note
+			messages = withSystemMessage(messages, schema.SystemMessage(opts.SystemPrompt))
+		}
+		err = s.host.ReplaceMessages(messages)
+	}
+	if err != nil {
+		s.close()
+		return err
+	}
+	b.sessions[id] = s
+	return nil
+}
+
+// close closes the host of s and removes its configuration.
+func (s *session) close() {
+	if s.host != nil {
+		s.host.Close()
+	}
+	if s.tools != nil {
+		s.tools.close()
+	}
+	if s.config != "" {
+		os.Remove(s.config)
+	}
+}
+
+// handleOpenSession opens a session with an empty conversation of msg.Agent
+// under the ID in msg.Session, so remote can run several chats, like one per
+// tab, with a single bridge. The bridge picks an ID if msg.Session is empty.
+// It sends the ID to remote, or an empty ID on failure.
+func (b *Bridge) handleOpenSession(ctx context.Context, msg Message) error {
+	id, agent := msg.Session, msg.Agent
+	if agent == "" {
+		agent = defaultAgent
+	}
+	var err error
+	if id == "" {
+		id, err = newID()
+	} else if _, ok := b.sessions[id]; ok {
+		err = fmt.Errorf("session %q is open already", id)
+	}
+	if err == nil {
+		err = b.openSession(ctx, id, agent, msg.Workdir, nil, nil, b.decisions.forSession())
+	}
+	if err != nil {
+		slog.Warn("opening session", "session", id, "err", err)
+		id = ""
+	}
+	return b.send(Message{MsgType: msgTypeSessionOpened, Content: id, Session: msg.Session})
+}
+
+// handleCloseSession closes the session of msg, freeing its host, and
+// confirms it to remote. Closing an unknown session only confirms it.
+func (b *Bridge) handleCloseSession(msg Message) error {
+	if s, ok := b.sessions[msg.Session]; ok {
+		for key, host := range b.presetHosts {
+			if s.config != "" && key.config == s.config {
+				host.Close()
+				delete(b.presetHosts, key)
+			}
+		}
+		delete(b.contextWarned, s.host)
+		delete(b.checkpoints, s.host)
+		s.close()
+		delete(b.sessions, msg.Session)
+	}
+	return b.send(Message{MsgType: msgTypeSessionClosed, Session: msg.Session})
+}
+
+// handleForkSession forks the session of msg and sends the ID of the new one
+// to remote, or an empty ID on failure.
+func (b *Bridge) handleForkSession(ctx context.Context, host Host, msg Message) error {
+	id, err := b.forkSession(ctx, host, msg.Session, msg.Agent, msg.Workdir)
+	if err != nil {
+		slog.Warn("forking session", "err", err)
+	}
+	return b.send(Message{MsgType: msgTypeSessionForked, Content: id, Session: msg.Session})
+}
+
+// sessionWorkdir returns the working directory of a forked session, or "" if
+// it has none or there is no session of that ID.
+func (b *Bridge) sessionWorkdir(id string) string {
+	if s, ok := b.sessions[id]; ok {
+		return s.workdir
+	}
+	return ""
+}
+
+// sessionDecisions returns the approvals of a session, the ones of the main
+// conversation if there is no session of that ID.
+func (b *Bridge) sessionDecisions(id string) *decisionCache {
+	if s, ok := b.sessions[id]; ok {
+		return s.decisions
+	}
+	return b.decisions
+}
+
+// sessionHost returns the host of a forked session, or false if there is no
+// session of that ID.
+func (b *Bridge) sessionHost(id string) (Host, string, bool) {
+	s, ok := b.sessions[id]
+	if !ok {
+		return nil, "", false
+	}
+	return s.host, s.agent, true
+}
+
+func (b *Bridge) closeSessions() {
+	for id, s := range b.sessions {
+		s.close()
+		delete(b.sessions, id)
+	}
+}
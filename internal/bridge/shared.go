@@ -0,0 +1,184 @@
+package bridge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sharedRefresh = 5 * time.Minute // how long a shared policy is used before checking for changes
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://")
+}
+
+// sharedFile is a policy file distributed over HTTP, kept in the user cache
+// directory so the last copy is used while the server is unreachable.
+type sharedFile struct {
+	url  string
+	path string // of the cached copy
+
+	mu      sync.Mutex
+	etag    string
+	checked time.Time
+}
+
+func newSharedFile(url string) (*sharedFile, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "mcphost-cockpit", "shared")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(url))
+	name := hex.EncodeToString(sum[:8]) + filepath.Ext(strings.SplitN(url, "?", 2)[0])
+	return &sharedFile{url: url, path: filepath.Join(dir, name)}, nil
+}
+
+// local returns the path of the cached copy, downloading the file if it was
+// not checked for a while.
+func (f *sharedFile) local(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) < sharedRefresh {
+		return f.path, nil
+	}
+	f.checked = time.Now()
+	err := f.download(ctx)
+	if err == nil {
+		return f.path, nil
+	}
+	if _, statErr := os.Stat(f.path); statErr == nil {
+		slog.Warn("using cached shared policy", "url", f.url, "err", err)
+		return f.path, nil
+	}
+	return "", err
+}
+
+func (f *sharedFile) download(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(f.path); f.etag != "" && err == nil {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("fetching %s: %s", f.url, resp.Status)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), f.path)
+	if err != nil {
+		return err
+	}
+	f.etag = resp.Header.Get("ETag")
+	return nil
+}
+
+// teamDecisions are allow and deny decisions shared by a team, from a JSON
+// file in the format of the approvals file, a directory of such files merged
+// in name order, or a URL of one. Keys may be tool name patterns. They apply
+// before the decisions of the user.
+type teamDecisions struct {
+	location string
+	remote   *sharedFile // if location is a URL
+
+	mu        sync.Mutex // scheduled jobs look decisions up as well
+	decisions map[string]decision
+	loaded    time.Time
+}
+
+func newTeamDecisions(location string) (*teamDecisions, error) {
+	t := &teamDecisions{location: location}
+	if isURL(location) {
+		var err error
+		t.remote, err = newSharedFile(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, t.load(context.Background())
+}
+
+func (t *teamDecisions) load(ctx context.Context) error {
+	file := t.location
+	if t.remote != nil {
+		var err error
+		file, err = t.remote.local(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	files := []string{file}
+	if info, err := os.Stat(file); err != nil {
+		return err
+	} else if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(file, "*.json"))
+		if err != nil {
+			return err
+		}
+	}
+	decisions := map[string]decision{}
+	for _, name := range files { // Glob sorts
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var d map[string]decision
+		if err := json.Unmarshal(data, &d); err != nil {
+			return fmt.Errorf("parsing %s: %w", name, err)
+		}
+		for tool, decision := range d {
+			decisions[tool] = decision
+		}
+	}
+	t.decisions, t.loaded = decisions, time.Now()
+	return nil
+}
+
+// lookup returns the team decision for tool, if there is one, reloading the
+// decisions if they were not loaded for a while.
+func (t *teamDecisions) lookup(ctx context.Context, tool string) (allow, found bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.loaded) >= sharedRefresh {
+		if err := t.load(ctx); err != nil {
+			slog.Warn("reloading team decisions, keeping the old ones", "err", err)
+			t.loaded = time.Now()
+		}
+	}
+	d, ok := matchTool(tool, t.decisions)
+	return d.Allow, ok
+}
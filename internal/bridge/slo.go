@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// warnFirstTokenSLO is the code of the warning that the first token of
+// several prompts in a row came later than Config.FirstTokenSLO.
+const warnFirstTokenSLO = "first-token-slo"
+
+const (
+	latencyWindow    = 100 // prompts the percentiles are of
+	violationsToWarn = 3   // prompts in a row over the SLO before a warning
+)
+
+// latencyStats are the times to the first token of the last prompts, in
+// admin-metrics results and meta.latency of first-token-slo warnings.
+type latencyStats struct {
+	Prompts    int   `json:"prompts"` // in the window, at most latencyWindow
+	P50Ms      int64 `json:"p50Ms"`
+	P90Ms      int64 `json:"p90Ms"`
+	P99Ms      int64 `json:"p99Ms"`
+	SLOMs      int64 `json:"sloMs,omitempty"`
+	Violations int   `json:"violations"` // prompts in the window over the SLO
+}
+
+// firstTokenTracker keeps the times to the first token of the last prompts.
+type firstTokenTracker struct {
+	slo     time.Duration // 0 for none
+	samples []time.Duration
+	inARow  int  // prompts over the SLO since the last one within
+	warned  bool // of the violations in a row
+}
+
+// record adds the time to the first token of a prompt and reports whether
+// remote should be warned, which it is once per run of violations.
+func (t *firstTokenTracker) record(d time.Duration) bool {
+	t.samples = append(t.samples, d)
+	if len(t.samples) > latencyWindow {
+		t.samples = t.samples[len(t.samples)-latencyWindow:]
+	}
+	if t.slo <= 0 || d <= t.slo {
+		t.inARow, t.warned = 0, false
+		return false
+	}
+	t.inARow++
+	if t.inARow < violationsToWarn || t.warned {
+		return false
+	}
+	t.warned = true
+	return true
+}
+
+// stats returns the percentiles of the times recorded, nil if none.
+func (t *firstTokenTracker) stats() *latencyStats {
+	if len(t.samples) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(t.samples)
+	slices.Sort(sorted)
+	percentile := func(p int) int64 {
+		i := (len(sorted)*p + 99) / 100 // nearest rank
+		return sorted[max(i-1, 0)].Milliseconds()
+	}
+	s := &latencyStats{Prompts: len(sorted), P50Ms: percentile(50), P90Ms: percentile(90), P99Ms: percentile(99), SLOMs: t.slo.Milliseconds()}
+	for _, d := range sorted {
+		if t.slo > 0 && d > t.slo {
+			s.Violations++
+		}
+	}
+	return s
+}
+
+// recordFirstToken tracks the time to the first token of a prompt and warns
+// remote when it exceeds the SLO repeatedly, as a local model server does
+// that is swapping or running on the CPU.
+func (b *Bridge) recordFirstToken(d time.Duration) {
+	if !b.firstTokens.record(d) {
+		return
+	}
+	stats := b.firstTokens.stats()
+	msg := fmt.Sprintf("the first token took longer than %s in the last %d prompts, %s at the 90th percentile, the model server may be degraded",
+		b.firstTokens.slo, b.firstTokens.inARow, time.Duration(stats.P90Ms)*time.Millisecond)
+	slog.Warn(msg)
+	if err := b.send(warningMessage(bridgeError{Code: warnFirstTokenSLO, Message: msg}).withMeta("latency", stats)); err != nil {
+		slog.Error("sending message", "err", err)
+	}
+}
@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+const sourceSnippetLen = 200 // bytes of a tool result sent as snippet
+
+// source is a tool result the model had when answering a prompt.
+type source struct {
+	ID      string          `json:"id"` // of the tool call
+	Tool    string          `json:"tool"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	Snippet string          `json:"snippet"`
+}
+
+// toolSources returns the successful tool results among messages, the part of
+// the conversation added by a prompt.
+func toolSources(messages []*schema.Message) []source {
+	calls := map[string]schema.ToolCall{}
+	var sources []source
+	for _, m := range messages {
+		for _, tc := range m.ToolCalls {
+			calls[tc.ID] = tc
+		}
+		if m.Role != schema.Tool || m.ToolCallID == "" {
+			continue
+		}
+		s := source{ID: m.ToolCallID, Snippet: snippet(m.Content, sourceSnippetLen)}
+		if tc, ok := calls[m.ToolCallID]; ok {
+			s.Tool, s.Args = tc.Function.Name, rawArgs(tc.Function.Arguments)
+		} else {
+			s.Tool = m.ToolName
+		}
+		sources = append(sources, s)
+	}
+	return sources
+}
+
+// snippet returns the start of text of at most n bytes, not splitting a rune.
+func snippet(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n] + "…"
+}
+
+// sendSources sends the tool results of the messages host added since it had
+// known messages to remote, if there are any.
+func (b *Bridge) sendSources(host Host, known int) error {
+	messages := host.Messages()
+	if known > len(messages) {
+		return nil // the history was compacted meanwhile
+	}
+	sources := toolSources(messages[known:])
+	if len(sources) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeSources, Content: string(data)})
+}
@@ -0,0 +1,84 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+const (
+	summaryInstruction = "Summarize our conversation so far in a few sentences. " +
+		"Keep facts, decisions and open questions, and mention the tools that were used. Do not call any tools."
+	summarizerPrompt = "You summarize conversations between a user and an assistant that administers a Linux system."
+
+	summaryReplace = "replace" // summarize-conversation content to replace the history with the summary
+)
+
+// transcript renders messages as plain text for a model that did not see them.
+func transcript(messages []*schema.Message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		switch m.Role {
+		case schema.System:
+			continue
+		case schema.Tool:
+			fmt.Fprintf(&b, "tool result (%s): %s\n", m.ToolName, m.Content)
+		default:
+			fmt.Fprintf(&b, "%s: %s\n", m.Role, m.Content)
+		}
+		for _, call := range m.ToolCalls {
+			fmt.Fprintf(&b, "%s called tool %s with %s\n", m.Role, call.Function.Name, call.Function.Arguments)
+		}
+	}
+	return b.String()
+}
+
+// summarize returns a summary of the conversation of host. It uses the
+// summary model if set, otherwise the active model without keeping the
+// exchange in the history.
+func (b *Bridge) summarize(ctx context.Context, host Host, summaryModel string) (string, error) {
+	messages := host.Messages()
+	if len(messages) == 0 {
+		return "", errors.New("nothing to summarize")
+	}
+
+	if summaryModel != "" {
+		summarizer, err := b.helperHost(ctx, summaryModel, summarizerPrompt)
+		if err != nil {
+			return "", err
+		}
+		defer summarizer.ClearSession()
+		return summarizer.Prompt(ctx, summaryInstruction+"\n\n"+transcript(messages))
+	}
+
+	defer func() {
+		err := host.ReplaceMessages(messages)
+		if err != nil {
+			slog.Error("restoring history after summary", "err", err)
+		}
+	}()
+	summaryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return host.PromptWithCallbacks(summaryCtx, summaryInstruction,
+		func(name, args string) {
+			slog.Warn("model tried to call a tool while summarizing", "tool", name)
+			cancel()
+		}, nil, nil)
+}
+
+// replaceWithSummary replaces the history of host with a summary of it.
+func replaceWithSummary(host Host, summary string) error {
+	return host.ReplaceMessages(summaryMessages(summary))
+}
+
+// summaryMessages stand for the messages summarized in the conversation.
+func summaryMessages(summary string) []*schema.Message {
+	return []*schema.Message{
+		schema.UserMessage("Summary of our conversation so far:\n" + summary),
+		schema.AssistantMessage("Understood, I will continue from this summary.", nil),
+	}
+}
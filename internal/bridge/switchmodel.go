@@ -0,0 +1,88 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// handleSwitchModel goes on with the conversation of the session or agent of
+// msg on the model in content, to escalate to a larger model when the answers
+// of a small one are poor. The SDK cannot change the model of a host, so a
+// host of the new model takes the conversation over and the old one is
+// closed. Like restarting a server it may recreate host, so the host to use
+// from then on is returned. On failure the conversation stays on its model.
+func (b *Bridge) handleSwitchModel(ctx context.Context, host Host, msg Message) (Host, error) {
+	model := strings.TrimSpace(msg.Content)
+	agent := msg.Agent
+	if agent == "" {
+		agent = defaultAgent
+	}
+	s, inSession := b.sessions[msg.Session]
+	old, hasHost := host, true
+	switch {
+	case inSession:
+		old, agent = s.host, s.agent
+	case agent != defaultAgent:
+		old, hasHost = b.agentHosts[agent]
+	}
+	opts, err := b.agentOptions(agent)
+	from := opts.Model
+	if hasHost {
+		from = old.GetModelString()
+	}
+	if err == nil && model == "" {
+		err = errors.New("no model to switch to")
+	}
+	if err != nil {
+		return host, b.sendError(bridgeError{Code: errorSwitchFailed, Message: err.Error()})
+	}
+	if inSession && s.config != "" {
+		opts.ConfigFile = s.config
+		opts.SystemPrompt += workdirNote(s.workdir)
+	}
+	opts.Model = model
+	if hasHost {
+		h, err := b.newCheckedHost(ctx, &opts)
+		if err == nil {
+			if err = h.ReplaceMessages(old.Messages()); err != nil {
+				h.Close()
+			}
+		}
+		var notFound *modelNotFoundError
+		if errors.As(err, &notFound) {
+			return host, b.sendError(bridgeError{Code: errorModelNotFound, Message: err.Error(), Models: notFound.Available})
+		}
+		if err != nil {
+			return host, b.sendError(bridgeError{Code: errorSwitchFailed, Message: fmt.Sprintf("switching to %s: %v", model, err)})
+		}
+		if cps, ok := b.checkpoints[old]; ok {
+			b.checkpoints[h] = cps
+			delete(b.checkpoints, old)
+		}
+		delete(b.contextWarned, old)
+		old.Close()
+		switch {
+		case inSession:
+			s.host = h
+		case agent != defaultAgent:
+			b.agentHosts[agent] = h
+		default:
+			host = h
+		}
+	}
+	if inSession {
+		s.model = model
+	} else {
+		b.models[agent] = model // for the hosts of agent created later
+	}
+	slog.Info("switched model", "from", from, "to", model, "session", msg.Session, "agent", msg.Agent)
+	reply := Message{MsgType: msgTypeModelSwitched, Session: msg.Session, Agent: msg.Agent}
+	reply.Content, err = providerSwitchContent(providerSwitch{From: from, To: model, Reason: "requested"})
+	if err != nil {
+		return host, err
+	}
+	return host, b.send(reply)
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// handleSetSystemPrompt makes content the system prompt of the conversation
+// of the session or agent of msg, to change the persona of the model without
+// restarting the bridge. The SDK only adds the system prompt of the host to a
+// conversation not starting with one, so it is set as the first message,
+// with the tool docs and the notes on verbosity and workdir the configured
+// one gets. An empty content, like clear-context, goes back to the configured
+// system prompt.
+func (b *Bridge) handleSetSystemPrompt(host Host, msg Message) error {
+	if h, _, ok := b.sessionHost(msg.Session); ok {
+		host = h
+	} else if h, ok := b.agentHosts[msg.Agent]; ok {
+		host = h
+	}
+	messages := slices.Clone(host.Messages())
+	if len(messages) > 0 && messages[0].Role == schema.System {
+		messages = messages[1:]
+	}
+	prompt := strings.TrimSpace(msg.Content)
+	if prompt != "" {
+		system := b.appendToolDocs(prompt) + verbosities[b.sessionVerbosity(msg.Session)].note
+		if s, ok := b.sessions[msg.Session]; ok && s.workdir != "" {
+			system += workdirNote(s.workdir)
+		}
+		messages = append([]*schema.Message{schema.SystemMessage(system)}, messages...)
+	}
+	if err := host.ReplaceMessages(messages); err != nil {
+		return err
+	}
+	slog.Info("set system prompt", "session", msg.Session, "agent", msg.Agent, "configured", prompt == "")
+	return b.send(Message{MsgType: msgTypeSystemPromptSet, Content: prompt, Session: msg.Session, Agent: msg.Agent})
+}
+
+// withSystemMessage returns messages with the system message they start
+// with, if any, replaced by system, or dropped if system is nil, for a host
+// going on with the conversation of another under a system prompt of its own.
+// The SDK only adds its system prompt to messages lacking one.
+func withSystemMessage(messages []*schema.Message, system *schema.Message) []*schema.Message {
+	if len(messages) == 0 || messages[0].Role != schema.System {
+		return messages
+	}
+	if system == nil {
+		return messages[1:]
+	}
+	messages = slices.Clone(messages)
+	messages[0] = system
+	return messages
+}
@@ -0,0 +1,129 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// telemetryEpsilon is the privacy budget per report. Each count is released
+// with Laplace noise of scale telemetrySensitivity/epsilon. The guarantee is
+// per event: a report tells little about whether any single prompt or tool
+// call happened, but not about a user making many of them.
+const telemetryEpsilon = 1.0
+
+// telemetrySensitivity is the most a single event changes the counts by in
+// sum: a prompt counts once as a prompt and once for its provider.
+const telemetrySensitivity = 2.0
+
+// telemetryProviders are the model providers of mcphost counted by name, any
+// other counts as provider:other.
+var telemetryProviders = []string{"anthropic", "azure", "google", "ollama", "openai"}
+
+// telemetry counts usage of the bridge, opted in with Config.Telemetry, into
+// daily reports in a local spool directory. Only counts of prompts, model
+// providers and tool risk classes are kept, never content, and nothing is
+// sent anywhere. Every report has the same keys, so the keys tell nothing
+// about what was used.
+type telemetry struct {
+	dir    string
+	day    string
+	counts map[string]int // of every key reported
+}
+
+// newTelemetry returns a telemetry spooling to dir, counting the tool calls
+// by the risk classes of risks.
+func newTelemetry(dir string, risks map[string]string) (*telemetry, error) {
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cache, "mcphost-cockpit", "telemetry")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	keys := []string{"prompts", "provider:other", "tool:unknown"} // riskClass of tools matching no pattern
+	for _, provider := range telemetryProviders {
+		keys = append(keys, "provider:"+provider)
+	}
+	for _, class := range risks {
+		keys = append(keys, "tool:"+class)
+	}
+	t := &telemetry{dir: dir, day: time.Now().Format(time.DateOnly), counts: map[string]int{}}
+	for _, key := range keys {
+		t.counts[key] = 0
+	}
+	return t, nil
+}
+
+// telemetryReport is a spooled report.
+type telemetryReport struct {
+	Day     string         `json:"day"`
+	Epsilon float64        `json:"epsilon"`
+	Counts  map[string]int `json:"counts"` // with noise added
+}
+
+// The methods of telemetry do nothing on a nil telemetry, like those of
+// metrics.
+
+// count counts an event of key, which is one of the keys reported.
+func (t *telemetry) count(key string) {
+	if t == nil {
+		return
+	}
+	day := time.Now().Format(time.DateOnly)
+	if t.day != day {
+		t.flush()
+		t.day = day
+	}
+	if _, ok := t.counts[key]; ok {
+		t.counts[key]++
+	}
+}
+
+func (t *telemetry) prompt(model string) {
+	provider, _, _ := strings.Cut(model, ":")
+	if !slices.Contains(telemetryProviders, provider) {
+		provider = "other"
+	}
+	t.count("prompts")
+	t.count("provider:" + provider)
+}
+
+// flush spools the counts of the day with noise and starts over.
+func (t *telemetry) flush() {
+	if t == nil {
+		return
+	}
+	report := telemetryReport{Day: t.day, Epsilon: telemetryEpsilon, Counts: map[string]int{}}
+	for key, n := range t.counts {
+		noise := laplace(rand.Float64()-0.5, telemetrySensitivity/telemetryEpsilon)
+		report.Counts[key] = max(0, int(math.Round(float64(n)+noise)))
+		t.counts[key] = 0
+	}
+	data, err := json.Marshal(report)
+	if err == nil {
+		name := fmt.Sprintf("%s-%d-%d.json", report.Day, os.Getpid(), time.Now().UnixNano())
+		err = os.WriteFile(filepath.Join(t.dir, name), data, 0o600)
+	}
+	if err != nil {
+		slog.Warn("spooling telemetry", "err", err)
+	}
+}
+
+// laplace returns the sample of the Laplace distribution with mean 0 for u,
+// uniformly distributed in [-0.5, 0.5). The bound -0.5 itself, which would
+// give infinite noise, is moved inside.
+func laplace(u, scale float64) float64 {
+	u = max(u, math.Nextafter(-0.5, 0))
+	return -scale * math.Copysign(math.Log(1-2*math.Abs(u)), u)
+}
@@ -0,0 +1,129 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Post-processing step types of prompt templates.
+const (
+	postExtractJSON = "extract-json" // keep only the JSON value of the response
+	postCommand     = "command"      // pipe the text through a command, failing on a non-zero exit
+	postWriteFile   = "write-file"   // write the text to a file, leaving it unchanged
+)
+
+// promptTemplate turns the content of a prompt message into the prompt and
+// the final response into the output of a small workflow.
+type promptTemplate struct {
+	Prompt string     `json:"prompt"` // text/template, {{.Input}} is the content of the prompt message
+	Post   []postStep `json:"post"`   // run in order on the final response
+}
+
+type postStep struct {
+	Type    string `json:"type"`
+	Command string `json:"command"` // for command, split at spaces, not run by a shell
+	Path    string `json:"path"`    // for write-file, relative to the artifacts directory unless absolute
+}
+
+// templateResult is the outcome of the post-processing as sent to remote.
+type templateResult struct {
+	Template string `json:"template"`
+	Output   string `json:"output"`
+	Error    string `json:"error,omitempty"`
+}
+
+// expandTemplate returns the prompt of template name for input.
+func (b *Bridge) expandTemplate(name, input string) (string, error) {
+	t, ok := b.bridgeConf.Templates[name]
+	if !ok {
+		return "", fmt.Errorf("unknown template %q", name)
+	}
+	tmpl, err := template.New(name).Parse(t.Prompt)
+	if err != nil {
+		return "", err
+	}
+	var prompt strings.Builder
+	err = tmpl.Execute(&prompt, struct{ Input string }{input})
+	return prompt.String(), err
+}
+
+// postProcess runs the post-processing of template name on response and
+// sends the result to remote, if the template has any steps.
+func (b *Bridge) postProcess(ctx context.Context, name, response string) error {
+	steps := b.bridgeConf.Templates[name].Post
+	if len(steps) == 0 {
+		return nil
+	}
+	res := templateResult{Template: name, Output: response}
+	for i, step := range steps {
+		out, err := b.runPostStep(ctx, step, res.Output)
+		if err != nil {
+			res.Error = fmt.Sprintf("step %d (%s): %s", i+1, step.Type, err)
+			break
+		}
+		res.Output = out
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return b.send(Message{MsgType: msgTypeTemplateResult, Content: string(data)})
+}
+
+func (b *Bridge) runPostStep(ctx context.Context, step postStep, text string) (string, error) {
+	switch step.Type {
+	case postExtractJSON:
+		return extractJSON(text)
+	case postCommand:
+		args := strings.Fields(step.Command)
+		if len(args) == 0 {
+			return "", errors.New("empty command")
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return string(out), nil
+	case postWriteFile:
+		file := step.Path
+		if !filepath.IsAbs(file) && b.artifacts != nil {
+			file = filepath.Join(b.artifacts.dir, file)
+		}
+		return text, os.WriteFile(file, []byte(text), 0o600)
+	}
+	return "", fmt.Errorf("unknown step type %q", step.Type)
+}
+
+// extractJSON returns the JSON value of a response, from a json code block
+// or else the outermost object or array, tolerating surrounding text.
+func extractJSON(text string) (string, error) {
+	for _, block := range extractCodeBlocks(text) {
+		if block.Language == "json" && json.Valid([]byte(block.Content)) {
+			return strings.TrimSpace(block.Content), nil
+		}
+	}
+	start := strings.IndexAny(text, "{[")
+	if start >= 0 {
+		closer := "}"
+		if text[start] == '[' {
+			closer = "]"
+		}
+		end := strings.LastIndex(text, closer)
+		if end > start && json.Valid([]byte(text[start:end+1])) {
+			return text[start : end+1], nil
+		}
+	}
+	return "", errors.New("no JSON in response")
+}
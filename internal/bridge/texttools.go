@@ -0,0 +1,192 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+const maxTextToolCalls = 10 // per prompt
+
+// openers a response consisting of a tool call written as text starts with
+var textToolOpeners = []string{"{", "```", "<tool_call>"}
+
+// textToolCall is a tool call a model wrote into its response.
+type textToolCall struct {
+	Name string
+	Args string // JSON object
+
+	edited bool // the arguments are the ones remote changed them to, see editOf
+}
+
+// parseTextToolCall recognizes a response that is a JSON tool call, bare, in
+// a code fence or in <tool_call> tags, as small models write them.
+func parseTextToolCall(response string) (textToolCall, bool) {
+	s := strings.TrimSpace(response)
+	s = strings.TrimPrefix(s, "<tool_call>")
+	s = strings.TrimSuffix(s, "</tool_call>")
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "```") {
+		s = strings.TrimSuffix(strings.TrimSpace(s), "```")
+		_, s, _ = strings.Cut(s, "\n")
+	}
+	var raw struct {
+		Name       string          `json:"name"`
+		Tool       string          `json:"tool"`
+		Arguments  json.RawMessage `json:"arguments"`
+		Parameters json.RawMessage `json:"parameters"`
+		Function   *struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return textToolCall{}, false
+	}
+	call := textToolCall{Name: raw.Name}
+	args := raw.Arguments
+	if call.Name == "" {
+		call.Name = raw.Tool
+	}
+	if len(args) == 0 {
+		args = raw.Parameters
+	}
+	if raw.Function != nil && call.Name == "" {
+		call.Name, args = raw.Function.Name, raw.Function.Arguments
+	}
+	// some models encode the arguments as a JSON string
+	var encoded string
+	if json.Unmarshal(args, &encoded) == nil {
+		args = json.RawMessage(encoded)
+	}
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	var obj map[string]any
+	if call.Name == "" || json.Unmarshal(args, &obj) != nil {
+		return textToolCall{}, false
+	}
+	call.Args = string(args)
+	return call, true
+}
+
+// textToolFilter holds back a streamed response that starts like a tool call
+// written as text, so it does not show up on remote if it is one.
+type textToolFilter struct {
+	holding bool // undecided or starting like a tool call
+	held    strings.Builder
+}
+
+func newTextToolFilter() *textToolFilter {
+	return &textToolFilter{holding: true}
+}
+
+func (f *textToolFilter) write(chunk string, emit func(string)) {
+	if !f.holding {
+		emit(chunk)
+		return
+	}
+	f.held.WriteString(chunk)
+	s := strings.TrimLeft(f.held.String(), " \t\r\n")
+	if s == "" {
+		return
+	}
+	for _, opener := range textToolOpeners {
+		if strings.HasPrefix(s, opener) || strings.HasPrefix(opener, s) {
+			return
+		}
+	}
+	f.holding = false
+	emit(f.held.String())
+	f.held.Reset()
+}
+
+// release emits the held back text, which was no tool call.
+func (f *textToolFilter) release(emit func(string)) {
+	if f.held.Len() > 0 {
+		emit(f.held.String())
+		f.held.Reset()
+	}
+	f.holding = false
+}
+
+// runTextToolCall runs a tool call the model wrote as text through the same
+// checks as native ones and returns the note about it for the model. It
+// reports false if the call was refused without a reason for the model.
+func (b *Bridge) runTextToolCall(ctx context.Context, call textToolCall, planned plannedTools) (string, bool) {
+	call.Args, _ = b.transformArgs(call.Name, call.Args)
+	if !b.breaker.allow(call.Name) {
+		if err := b.send(Message{MsgType: msgTypeUnavailable, Content: call.Name}); err != nil {
+			slog.Error("sending message", "err", err)
+		}
+		return "The tool " + call.Name + " is temporarily unavailable. Answer without it.", true
+	}
+	if b.conf.ElicitArgs {
+		args, ok := b.elicitArgs(ctx, call)
+		if !ok {
+			return "", false
+		}
+		call.Args = args
+	}
+	if b.conf.ValidateArgs {
+		args, errs := b.validateCall(ctx, b.promptToolbox(ctx).tools[call.Name], call.Name, call.Args)
+		if len(errs) > 0 {
+			b.rejectToolArgs(call.Name, errs)
+			return invalidCallNote(call.Name, errs), true
+		}
+		call.Args = args
+	}
+	if allow, reason := b.authorizeTool(ctx, call.Name, call.Args, planned.take(call.Name)); !allow {
+		if reason != "" {
+			return deniedCallNote(call.Name, reason), true
+		}
+		return "", false
+	}
+	if edit, ok := b.editOf(call); ok {
+		note, ok := b.runTextToolCall(ctx, edit, nil)
+		return editedCallNote(edit) + note, ok
+	}
+	if err := b.limiter.acquire(ctx, call.Name); err != nil {
+		return "", false
+	}
+	if matchesToolPatterns(b.conf.AsyncTools, call.Name) {
+		return b.runAsync(ctx, call), true
+	}
+	start := time.Now()
+	b.turn.toolCalls++
+	contents, isError, err := b.callWithRetries(ctx, call)
+	b.limiter.release(call.Name)
+	items := b.resultItems(contents)
+	result := itemsText(items)
+	if err != nil {
+		result, isError = err.Error(), true
+		items = []resultItem{{Type: mcp.ContentTypeText, Text: result}}
+	}
+	status := auditOK
+	if isError {
+		status = auditFailed
+	}
+	ran := b.recordToolRun(call.Name, call.Args, start, status)
+	b.turn.toolRan(call.Name, start, isError)
+	if b.breaker.record(call.Name, isError) {
+		if err := b.send(Message{MsgType: msgTypeUnavailable, Content: call.Name}); err != nil {
+			slog.Error("sending message", "err", err)
+		}
+	}
+	resultMsg := resultMessage(msgTypeResultOK, call.Name, b.sentItems(items), ran)
+	if isError {
+		resultMsg = b.failedResult(call.Name, b.sentItems(items), ran)
+	}
+	if err := b.send(resultMsg); err != nil {
+		slog.Error("sending message", "err", err)
+	}
+	result = b.guardResult(call.Name, result)
+	if isError {
+		return "The tool " + call.Name + " failed:\n" + result, true
+	}
+	return "The tool " + call.Name + " returned:\n" + result, true
+}
@@ -0,0 +1,54 @@
+package bridge
+
+import "github.com/cloudwego/eino/schema"
+
+// contextTokens is where the tokens of a conversation are, in the meta data
+// of history and done messages. All counts are estimated.
+type contextTokens struct {
+	System int          `json:"system"` // of the messages before the first prompt, if the session keeps any
+	Turns  []turnTokens `json:"turns"`
+	Total  int          `json:"total"`
+}
+
+// turnTokens are the tokens of a prompt of the user and all that followed up
+// to the next.
+type turnTokens struct {
+	Prompt      int `json:"prompt"`
+	Completion  int `json:"completion"`  // the responses of the model, with its tool calls
+	ToolResults int `json:"toolResults"` // the results of the tools added to the conversation
+}
+
+// messageTokens estimates the tokens of m.
+func messageTokens(m *schema.Message) int {
+	tokens := estimateTokens(m.Content)
+	for _, tc := range m.ToolCalls {
+		tokens += estimateTokens(tc.Function.Name + tc.Function.Arguments)
+	}
+	return tokens
+}
+
+// countContextTokens breaks the tokens of messages down by turn.
+func countContextTokens(messages []*schema.Message) contextTokens {
+	c := contextTokens{Turns: []turnTokens{}}
+	for _, m := range messages {
+		tokens := messageTokens(m)
+		c.Total += tokens
+		if m.Role == schema.User {
+			c.Turns = append(c.Turns, turnTokens{})
+		}
+		if len(c.Turns) == 0 {
+			c.System += tokens
+			continue
+		}
+		turn := &c.Turns[len(c.Turns)-1]
+		switch m.Role {
+		case schema.User:
+			turn.Prompt += tokens
+		case schema.Tool:
+			turn.ToolResults += tokens
+		default:
+			turn.Completion += tokens
+		}
+	}
+	return c
+}
@@ -0,0 +1,304 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"gopkg.in/yaml.v3"
+)
+
+// mcpServer is the part of a server entry of the mcphost configuration the
+// bridge needs to connect to it, in the current and the legacy format.
+type mcpServer struct {
+	Type          string            `yaml:"type"`
+	Transport     string            `yaml:"transport"` // legacy
+	Command       any               `yaml:"command"`   // list, or a string with args in the legacy format
+	Args          []string          `yaml:"args"`
+	Environment   map[string]string `yaml:"environment"`
+	Env           map[string]string `yaml:"env"`
+	URL           string            `yaml:"url"`
+	AllowedTools  []string          `yaml:"allowedTools"`
+	ExcludedTools []string          `yaml:"excludedTools"`
+}
+
+var envReference = regexp.MustCompile(`\$\{env://([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv replaces ${env://NAME:-default} references like mcphost does.
+func expandEnv(s string) string {
+	return envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envReference.FindStringSubmatch(ref)
+		if v, ok := os.LookupEnv(m[1]); ok {
+			return v
+		}
+		return m[2]
+	})
+}
+
+func loadMCPServers(path string) (map[string]mcpServer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		MCPServers map[string]mcpServer `yaml:"mcpServers"`
+	}
+	// YAML is a superset of JSON, so this reads both config formats
+	err = yaml.Unmarshal([]byte(expandEnv(string(b))), &conf)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return conf.MCPServers, nil
+}
+
+func (s mcpServer) command() []string {
+	switch c := s.Command.(type) {
+	case string:
+		return append([]string{c}, s.Args...)
+	case []any:
+		var cmd []string
+		for _, part := range c {
+			cmd = append(cmd, fmt.Sprint(part))
+		}
+		return cmd
+	}
+	return nil
+}
+
+func (s mcpServer) offers(tool string) bool {
+	if len(s.AllowedTools) > 0 {
+		return slices.Contains(s.AllowedTools, tool)
+	}
+	return !slices.Contains(s.ExcludedTools, tool)
+}
+
+var errBuiltinServer = errors.New("builtin servers are not reachable")
+
+// toolbox connects the bridge itself to the MCP servers of the mcphost
+// configuration, for tool calls the SDK does not make. Builtin servers run
+// inside mcphost and cannot be reached.
+type toolbox struct {
+	clients map[string]*client.Client // keyed by server name
+	tools   map[string]mcp.Tool       // keyed by server__tool like mcphost names them
+}
+
+// getToolbox returns the toolbox for the servers of configFile, connecting to
+// them on first use. Scheduled jobs ask for it beside the chat loop.
+func (b *Bridge) getToolbox(ctx context.Context, configFile string) *toolbox {
+	b.toolsMu.Lock()
+	defer b.toolsMu.Unlock()
+	if b.tools == nil {
+		b.tools = b.connectToolbox(ctx, configFile)
+	}
+	return b.tools
+}
+
+// promptToolbox returns the toolbox for the tool calls of the current prompt,
+// the one of its session if the session has its tools scoped to a working
+// directory, connecting to the servers of the scoped configuration on first
+// use, or the one of the bridge otherwise.
+func (b *Bridge) promptToolbox(ctx context.Context) *toolbox {
+	s, ok := b.sessions[b.session]
+	if !ok || s.config == "" {
+		return b.getToolbox(ctx, b.options.ConfigFile)
+	}
+	b.toolsMu.Lock()
+	defer b.toolsMu.Unlock()
+	if s.tools == nil {
+		s.tools = b.connectToolbox(ctx, s.config)
+	}
+	return s.tools
+}
+
+// connectToolbox returns a toolbox connected to the servers of configFile.
+// Servers that fail are left out and reported to remote.
+func (b *Bridge) connectToolbox(ctx context.Context, configFile string) *toolbox {
+	tools := &toolbox{clients: map[string]*client.Client{}, tools: map[string]mcp.Tool{}}
+	servers, err := loadMCPServers(configFile)
+	if err != nil {
+		slog.Error("loading MCP servers", "err", err)
+		if configFile == "" {
+			return tools // mcphost looks for its default configuration
+		}
+		if err := b.sendError(bridgeError{Code: errorBadConfig, Message: err.Error()}); err != nil {
+			slog.Error("sending message", "err", err)
+		}
+		return tools
+	}
+	for name, server := range servers {
+		if err := tools.connect(ctx, name, server); err != nil {
+			slog.Warn("connecting to MCP server", "server", name, "err", err)
+			if errors.Is(err, errBuiltinServer) {
+				continue // it runs inside mcphost
+			}
+			if err := b.sendError(bridgeError{Code: errorServerFailed, Message: err.Error(), Server: name}); err != nil {
+				slog.Error("sending message", "err", err)
+			}
+		}
+	}
+	return tools
+}
+
+func (t *toolbox) connect(ctx context.Context, name string, server mcpServer) error {
+	var c *client.Client
+	var err error
+	kind := server.Type
+	if server.Transport != "" {
+		kind = server.Transport
+	}
+	switch {
+	case kind == "builtin" || kind == "inprocess":
+		return errBuiltinServer
+	case kind == "remote" || kind == "streamable":
+		c, err = client.NewStreamableHttpClient(server.URL)
+	case kind == "sse" || kind == "" && server.URL != "":
+		c, err = client.NewSSEMCPClient(server.URL)
+	default:
+		cmd := server.command()
+		if len(cmd) == 0 {
+			return fmt.Errorf("no command")
+		}
+		var env []string
+		for k, v := range server.Environment {
+			env = append(env, k+"="+v)
+		}
+		for k, v := range server.Env {
+			env = append(env, k+"="+v)
+		}
+		c = client.NewClient(transport.NewStdio(cmd[0], env, cmd[1:]...))
+	}
+	if err != nil {
+		return err
+	}
+	return t.connectClient(ctx, name, c, server)
+}
+
+// connectClient starts c and adds the tools of its server.
+func (t *toolbox) connectClient(ctx context.Context, name string, c *client.Client, server mcpServer) error {
+	if err := c.Start(ctx); err != nil {
+		return err
+	}
+	init := mcp.InitializeRequest{}
+	init.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	init.Params.ClientInfo = mcp.Implementation{Name: "mcphost-cockpit", Version: "1.0.0"}
+	if _, err := c.Initialize(ctx, init); err != nil {
+		c.Close()
+		return err
+	}
+	list, err := c.ListTools(ctx, mcp.ListToolsRequest{})
+	if err != nil {
+		c.Close()
+		return err
+	}
+	t.clients[name] = c
+	for _, tool := range list.Tools {
+		if server.offers(tool.Name) {
+			t.tools[name+"__"+tool.Name] = tool
+		}
+	}
+	return nil
+}
+
+// resolve returns the full name of tool, which may lack the server prefix if
+// no other server has a tool of that name.
+func (t *toolbox) resolve(tool string) (string, bool) {
+	if _, ok := t.tools[tool]; ok {
+		return tool, true
+	}
+	found := ""
+	for name := range t.tools {
+		if _, short, _ := strings.Cut(name, "__"); short == tool {
+			if found != "" {
+				return "", false
+			}
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// call runs a tool and returns the content of its result.
+func (t *toolbox) call(ctx context.Context, name, args string) ([]mcp.Content, bool, error) {
+	server, tool, _ := strings.Cut(name, "__")
+	c, ok := t.clients[server]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown tool %q", name)
+	}
+	req := mcp.CallToolRequest{}
+	req.Params.Name = tool
+	if args != "" {
+		if err := json.Unmarshal([]byte(args), &req.Params.Arguments); err != nil {
+			return nil, false, fmt.Errorf("parsing arguments: %w", err)
+		}
+	}
+	res, err := c.CallTool(ctx, req)
+	if err != nil {
+		return nil, false, err
+	}
+	return res.Content, res.IsError, nil
+}
+
+// readOnlyTool reports whether the server of tool annotates it as only
+// reading data, so it runs without asking if Config.AutoApproveReadOnly is
+// set. The hint is taken on trust, as the server runs the tool anyway.
+func (b *Bridge) readOnlyTool(ctx context.Context, tool string) bool {
+	if !b.conf.AutoApproveReadOnly {
+		return false
+	}
+	tools := b.getToolbox(ctx, b.options.ConfigFile)
+	b.toolsMu.Lock() // against a restart of the server by the chat loop
+	defer b.toolsMu.Unlock()
+	full, ok := tools.resolve(tool)
+	if !ok {
+		return false
+	}
+	hint := tools.tools[full].Annotations.ReadOnlyHint
+	return hint != nil && *hint
+}
+
+func (b *Bridge) closeToolbox() {
+	b.toolsMu.Lock()
+	defer b.toolsMu.Unlock()
+	if b.tools == nil {
+		return
+	}
+	b.tools.close()
+	b.tools = nil
+}
+
+// close disconnects the toolbox from its servers.
+func (t *toolbox) close() {
+	for name, c := range t.clients {
+		c.Close()
+		delete(t.clients, name)
+	}
+}
+
+// restart reconnects the toolbox to server name, reporting false if it is not
+// connected to it.
+func (t *toolbox) restart(ctx context.Context, name string, servers map[string]mcpServer) (bool, error) {
+	c, ok := t.clients[name]
+	if !ok {
+		return false, nil
+	}
+	c.Close()
+	delete(t.clients, name)
+	for tool := range t.tools {
+		if strings.HasPrefix(tool, name+"__") {
+			delete(t.tools, tool)
+		}
+	}
+	if server, ok := servers[name]; ok {
+		return true, t.connect(ctx, name, server)
+	}
+	return true, nil
+}
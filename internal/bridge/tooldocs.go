@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// toolDoc improves the documentation an MCP server ships for its tools.
+// Small models misuse tools with poor descriptions.
+type toolDoc struct {
+	Description string   `json:"description"` // replaces the description of the server
+	Notes       string   `json:"notes"`       // added to the description
+	Examples    []string `json:"examples"`    // example calls, e.g. JSON arguments
+}
+
+// matchTool returns the value for tool, or else for the first pattern, in
+// sorted order, that matches it.
+func matchTool[T any](tool string, byPattern map[string]T) (T, bool) {
+	if v, ok := byPattern[tool]; ok {
+		return v, true
+	}
+	for _, pattern := range slices.Sorted(maps.Keys(byPattern)) {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return byPattern[pattern], true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// apply returns description with the doc applied.
+func (d toolDoc) apply(description string) string {
+	if d.Description != "" {
+		description = d.Description
+	}
+	if d.Notes != "" {
+		description += " " + d.Notes
+	}
+	for _, example := range d.Examples {
+		description += "\n  example: " + example
+	}
+	return strings.TrimSpace(description)
+}
+
+// toolDescription returns the description of tool with the doc configured
+// for it applied.
+func (b *Bridge) toolDescription(tool, description string) string {
+	if doc, ok := matchTool(tool, b.bridgeConf.Tools); ok {
+		return doc.apply(description)
+	}
+	return description
+}
+
+// withToolDocs adds the configured tool docs to systemPrompt, which may be
+// a file like for mcphost. The SDK registers the tools itself, so the docs
+// reach the model through the system prompt.
+func (b *Bridge) withToolDocs(systemPrompt string) string {
+	if len(b.bridgeConf.Tools) == 0 {
+		return systemPrompt
+	}
+	if data, err := os.ReadFile(systemPrompt); err == nil {
+		systemPrompt = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		slog.Warn("reading system prompt", "err", err)
+	}
+	return b.appendToolDocs(systemPrompt)
+}
+
+// appendToolDocs adds the configured tool docs to the text of a system
+// prompt.
+func (b *Bridge) appendToolDocs(systemPrompt string) string {
+	if len(b.bridgeConf.Tools) == 0 {
+		return systemPrompt
+	}
+	var docs strings.Builder
+	docs.WriteString(systemPrompt)
+	if systemPrompt != "" {
+		docs.WriteString("\n\n")
+	}
+	docs.WriteString("Notes on the tools, names may be patterns:\n")
+	for _, pattern := range slices.Sorted(maps.Keys(b.bridgeConf.Tools)) {
+		fmt.Fprintf(&docs, "- %s: %s\n", pattern, b.bridgeConf.Tools[pattern].apply(""))
+	}
+	return docs.String()
+}
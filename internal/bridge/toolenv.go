@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// toolEnvVars are the environment variables recorded for tool calls. The MCP
+// servers inherit them from the bridge, unless their configuration sets them.
+var toolEnvVars = []string{"PATH", "HOME", "USER", "LOGNAME", "LANG", "LC_ALL", "SHELL", "TMPDIR"}
+
+// toolEnvironment is how a tool call ran, for reviewing it later.
+type toolEnvironment struct {
+	User        string            `json:"user"` // effective user
+	UID         int               `json:"uid"`  // -1 on Windows
+	Cwd         string            `json:"cwd"`
+	Env         map[string]string `json:"env,omitempty"`         // the set toolEnvVars
+	Confinement string            `json:"confinement,omitempty"` // of the server, see serverConfig.confinement
+	Duration    string            `json:"duration"`              // of the run, e.g. "1.5s"
+}
+
+// recordToolRun logs the environment of a call of tool with args started at
+// start, zero if it is not known, and writes it to the audit log with the
+// status of the result. It returns the environment if it is to be sent with
+// the result.
+func (b *Bridge) recordToolRun(tool, args string, start time.Time, status string) *toolEnvironment {
+	env := &toolEnvironment{UID: os.Geteuid(), Env: map[string]string{}}
+	if !start.IsZero() {
+		env.Duration = time.Since(start).Round(time.Millisecond).String()
+	}
+	u, err := user.Current()
+	if env.UID >= 0 {
+		u, err = user.LookupId(strconv.Itoa(env.UID))
+	}
+	if err == nil {
+		env.User = u.Username
+	}
+	env.Cwd, _ = os.Getwd()
+	for _, name := range toolEnvVars {
+		if v, ok := os.LookupEnv(name); ok {
+			env.Env[name] = v
+		}
+	}
+	server, _, _ := strings.Cut(tool, "__")
+	env.Confinement = b.bridgeConf.Servers[server].confinement()
+	slog.Info("tool ran", "tool", tool, "user", env.User, "uid", env.UID, "cwd", env.Cwd,
+		"env", env.Env, "confinement", env.Confinement, "duration", env.Duration)
+	entry := auditEntry{Time: start, Tool: tool, Args: rawArgs(args), Decision: "allow", Status: status, Duration: env.Duration, Env: env}
+	if start.IsZero() {
+		entry.Time = time.Now()
+	}
+	b.audit.record(entry)
+	if !b.conf.ToolEnvironment {
+		return nil
+	}
+	return env
+}
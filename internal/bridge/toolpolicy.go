@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// toolPolicy allows or denies tools by patterns, without asking remote.
+// Patterns are like filesystem:read_*, matching the server and the tool name
+// with path.Match, or match the full name like filesystem__read_file if they
+// have no colon. Deny patterns win.
+type toolPolicy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// loadToolPolicy reads a tool policy in YAML or JSON, or returns nil if path
+// is empty.
+func loadToolPolicy(path string) (*toolPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p toolPolicy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, pattern := range append(p.Allow, p.Deny...) {
+		if _, err := matchToolPattern(pattern, "a__b"); err != nil {
+			return nil, fmt.Errorf("%s: pattern %q: %w", path, pattern, err)
+		}
+	}
+	return &p, nil
+}
+
+// decide returns the decision for tool and the pattern that made it, or
+// policyAsk if no pattern matches.
+func (p *toolPolicy) decide(tool string) (decision, pattern string) {
+	if p == nil {
+		return policyAsk, ""
+	}
+	for _, pattern := range p.Deny {
+		if ok, _ := matchToolPattern(pattern, tool); ok {
+			return policyDeny, pattern
+		}
+	}
+	for _, pattern := range p.Allow {
+		if ok, _ := matchToolPattern(pattern, tool); ok {
+			return policyAllow, pattern
+		}
+	}
+	return policyAsk, ""
+}
+
+// matchToolPattern reports whether the full name of tool matches pattern.
+func matchToolPattern(pattern, tool string) (bool, error) {
+	serverPattern, namePattern, ok := strings.Cut(pattern, ":")
+	if !ok {
+		return path.Match(pattern, tool)
+	}
+	server, name, _ := strings.Cut(tool, "__")
+	serverOK, err := path.Match(serverPattern, server)
+	if err != nil || !serverOK {
+		return false, err
+	}
+	return path.Match(namePattern, name)
+}
@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"text/template"
+)
+
+const toolSummarizerPrompt = "You explain tool calls to people who are not programmers. " +
+	"Answer with one short sentence saying what the call will do, starting with a verb, and nothing else."
+
+// defaultSummaries are the summaries of the tools of the builtin servers of
+// mcphost, whatever the servers are named.
+var defaultSummaries = map[string]string{
+	"*__read_file":                "Read the file {{.path}}",
+	"*__read_multiple_files":      `Read the files {{join .paths ", "}}`,
+	"*__write_file":               "Write {{len .content}} characters to the file {{.path}}, replacing its content",
+	"*__modify_file":              "Replace {{printf \"%q\" .find}} with {{printf \"%q\" .replace}} in the file {{.path}}",
+	"*__copy_file":                "Copy {{.source}} to {{.destination}}",
+	"*__move_file":                "Move {{.source}} to {{.destination}}",
+	"*__delete_file":              "Delete {{.path}}",
+	"*__create_directory":         "Create the directory {{.path}}",
+	"*__list_directory":           "List the files in {{.path}}",
+	"*__tree":                     "List the files below {{.path}}",
+	"*__search_files":             "Search {{.path}} for files named like {{.pattern}}",
+	"*__search_within_files":      "Search the files below {{.path}} for {{printf \"%q\" .substring}}",
+	"*__get_file_info":            "Look up the size, times and permissions of {{.path}}",
+	"*__list_allowed_directories": "List the directories the tools may access",
+	"*__run_shell_cmd":            "Run the shell command {{printf \"%q\" .command}} to {{.description}}",
+	"*__fetch":                    "Download {{.url}}",
+	"*__todoread":                 "Read the to-do list",
+	"*__todowrite":                "Update the to-do list",
+}
+
+var summaryFuncs = template.FuncMap{
+	"join": func(values []any, sep string) string {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = fmt.Sprint(v)
+		}
+		return strings.Join(s, sep)
+	},
+}
+
+// templateSummary returns the summary of a call of tool with args from the
+// configured templates or the default ones, or "" if there is none or it
+// needs arguments the call lacks.
+func (b *Bridge) templateSummary(tool, args string) string {
+	text, ok := matchTool(tool, b.bridgeConf.Summaries)
+	if !ok {
+		text, ok = matchTool(tool, defaultSummaries)
+	}
+	if !ok {
+		return ""
+	}
+	tmpl, err := template.New(tool).Funcs(summaryFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		slog.Warn("parsing tool summary", "tool", tool, "err", err)
+		return ""
+	}
+	values := map[string]any{}
+	if strings.TrimSpace(args) != "" && json.Unmarshal([]byte(args), &values) != nil {
+		return ""
+	}
+	var summary bytes.Buffer
+	if err := tmpl.Execute(&summary, values); err != nil {
+		slog.Debug("executing tool summary", "tool", tool, "err", err)
+		return ""
+	}
+	return summary.String()
+}
+
+// toolSummary returns what a call of tool with args will do in plain words,
+// for the confirmation. Without a template the tool summary model writes it, if
+// there is one.
+func (b *Bridge) toolSummary(ctx context.Context, tool, args string) string {
+	if summary := b.templateSummary(tool, args); summary != "" {
+		return summary
+	}
+	if b.conf.ToolSummaryModel == "" {
+		return ""
+	}
+	summary, err := b.modelSummary(ctx, tool, args)
+	if err != nil {
+		slog.Warn("summarizing tool call", "tool", tool, "err", err)
+		return ""
+	}
+	return summary
+}
+
+// modelSummary asks the tool summary model what a call of tool with args will do.
+// Its exchange is not kept.
+func (b *Bridge) modelSummary(ctx context.Context, tool, args string) (string, error) {
+	summarizer, err := b.helperHost(ctx, b.conf.ToolSummaryModel, toolSummarizerPrompt)
+	if err != nil {
+		return "", err
+	}
+	defer summarizer.ClearSession()
+	answer, err := summarizer.Prompt(ctx, fmt.Sprintf("Tool: %s\nArguments: %s", tool, args))
+	if err != nil {
+		return "", err
+	}
+	// a sentence, whatever else small models add
+	line, _, _ := strings.Cut(strings.TrimSpace(answer), "\n")
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+)
+
+// argRule rewrites an argument of tool calls before they run, e.g. to force
+// a dry run, confine paths or clamp limits.
+type argRule struct {
+	Arg    string   `json:"arg"`
+	Set    any      `json:"set"`    // replaces the argument, added if missing
+	Prefix string   `json:"prefix"` // prepended to a string argument lacking it
+	Suffix string   `json:"suffix"` // appended to a string argument lacking it
+	Min    *float64 `json:"min"`    // lower bound of a number argument
+	Max    *float64 `json:"max"`    // upper bound of a number argument
+}
+
+func (r argRule) apply(args map[string]any) {
+	if r.Set != nil {
+		args[r.Arg] = r.Set
+	}
+	switch v := args[r.Arg].(type) {
+	case string:
+		if r.Prefix != "" && !strings.HasPrefix(v, r.Prefix) {
+			v = r.Prefix + v
+		}
+		if r.Suffix != "" && !strings.HasSuffix(v, r.Suffix) {
+			v += r.Suffix
+		}
+		args[r.Arg] = v
+	case float64:
+		if r.Min != nil && v < *r.Min {
+			v = *r.Min
+		}
+		if r.Max != nil && v > *r.Max {
+			v = *r.Max
+		}
+		args[r.Arg] = v
+	}
+}
+
+// transformArgs applies the argument rules configured for tool to args and
+// reports whether they changed. Arguments that are no JSON object are left
+// as they are.
+func (b *Bridge) transformArgs(tool, args string) (string, bool) {
+	rules, ok := matchTool(tool, b.bridgeConf.ArgRules)
+	if !ok {
+		return args, false
+	}
+	parsed := map[string]any{}
+	if strings.TrimSpace(args) != "" {
+		if err := json.Unmarshal([]byte(args), &parsed); err != nil {
+			slog.Warn("not transforming arguments", "tool", tool, "err", err)
+			return args, false
+		}
+	}
+	before, err := json.Marshal(parsed)
+	if err != nil {
+		return args, false
+	}
+	for _, rule := range rules {
+		rule.apply(parsed)
+	}
+	after, err := json.Marshal(parsed)
+	if err != nil || string(after) == string(before) {
+		return args, false
+	}
+	slog.Info("transformed tool arguments", "tool", tool, "from", args, "to", string(after))
+	return string(after), true
+}
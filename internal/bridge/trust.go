@@ -0,0 +1,35 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+)
+
+// trust levels of MCP servers
+const (
+	trustTrusted = "trusted" // the tools run without asking, unless a policy denies them
+	trustAsk     = "ask"     // remote is asked for every call, remembered decisions do not apply
+	trustBlocked = "blocked" // the tools are denied without asking
+)
+
+// serverBlocked is the reason of tool-denied messages for tools of blocked
+// servers.
+const serverBlocked = "server-blocked"
+
+func checkTrust(server, trust string) error {
+	switch trust {
+	case "", trustTrusted, trustAsk, trustBlocked:
+		return nil
+	}
+	return fmt.Errorf("server %s: unknown trust level %q, want %s, %s or %s", server, trust, trustTrusted, trustAsk, trustBlocked)
+}
+
+// serverTrust returns the trust level of the server of tool, "" if none is
+// configured.
+func (b *Bridge) serverTrust(tool string) string {
+	server, _, found := strings.Cut(tool, "__")
+	if !found {
+		return ""
+	}
+	return b.bridgeConf.Servers[server].Trust
+}
@@ -0,0 +1,229 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// checkToolArgs validates the arguments of a call of tool if enabled. It
+// returns the full name of the tool, the arguments, repaired if needed, and
+// what is wrong with them beyond repair, see validateCall.
+func (b *Bridge) checkToolArgs(ctx context.Context, tool, args string) (string, string, []string) {
+	if !b.conf.ValidateArgs {
+		return tool, args, nil
+	}
+	tools := b.promptToolbox(ctx)
+	full, ok := tools.resolve(tool)
+	if !ok {
+		return tool, args, nil
+	}
+	repaired, errs := b.validateCall(ctx, tools.tools[full], full, args)
+	return full, repaired, errs
+}
+
+// rejectToolArgs tells remote that a call of tool was not run.
+func (b *Bridge) rejectToolArgs(tool string, errs []string) {
+	slog.Info("rejecting tool call", "tool", tool, "errors", errs)
+	err := b.send(Message{MsgType: msgTypeArgsRejected, Content: strings.Join(errs, "\n"), Tool: tool})
+	if err != nil {
+		slog.Error("sending message", "err", err)
+	}
+}
+
+// invalidCallNote tells the model why its call of tool was not run.
+func invalidCallNote(tool string, errs []string) string {
+	return "The call of the tool " + tool + " was rejected and not run, as its arguments are invalid: " +
+		strings.Join(errs, "; ") + ". Call it again with valid arguments."
+}
+
+// toolSchema returns the input schema of tool as generic JSON.
+func toolSchema(tool mcp.Tool) map[string]any {
+	data := []byte(tool.RawInputSchema)
+	if len(data) == 0 {
+		var err error
+		data, err = json.Marshal(tool.InputSchema)
+		if err != nil {
+			return nil
+		}
+	}
+	var schema map[string]any
+	if json.Unmarshal(data, &schema) != nil {
+		return nil
+	}
+	return schema
+}
+
+// validateToolArgs checks the arguments of a call of tool against its input
+// schema. Values of the wrong type that convert losslessly, like "5" for a
+// number, are repaired and unknown arguments dropped if the schema allows
+// none. It returns the arguments, repaired if changed, and what is wrong
+// with them beyond repair.
+func validateToolArgs(tool mcp.Tool, args string) (string, []string) {
+	var value any = map[string]any{}
+	if strings.TrimSpace(args) != "" {
+		if err := json.Unmarshal([]byte(args), &value); err != nil {
+			return args, []string{"the arguments are no valid JSON: " + err.Error()}
+		}
+	}
+	if _, ok := value.(map[string]any); !ok {
+		return args, []string{"the arguments are no JSON object"}
+	}
+	v := schemaValidator{}
+	value = v.check(toolSchema(tool), value, "")
+	if !v.repaired || len(v.errs) > 0 {
+		return args, v.errs
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return args, []string{err.Error()}
+	}
+	return string(data), nil
+}
+
+// schemaValidator checks values against the part of JSON schema tools use:
+// type, enum, required, properties, additionalProperties and items.
+type schemaValidator struct {
+	errs     []string
+	repaired bool
+}
+
+func (v *schemaValidator) fail(path, format string, args ...any) {
+	if path == "" {
+		path = "arguments"
+	}
+	v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+// check returns value, repaired where possible, and notes what is wrong.
+func (v *schemaValidator) check(schema map[string]any, value any, path string) any {
+	if schema == nil {
+		return value
+	}
+	if types := stringList(schema["type"]); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return hasType(value, t) }) {
+		converted, ok := convert(value, types)
+		if !ok {
+			v.fail(path, "want %s, got %s", strings.Join(types, " or "), jsonType(value))
+			return value
+		}
+		value = converted
+		v.repaired = true
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return reflect.DeepEqual(e, value) }) {
+		v.fail(path, "%v is none of %v", value, enum)
+	}
+	switch val := value.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		for _, name := range stringList(schema["required"]) {
+			if _, ok := val[name]; !ok {
+				v.fail(argPath(path, name), "missing")
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(val)) {
+			prop, known := props[name].(map[string]any)
+			switch {
+			case known:
+				val[name] = v.check(prop, val[name], argPath(path, name))
+			case schema["additionalProperties"] == false:
+				delete(val, name)
+				v.repaired = true
+			}
+		}
+	case []any:
+		items, _ := schema["items"].(map[string]any)
+		for i := range val {
+			val[i] = v.check(items, val[i], fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+	return value
+}
+
+func argPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// stringList returns a string or list of strings of a schema as list.
+func stringList(v any) []string {
+	switch t := v.(type) {
+	case string:
+		if t == "" {
+			return nil
+		}
+		return []string{t}
+	case []any:
+		var types []string
+		for _, e := range t {
+			if s, ok := e.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func hasType(value any, t string) bool {
+	switch t {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		return jsonType(value) == "number"
+	}
+	return jsonType(value) == t
+}
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// convert returns value as the first of types it converts to without loss.
+func convert(value any, types []string) (any, bool) {
+	for _, t := range types {
+		switch s, isString := value.(string); {
+		case isString && (t == "number" || t == "integer"):
+			if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil && hasType(f, t) {
+				return f, true
+			}
+		case isString && t == "boolean":
+			if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+				return b, true
+			}
+		case t == "string":
+			switch val := value.(type) {
+			case float64:
+				return strconv.FormatFloat(val, 'f', -1, 64), true
+			case bool:
+				return strconv.FormatBool(val), true
+			}
+		}
+	}
+	return nil, false
+}
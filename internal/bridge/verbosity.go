@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// verbosity is how long the answers of the model are, set with a note in the
+// system prompt and a limit of the tokens of a response.
+type verbosity struct {
+	note      string
+	maxTokens int // 0 keeps the configured limit
+}
+
+// verbosity levels, normal being the model as configured
+var verbosities = map[string]verbosity{
+	"terse": {
+		note:      "\n\nAnswer as briefly as possible, in one line where you can, or with just the command or value asked for. Explain only when asked to.",
+		maxTokens: 1024,
+	},
+	"normal": {},
+	"detailed": {
+		note:      "\n\nAnswer thoroughly: explain what you do and why, the steps to take and what to watch out for.",
+		maxTokens: 8192,
+	},
+}
+
+// applyVerbosity makes level the verbosity of all hosts created later.
+func (b *Bridge) applyVerbosity(level string) {
+	v := verbosities[level]
+	b.options.SystemPrompt += v.note
+	if v.maxTokens > 0 {
+		viper.Set("max-tokens", v.maxTokens)
+	}
+}
+
+// sessionVerbosity returns the verbosity of a forked session, or of the main
+// conversation if there is no session of that ID.
+func (b *Bridge) sessionVerbosity(id string) string {
+	if s, ok := b.sessions[id]; ok && s.verbosity != "" {
+		return s.verbosity
+	}
+	if b.verbosity != "" {
+		return b.verbosity
+	}
+	return b.conf.Verbosity
+}
+
+// handleSetVerbosity sets the verbosity of the session of msg, or of the main
+// conversation, to the level in content, and tells remote the level in effect.
+func (b *Bridge) handleSetVerbosity(msg Message) error {
+	level := strings.TrimSpace(msg.Content)
+	if _, ok := verbosities[level]; !ok {
+		levels := slices.Sorted(maps.Keys(verbosities))
+		return b.sendError(bridgeError{Code: errorUnknownVerbosity,
+			Message: fmt.Sprintf("unknown verbosity %q, use one of %s", level, strings.Join(levels, ", "))})
+	}
+	if s, ok := b.sessions[msg.Session]; ok {
+		s.verbosity = level
+	} else {
+		b.verbosity = level
+	}
+	return b.send(Message{MsgType: msgTypeVerbositySet, Content: level, Session: msg.Session})
+}
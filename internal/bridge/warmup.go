@@ -0,0 +1,80 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Warm-up states reported to remote in the ready messages.
+const (
+	warmupRunning = "running"
+	warmupDone    = "done"
+	warmupFailed  = "failed"
+	warmupSkipped = "skipped" // the provider of the model needs no warm-up
+)
+
+// readyInfo is the content of ready messages when the bridge warms up the
+// model. Without warm-up ready messages have no content.
+type readyInfo struct {
+	Warmup string `json:"warmup"`
+}
+
+type warmup struct {
+	mu    sync.Mutex
+	state string
+}
+
+func (w *warmup) set(state string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state = state
+}
+
+func (w *warmup) get() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+// startWarmup loads model in the background, so the first prompt does not
+// wait for it. Only Ollama models are loaded this way, other providers have
+// no load latency to hide.
+func (b *Bridge) startWarmup(ctx context.Context, model string) {
+	name, ok := ollamaModel(model)
+	if !ok {
+		b.warmup.set(warmupSkipped)
+		return
+	}
+	b.warmup.set(warmupRunning)
+	go func() {
+		client, err := ollamaClient()
+		if err == nil {
+			// a generation without prompt just loads the model
+			err = client.Generate(ctx, &api.GenerateRequest{Model: name}, func(api.GenerateResponse) error { return nil })
+		}
+		if err != nil {
+			slog.Warn("warming up model", "model", model, "err", err)
+			b.warmup.set(warmupFailed)
+			return
+		}
+		slog.Debug("model warmed up", "model", model)
+		b.warmup.set(warmupDone)
+	}()
+}
+
+// readyMessage returns the ready message with the warm-up state, if any.
+func (b *Bridge) readyMessage() (Message, error) {
+	msg := Message{MsgType: msgTypeReady}
+	if state := b.warmup.get(); state != "" {
+		data, err := json.Marshal(readyInfo{Warmup: state})
+		if err != nil {
+			return msg, err
+		}
+		msg.Content = string(data)
+	}
+	return msg, nil
+}
@@ -0,0 +1,252 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// outsideWorkdir is the reason of tool-denied messages for calls with paths
+// outside the working directory of the session.
+const outsideWorkdir = "outside-workdir"
+
+// checkWorkdir returns dir with symbolic links resolved, so paths compare
+// with the ones tools see, if it is an absolute path of a directory.
+func checkWorkdir(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("working directory %s is not an absolute path", dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("working directory %s is not a directory", dir)
+	}
+	return resolved, nil
+}
+
+// startInDir is a POSIX shell script running its arguments after the first
+// in the directory given as the first, like env -C, which only GNU env has.
+const startInDir = `cd -- "$1" && shift && exec "$@"`
+
+// workdirConfig writes an mcphost configuration like the one at path to a
+// temporary file, with the servers scoped to dir: the builtin filesystem
+// server may only access dir and local servers start in it. The caller
+// removes the file.
+func workdirConfig(path, dir string) (string, error) {
+	conf := map[string]any{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		// the references to environment variables are left for mcphost
+		if err := yaml.Unmarshal(data, &conf); err != nil {
+			return "", fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	servers, _ := conf["mcpServers"].(map[string]any)
+	for _, entry := range servers {
+		server, ok := entry.(map[string]any)
+		if !ok {
+			continue
+		}
+		if server["type"] == "builtin" && server["name"] == "fs" {
+			options, _ := server["options"].(map[string]any)
+			if options == nil {
+				options = map[string]any{}
+			}
+			options["allowed_directories"] = []string{dir}
+			server["options"] = options
+			continue
+		}
+		scopeServerEnv(server, dir)
+		if runtime.GOOS == "windows" {
+			continue // there is no POSIX shell, the servers get PWD only
+		}
+		switch command := server["command"].(type) {
+		case []any:
+			server["command"] = append([]any{"sh", "-c", startInDir, "sh", dir}, command...)
+		case string: // legacy format with separate args
+			args, _ := server["args"].([]any)
+			server["command"] = "sh"
+			server["args"] = append([]any{"-c", startInDir, "sh", dir, command}, args...)
+		}
+	}
+	f, err := os.CreateTemp("", "mcphost-cockpit-workdir-*.json")
+	if err != nil {
+		return "", err
+	}
+	err = json.NewEncoder(f).Encode(conf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// scopeServerEnv sets PWD in the environment of a local server, in the
+// format of its configuration.
+func scopeServerEnv(server map[string]any, dir string) {
+	if _, ok := server["command"]; !ok {
+		return
+	}
+	key := "environment"
+	if _, legacy := server["command"].(string); legacy {
+		key = "env"
+	}
+	env, _ := server[key].(map[string]any)
+	if env == nil {
+		env = map[string]any{}
+	}
+	env["PWD"] = dir
+	server[key] = env
+}
+
+// workdirNote tells the model of a session the directory it works in.
+func workdirNote(dir string) string {
+	return "\n\nYou work in the directory " + dir + ". Only access files inside it, relative paths are relative to it."
+}
+
+// pathArgument reports whether an argument of that name holds a path even
+// if its value is relative.
+func pathArgument(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc([]string{"path", "file", "dir", "folder", "cwd", "root", "source", "destination"},
+		func(s string) bool { return strings.Contains(name, s) })
+}
+
+// commandArgument reports whether an argument of that name holds a command
+// line for a shell.
+func commandArgument(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc([]string{"command", "cmd", "script", "shell"},
+		func(s string) bool { return strings.Contains(name, s) })
+}
+
+// commandPaths returns the words of a command line that look like paths:
+// absolute, in the home directory or going up with "..". The standard
+// streams and /dev/null that commands redirect to are left out.
+func commandPaths(command string) []string {
+	words := strings.FieldsFunc(command, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(";&|()<>'\"`=$", r)
+	})
+	var paths []string
+	for _, w := range words {
+		if slices.Contains([]string{"/dev/null", "/dev/stdin", "/dev/stdout", "/dev/stderr"}, w) {
+			continue
+		}
+		if filepath.IsAbs(w) || strings.HasPrefix(w, "~") || w == ".." ||
+			strings.HasPrefix(w, "../") || strings.Contains(w, "/../") || strings.HasSuffix(w, "/..") {
+			paths = append(paths, w)
+		}
+	}
+	return paths
+}
+
+// pathsOutside returns the paths in the arguments of a tool call that are
+// outside dir. Absolute paths are checked wherever they are, relative ones
+// in arguments named like paths, and the words of command lines that look
+// like paths. This is best effort: a command can compute a path, from a
+// variable say, that no argument shows, so servers that run commands need
+// their own sandbox.
+func pathsOutside(args, dir string) []string {
+	var value any
+	if strings.TrimSpace(args) == "" || json.Unmarshal([]byte(args), &value) != nil {
+		return nil
+	}
+	var outside []string
+	var walk func(name string, v any)
+	walk = func(name string, v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, elem := range v {
+				walk(key, elem)
+			}
+		case []any:
+			for _, elem := range v {
+				walk(name, elem)
+			}
+		case string:
+			if commandArgument(name) {
+				for _, p := range commandPaths(v) {
+					if !insideDir(p, dir) {
+						outside = append(outside, p)
+					}
+				}
+				return
+			}
+			if v == "" || !filepath.IsAbs(v) && !strings.HasPrefix(v, "~/") && !pathArgument(name) {
+				return
+			}
+			if !insideDir(v, dir) {
+				outside = append(outside, v)
+			}
+		}
+	}
+	walk("", value)
+	slices.Sort(outside)
+	return outside
+}
+
+// insideDir reports whether p, relative to dir unless absolute, is dir or
+// below it.
+func insideDir(p, dir string) bool {
+	if strings.HasPrefix(p, "~") {
+		return false // the home directory of the server, wherever that is
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	p = resolveExisting(filepath.Clean(p))
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveExisting returns the clean path p with the symbolic links of its
+// longest existing prefix resolved, so a file to be created below a link to
+// another directory is taken for a file there.
+func resolveExisting(p string) string {
+	rest := ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Join(p, rest)
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// deniedOutsideWorkdir tells remote that a tool call was denied as it has
+// paths outside the working directory of c, and reports whether it was.
+func (b *Bridge) deniedOutsideWorkdir(c toolCaller, name, args string) bool {
+	if c.workdir == "" {
+		return false
+	}
+	outside := pathsOutside(args, c.workdir)
+	if len(outside) == 0 {
+		return false
+	}
+	b.sendDenied(c, Message{MsgType: msgTypeToolDenied, Content: name}.
+		withMeta("reason", outsideWorkdir).withMeta("workdir", c.workdir).withMeta("paths", outside))
+	return true
+}
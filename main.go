@@ -3,15 +3,20 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	runtimedebug "runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/mark3labs/mcphost/sdk"
+	"mcphost-cockpit/internal/bridge"
 )
 
 var (
@@ -20,62 +25,285 @@ var (
 	systemPrompt = flag.String("system-prompt", "", "Set the system prompt. Defaults to the model's if not set")
 	debug        = flag.Bool("debug", false, "Enable debug logging")
 	logFile      = flag.String("log-file", "", "Write logs to this file. Will be truncated. Defaults to stderr if not set")
+	compress     = flag.String("compress", "", "Compress large message content sent to remote (gzip), if it accepts that in its version reply. Disabled if not set")
+	compressMin  = flag.Int("compress-min-size", 4096, "Only compress content of at least this many bytes")
+	bridgeFile   = flag.String("bridge-config", "", "Path to bridge configuration (JSON)")
+	maxParallel  = flag.Int("max-parallel-tools", 0, "Maximum number of tools running at the same time, in the background, in scheduled jobs and in prompts. Unlimited if 0")
+	toolPolicy   = flag.String("tool-policy", "", "Allow or deny tools without asking by patterns like filesystem:read_* in the allow and deny lists of this YAML or JSON file. Deny wins")
+	policyFile   = flag.String("policy", "", "Authorize tool calls with this Rego policy file, directory or http(s) URL, evaluated by embedded OPA")
+	policyQuery  = flag.String("policy-query", "data.mcphost.decision", "Rego query returning allow, deny or ask")
+	filterCmd    = flag.String("filter-cmd", "", "Pass every protocol message through this external filter process")
+	embedModel   = flag.String("embedding-model", "", "Model for embed requests, e.g. ollama:nomic-embed-text. Only ollama models are supported")
+	summaryModel = flag.String("summary-model", "", "Model for summarizing conversations. Defaults to the active model if not set")
+	circuitMax   = flag.Int("circuit-threshold", 0, "Disable a tool after this many failures in a row. Never disabled if 0")
+	circuitWait  = flag.Duration("circuit-cooldown", time.Minute, "Time before a disabled tool may be tried again")
+	preset       = flag.String("preset", "", "Generation preset: precise, balanced or creative. Defaults to the configured parameters if not set")
+	verbosity    = flag.String("verbosity", "normal", "Length of the answers: terse for one line where possible, normal or detailed. Remote may change it per session")
+	firstTokSLO  = flag.Duration("first-token-slo", 0, "Warn the frontend when the first token of several prompts in a row takes longer than this. No warnings if 0")
+	planFirst    = flag.Bool("plan-first", false, "Ask the model for a plan of tool calls and send it for approval before running a prompt")
+	approvalFile = flag.String("approvals-file", "", "Remember tool approvals with scope always in this file. Kept for the session only if not set")
+	artifactsDir = flag.String("artifacts-dir", "", "Save files produced by the model below this directory. Disabled if not set")
+	codeBlocks   = flag.Bool("code-artifacts", false, "Send code blocks of responses as separate code-artifact messages")
+	maxChunkRate = flag.Int("max-chunks-per-second", 0, "Aggregate streamed chunks to send at most this many per second. Unlimited if 0")
+	chunkBound   = flag.String("chunk-boundary", "", "Only end streamed chunks at word or sentence boundaries. Chunks end anywhere if not set")
+	textTools    = flag.Bool("detect-text-tool-calls", false, "Run tool calls the model writes as JSON into its response instead of calling the tool")
+	simStream    = flag.Int("simulate-streaming", 0, "Send responses of models that do not stream as chunks of this many words per second. Sent at once if 0")
+	emulateTools = flag.String("emulate-tools", "", "Comma separated model patterns, e.g. ollama:gemma*, whose tool calls are emulated with prompts")
+	listen       = flag.String("listen", "", "Serve one frontend on this unix socket, or named pipe on Windows, instead of stdin and stdout")
+	multiClient  = flag.Bool("multi-client", false, "With --listen, serve any number of frontends sharing the conversation, running their prompts one at a time. Frontends sending observe only watch")
+	reattach     = flag.Duration("reattach-grace", 0, "With --listen, keep working this long after the frontend went away, for it to reattach and resume-stream the missed messages. Serves several frontends like --multi-client")
+	outQueue     = flag.Int("outbound-queue", 0, "Queue up to this many messages for a frontend reading slowly instead of waiting for each write")
+	overflow     = flag.String("overflow", "block", "What to do when the outbound queue is full: block, or drop-chunks to drop the oldest chunks")
+	toolEnv      = flag.Bool("tool-environment", false, "Send the user, working directory, environment subset and duration of tool calls with their results. They are always logged")
+	heartbeat    = flag.Duration("heartbeat", 0, "Ping the frontend at this interval and exit if it sends nothing, not even a pong, for three intervals. No pings if 0")
+	elicitArgs   = flag.Bool("elicit-args", false, "Ask the frontend for required arguments missing in tool calls instead of letting the calls fail. Connects the bridge to the MCP servers itself")
+	validateArgs = flag.Bool("validate-tool-args", false, "Check tool calls against the input schemas of the tools, repairing or rejecting invalid ones before they run. Connects the bridge to the MCP servers itself")
+	repairModel  = flag.String("repair-model", "", "Model asked to fix tool arguments that fail --validate-tool-args before the call is rejected. None if not set")
+	toolSummary  = flag.String("tool-summary-model", "", "Model writing a plain summary of tool calls to confirm that have no summary template. None if not set")
+	auditLog     = flag.String("audit-log", "", "Append every tool call, with its arguments, decision, result status and duration, to this file as JSON lines")
+	maxResult    = flag.Int("max-result-text", 0, "Cut the text of tool results sent to the frontend to this many bytes per content item. Sent whole if 0")
+	autoApprove  = listFlag("auto-approve", "*", "Run tools without asking, for unattended use. Given alone all tools, or those matching a comma separated list of patterns like --auto-approve=fs:read_*,fetch__fetch. Policies still deny tools")
+	asyncTools   = flag.String("async-tools", "", "Comma separated patterns of tools to run in the background, like --async-tools=zypper__update, so the chat goes on while they run")
+	asyncFollow  = flag.Bool("async-follow-up", false, "Let the model go on with the results of tools run in the background once they finish")
+	readOnly     = flag.Bool("auto-approve-read-only", false, "Run tools their MCP server annotates as read-only without asking, unless a policy denies them. Connects the bridge to the MCP servers itself")
+	historyFile  = flag.String("history-file", "", "Save the conversation to this file after every prompt, for --resume or resume-session after a restart. Not saved if not set")
+	resume       = flag.Bool("resume", false, "Go on with the conversation saved in --history-file")
+	ctxWindow    = flag.Int("context-window", 0, "Tokens of the context of the model, to warn the frontend when the conversation fills it. No warnings if 0")
+	ctxWarnings  = flag.String("context-warnings", "70,90", "Comma separated percentages of --context-window to warn at, the last one urging a new session")
+	compactAt    = flag.Int("compact-at", 0, "Summarize older turns when the conversation takes this percentage of --context-window. Never if 0")
+	maxInput     = flag.Int("max-input-tokens", 0, "Refuse prompts that would send the model more tokens with the conversation, for metered providers. No limit if 0")
+	maxOutput    = flag.Int("max-output-tokens", 0, "Cut off responses longer than this many tokens. No limit if 0")
+	maxSession   = flag.Int("max-session-tokens", 0, "Refuse prompts once a session has sent to and received from the model this many tokens. No limit if 0")
+	injGuard     = flag.Bool("injection-guard", false, "Guard against prompt injection: run tool calls through the bridge to set their results off as data, and have further tool calls of a prompt confirmed after a tool returned what looks like instructions to the model. Results of tools the bridge cannot reach itself go to the model as they are")
+	maxMessage   = flag.Int("max-message-size", 0, "Skip messages from the frontend larger than this many bytes, telling it with an error. 32 MiB if 0")
+	captureOut   = flag.Bool("capture-output", false, "Log what the SDK, provider clients and MCP servers print to stdout or stderr, instead of it breaking the protocol or getting lost. Implies --strict-stdout")
+	strictOut    = flag.Bool("strict-stdout", false, "Keep anything but protocol messages off stdout, logging stray output of the SDK or MCP servers instead, and write crashes to --log-file too")
+	lowMemory    = flag.Bool("low-memory", false, "Save memory on small devices: short history, no cached helper hosts, mcphost started on the first prompt")
+	warmup       = flag.Bool("warmup", false, "Load Ollama models at startup instead of on the first prompt")
+	admin        = flag.Bool("admin", false, "Allow the frontend to change the log level, toggle metrics, run a self-test, restart MCP servers and delete models")
+	teamApproval = flag.String("team-approvals", "", "Tool decisions shared by a team, as a JSON file like the approvals file, a directory of them or an http(s) URL")
+	telemetry    = flag.Bool("telemetry", false, "Count prompts, model providers and tool risk classes, never content, into anonymized daily reports in a local spool directory")
+	telemetryDir = flag.String("telemetry-dir", "", "Spool directory of the telemetry reports. Defaults to the user cache directory")
 )
 
-const (
-	msgTypeReady          = "ready"                // inform remote that we are ready for a prompt
-	msgTypePrompt         = "prompt"               // remote is sending a prompt message
-	msgTypeQuit           = "quit"                 // remote is sending a quit message
-	msgTypeChunk          = "chunk"                // a chunk in a streaming response to remote
-	msgTypeConfirm        = "confirm-tool-run"     // ask remote for permission to run a tool
-	msgTypeAllow          = "allow-tool-run"       // remote gives permission to run tool
-	msgTypeDeny           = "deny-tool-run"        // remote denies permission to run tool
-	msgTypeResultOK       = "tool-result-ok"       // inform remote that the tool ran okay
-	msgTypeResultFailed   = "tool-result-failed"   // inform remote that the tool run failed
-	msgTypeResultCanceled = "tool-result-canceled" // inform remote that the tool call was canceled
-)
+// listValue is a flag taking a list, given alone it takes all.
+type listValue struct {
+	list  string
+	all   string
+	alone bool // given without a value
+}
+
+func (v *listValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.list
+}
+
+func (v *listValue) Set(s string) error {
+	switch s {
+	case "true":
+		s, v.alone = v.all, true
+	case "false":
+		s = ""
+	}
+	v.list = s
+	return nil
+}
+
+func (v *listValue) IsBoolFlag() bool { return true }
+
+// listFlag defines a list flag, set to all if given without a value.
+func listFlag(name, all, usage string) *listValue {
+	v := &listValue{all: all}
+	flag.Var(v, name, usage)
+	return v
+}
 
-type Message struct {
-	MsgType string `json:"msg_type"`
-	Content string `json:"content"`
+// findConfigFile returns name if it was given or exists, otherwise the first
+// mcphost configuration found in the user's config directory or home.
+func findConfigFile(name string) string {
+	given := false
+	flag.Visit(func(f *flag.Flag) { given = given || f.Name == "config-file" })
+	if _, err := os.Stat(name); given || err == nil {
+		return name
+	}
+	var candidates []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "mcphost-cockpit", name))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".mcphost.json"), filepath.Join(home, ".mcphost.yml"))
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			slog.Debug("using config file", "path", path)
+			return path
+		}
+	}
+	return name
 }
 
-func (m Message) String() string {
-	s := "MsgType: " + m.MsgType
-	if m.Content != "" {
-		s += ", Content: " + m.Content
+// captureOutput makes std, os.Stdout or os.Stderr, carry nothing but what is
+// written to the file it returns. Anything else written to it, like prints
+// of the SDK, the provider clients or MCP servers sharing it, is logged with
+// msg at level line by line. Lines redrawn with carriage returns, like
+// progress bars, are logged each time.
+func captureOutput(std *os.File, msg string, level slog.Level) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := redirectOutput(std, w)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
 	}
-	return s
+	if std == os.Stdout {
+		os.Stdout = w
+	} else {
+		os.Stderr = w
+	}
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			for _, line := range strings.Split(scanner.Text(), "\r") {
+				if strings.TrimSpace(line) != "" {
+					slog.Log(context.Background(), level, msg, "line", line)
+				}
+			}
+		}
+	}()
+	return out, nil
 }
 
-func recvMessage(scanner *bufio.Scanner) (Message, error) {
-	msg := Message{}
-	if !scanner.Scan() {
-		return msg, scanner.Err()
+// runModelCommand runs the pull-model or delete-model command, reporting
+// whether args are one.
+func runModelCommand(args []string) bool {
+	if len(args) == 0 || args[0] != "pull-model" && args[0] != "delete-model" {
+		return false
+	}
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: mcphost-cockpit %s MODEL\n", args[0])
+		os.Exit(2)
 	}
-	b := scanner.Bytes()
-	err := json.Unmarshal(b, &msg)
-	if err == nil {
-		slog.Debug("received from stdin", "Message", msg)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	var err error
+	if args[0] == "pull-model" {
+		err = bridge.PullModel(ctx, args[1], os.Stdout)
+	} else {
+		err = bridge.DeleteModel(ctx, args[1])
 	}
-	return msg, err
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		cancel()
+		os.Exit(1)
+	}
+	return true
 }
 
-func sendMessage(w io.Writer, msg Message) error {
-	slog.Debug("sending to stdout", "Message", msg)
-	return json.NewEncoder(w).Encode(msg) // appends a newline
+// checkArgs fails on arguments that are no command. A list flag given alone
+// takes all, so a list following it with a space instead of = would run as
+// the command and widen the flag instead.
+func checkArgs() error {
+	if flag.NArg() == 0 {
+		return nil
+	}
+	if autoApprove.alone {
+		return fmt.Errorf("--auto-approve given alone runs all tools, to run only %s give --auto-approve=%[1]s instead", flag.Arg(0))
+	}
+	switch flag.Arg(0) {
+	case "pull-model", "delete-model", "eval":
+		return nil
+	}
+	return fmt.Errorf("unexpected argument %q", flag.Arg(0))
 }
 
 func main() {
 	flag.Parse()
-	if *model == "" {
-		fmt.Fprintf(os.Stderr, "Model must be set.\n")
+	if err := checkArgs(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s.\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if runModelCommand(flag.Args()) {
+		return
+	}
+	conf := bridge.Config{
+		Model:               *model,
+		ConfigFile:          findConfigFile(*configFile),
+		SystemPrompt:        *systemPrompt,
+		Compress:            *compress,
+		CompressMinSize:     *compressMin,
+		BridgeConfigFile:    *bridgeFile,
+		MaxParallelTools:    *maxParallel,
+		PolicyFile:          *policyFile,
+		ToolPolicyFile:      *toolPolicy,
+		PolicyQuery:         *policyQuery,
+		FilterCmd:           *filterCmd,
+		EmbeddingModel:      *embedModel,
+		SummaryModel:        *summaryModel,
+		CircuitThreshold:    *circuitMax,
+		CircuitCooldown:     *circuitWait,
+		Preset:              *preset,
+		PlanFirst:           *planFirst,
+		ApprovalsFile:       *approvalFile,
+		ArtifactsDir:        *artifactsDir,
+		CodeArtifacts:       *codeBlocks,
+		MaxChunksPerSecond:  *maxChunkRate,
+		ChunkBoundary:       *chunkBound,
+		DetectTextToolCalls: *textTools,
+		SimulateStreaming:   *simStream,
+		EmulateTools:        *emulateTools,
+		LowMemory:           *lowMemory,
+		Warmup:              *warmup,
+		Admin:               *admin,
+		TeamApprovals:       *teamApproval,
+		Telemetry:           *telemetry,
+		TelemetryDir:        *telemetryDir,
+		ReattachGrace:       *reattach,
+		OutboundQueue:       *outQueue,
+		Overflow:            *overflow,
+		ToolEnvironment:     *toolEnv,
+		Heartbeat:           *heartbeat,
+		ElicitArgs:          *elicitArgs,
+		ValidateArgs:        *validateArgs,
+		RepairModel:         *repairModel,
+		AuditLog:            *auditLog,
+		ToolSummaryModel:    *toolSummary,
+		MaxResultText:       *maxResult,
+		MaxMessageSize:      *maxMessage,
+		HistoryFile:         *historyFile,
+		Resume:              *resume,
+		ContextWindow:       *ctxWindow,
+		ContextWarnings:     *ctxWarnings,
+		CompactAt:           *compactAt,
+		MaxInputTokens:      *maxInput,
+		MaxOutputTokens:     *maxOutput,
+		MaxSessionTokens:    *maxSession,
+		InjectionGuard:      *injGuard,
+		AutoApproveReadOnly: *readOnly,
+		AutoApprove:         autoApprove.list,
+		AsyncTools:          *asyncTools,
+		AsyncFollowUp:       *asyncFollow,
+		Verbosity:           *verbosity,
+		FirstTokenSLO:       *firstTokSLO,
+	}
+	if err := conf.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s.\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
+	logLevel := &slog.LevelVar{}
 	if *debug {
+		logLevel.Set(slog.LevelDebug)
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
+	conf.SetLogLevel = func(level slog.Level) { slog.SetLogLoggerLevel(level) }
+	logging := false // to a file
 	if *logFile != "" {
 		f, err := os.Create(*logFile)
 		if err != nil {
@@ -83,123 +311,111 @@ func main() {
 			slog.Info("Using stderr for logging")
 		} else {
 			defer f.Close()
-			logLevel := slog.LevelInfo
-			if *debug {
-				logLevel = slog.LevelDebug
-			}
+			logging = true
 			logger := slog.New(slog.NewTextHandler(f, &slog.HandlerOptions{Level: logLevel}))
 			slog.SetDefault(logger)
+			conf.SetLogLevel = logLevel.Set
+			if *strictOut || *captureOut {
+				// panics go to stderr, which Cockpit ignores
+				if err := runtimedebug.SetCrashOutput(f, runtimedebug.CrashOptions{}); err != nil {
+					slog.Warn("Cannot write crashes to", "logFile", *logFile, "error", err)
+				}
+			}
 		}
 	}
-
-	options := sdk.Options{
-		Model:        *model,
-		ConfigFile:   *configFile,
-		SystemPrompt: *systemPrompt,
-		Streaming:    true,
-		Quiet:        true,
+	if *captureOut {
+		f, err := captureOutput(os.Stderr, "output on stderr", slog.LevelInfo)
+		if err != nil {
+			slog.Error("capturing stderr", "error", err)
+			os.Exit(1)
+		}
+		if !logging { // on to stderr, the logger must not write to the pipe
+			slog.SetDefault(slog.New(slog.NewTextHandler(f, &slog.HandlerOptions{Level: logLevel})))
+			conf.SetLogLevel = logLevel.Set
+		}
 	}
-	slog.Debug("sdk config", "options", options)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	host, err := sdk.New(ctx, &options)
-	if err != nil {
-		slog.Error("creating MCPHost", "error", err)
-		os.Exit(1)
+	var stdout io.Writer = os.Stdout
+	if *strictOut || *captureOut {
+		f, err := captureOutput(os.Stdout, "stray output on stdout", slog.LevelWarn)
+		if err != nil {
+			slog.Error("keeping stdout for the protocol", "error", err)
+			os.Exit(1)
+		}
+		stdout = f
 	}
 
-	err = chatLoop(ctx, host)
+	b, err := bridge.New(conf, bridge.NewSDKHost)
 	if err != nil {
-		slog.Error("chatLoop", "error", err)
-		cancel()
+		slog.Error("setting up bridge", "error", err)
 		os.Exit(1)
 	}
-}
-
-func chatLoop(ctx context.Context, host *sdk.MCPHost) error {
-	defer host.Close()
 
-	scanner := bufio.NewScanner(os.Stdin)
-
-	for {
-		err := sendMessage(os.Stdout, Message{MsgType: msgTypeReady})
-		if err != nil {
-			return err
+	// Cockpit ends the bridge with a signal if the page is closed
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if flag.Arg(0) == "eval" {
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: mcphost-cockpit [flags] eval SUITE")
+			os.Exit(2)
 		}
-
-		msg, err := recvMessage(scanner)
+		passed, err := b.Eval(ctx, flag.Arg(1), stdout)
+		b.Close()
+		cancel()
 		if err != nil {
-			return err
+			slog.Error("running eval", "error", err)
+			os.Exit(1)
 		}
-		switch msg.MsgType {
-		case msgTypeQuit:
-			return nil
-		case msgTypePrompt:
-			err = handlePrompt(ctx, msg.Content, host, scanner)
-			if err != nil {
-				return err
-			}
-		default:
-			slog.Warn("expected prompt or quit, got", "MsgType", msg.MsgType)
+		if !passed {
+			os.Exit(1)
 		}
+		return
+	}
+	host, err := b.DefaultHost(ctx)
+	if err != nil {
+		slog.Error("creating MCPHost", "error", err)
+		os.Exit(1)
 	}
-}
-
-func handlePrompt(ctx context.Context, prompt string, host *sdk.MCPHost, scanner *bufio.Scanner) error {
-	promptCanceled := false
-	promptCtx, cancelPrompt := context.WithCancel(ctx)
 
-	_, err := host.PromptWithCallbacks(
-		promptCtx,
-		prompt,
-		func(name, args string) { // onToolCall callback
-			details := fmt.Sprintf("Run tool: %s with args: %s", name, args)
-			err := sendMessage(os.Stdout, Message{MsgType: msgTypeConfirm, Content: details})
-			if err != nil {
-				slog.Error("onToolcall: sending message", "err", err)
-			}
-			msg, err := recvMessage(scanner)
-			if err != nil {
-				slog.Error("onToolCall: receiving message", "err", err)
-			}
-			switch msg.MsgType {
-			case msgTypeDeny:
-				promptCanceled = true
-				cancelPrompt()
-			case msgTypeAllow:
-				return
-			default:
-				slog.Warn("onToolCall: expected allow or deny, got:", "MsgType", msg.MsgType)
-			}
-		},
-		func(name, args, result string, isError bool) { // onToolResult callback
-			if isError {
-				err := sendMessage(os.Stdout, Message{MsgType: msgTypeResultFailed, Content: name})
-				if err != nil {
-					slog.Error("onToolResult: sending message", "err", err)
-				}
-				return
-			}
-			if errors.Is(promptCtx.Err(), context.Canceled) {
-				err := sendMessage(os.Stdout, Message{MsgType: msgTypeResultCanceled, Content: name})
-				if err != nil {
-					slog.Error("onToolResult: sending message", "err", err)
-				}
-				return
-			}
-			err := sendMessage(os.Stdout, Message{MsgType: msgTypeResultOK, Content: name})
+	var in io.Reader = os.Stdin
+	var out io.Writer = stdout
+	var run func() error
+	if *listen != "" {
+		// jobs run while waiting for the frontend as well
+		if err := b.StartJobs(ctx); err != nil {
+			slog.Error("starting jobs", "error", err)
+			os.Exit(1)
+		}
+		if *multiClient || *reattach > 0 {
+			accept, stop, err := listenFrontends(*listen)
 			if err != nil {
-				slog.Error("onToolResult: sending message", "err", err)
+				slog.Error("listening for frontends", "listen", *listen, "error", err)
+				os.Exit(1)
 			}
-		},
-		func(chunk string) { // onStreaming callback
-			err := sendMessage(os.Stdout, Message{MsgType: msgTypeChunk, Content: chunk})
+			defer stop()
+			run = func() error { return b.Serve(ctx, host, accept) }
+		} else {
+			conn, err := acceptFrontend(*listen)
 			if err != nil {
-				slog.Error("onStreaming: sending message", "err", err)
+				slog.Error("waiting for frontend", "listen", *listen, "error", err)
+				os.Exit(1)
 			}
-		})
-	if err != nil && !promptCanceled {
-		return err
+			defer conn.Close()
+			in, out = conn, conn
+		}
+	}
+
+	if run == nil {
+		run = func() error { return b.Run(ctx, host, in, out) }
+	}
+	err = run()
+	b.Close() // stops the MCP servers
+	if errors.Is(err, bridge.ErrConnectionLost) || ctx.Err() != nil {
+		slog.Info("frontend went away, exiting", "error", err)
+		cancel()
+		os.Exit(0)
+	}
+	if err != nil {
+		slog.Error("chatLoop", "error", err)
+		cancel()
+		os.Exit(1)
 	}
-	return nil
 }
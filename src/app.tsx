@@ -49,7 +49,8 @@ export const Application = () => {
       } else if (msg.msg_type === 'chunk') {
         setOutput(prev => prev + msg.content);
       } else if (msg.msg_type === 'confirm-tool-run') {
-        setOutput(prev => prev + `\n[TOOL]: ${msg.content}\n`);
+        const summary = msg.meta?.summary ? `${msg.meta.summary}\n` : '';
+        setOutput(prev => prev + `\n[TOOL]: ${summary}${msg.content}\n`);
         setToolRequest(msg.content);
       } else if (msg.msg_type === 'tool-result-ok') {
         setOutput(prev => prev + `[TOOL OK]: ${msg.content}\n`);
@@ -57,6 +58,10 @@ export const Application = () => {
         setOutput(prev => prev + `[TOOL FAILED]: ${msg.content}\n`);
       } else if (msg.msg_type === 'tool-result-canceled') {
         setOutput(prev => prev + `[TOOL CANCELED]: ${msg.content}\n`);
+      } else if (msg.msg_type === 'goodbye') {
+        const bye = JSON.parse(msg.content);
+        setOutput(prev => prev + `\n[BRIDGE EXITED]: ${bye.reason}${bye.message ? ': ' + bye.message : ''}\n`);
+        setIsReady(false);
       }
       // Other message types are received but not shown.
     };
@@ -123,6 +128,15 @@ export const Application = () => {
     }
   };
 
+  const newChat = () => {
+    if (!process || !isReady) return;
+
+    // The bridge keeps running with its MCP servers, only the conversation starts anew
+    process.input(JSON.stringify({ msg_type: 'clear-context', content: '' }) + '\n', true);
+    setOutput('');
+    setIsReady(false);
+  };
+
   const handleToolResponse = (allow) => {
     if (process && toolRequest) {
       const msgType = allow ? 'allow-tool-run' : 'deny-tool-run';
@@ -164,6 +178,11 @@ export const Application = () => {
               {_("Send")}
             </Button>
           </FlexItem>
+          <FlexItem>
+            <Button variant="secondary" onClick={newChat} disabled={!process || !isReady}>
+              {_("New chat")}
+            </Button>
+          </FlexItem>
         </Flex>
       </StackItem>
       <StackItem>
@@ -0,0 +1,57 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// acceptFrontend waits for one frontend to connect to the unix socket at
+// path, which only the user may use.
+func acceptFrontend(path string) (io.ReadWriteCloser, error) {
+	accept, stop, err := listenFrontends(path)
+	if err != nil {
+		return nil, err
+	}
+	defer stop() // also removes the socket file
+	return accept()
+}
+
+// listenFrontends listens on the unix socket at path, which only the user
+// may use, for any number of frontends until stop is called.
+func listenFrontends(path string) (accept func() (io.ReadWriteCloser, error), stop func() error, err error) {
+	err = os.Remove(path) // left over from a previous run
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	// the socket is created with the permissions of the umask, so it must
+	// not be usable by others even before a chmod
+	umask := unix.Umask(0o177)
+	l, err := net.Listen("unix", path)
+	unix.Umask(umask)
+	if err != nil {
+		return nil, nil, err
+	}
+	accept = func() (io.ReadWriteCloser, error) { return l.Accept() }
+	return accept, l.Close, nil
+}
+
+// redirectOutput points the file descriptor of std, os.Stdout or os.Stderr,
+// to w and returns a file writing to where it pointed before.
+func redirectOutput(std, w *os.File) (*os.File, error) {
+	fd, err := unix.Dup(int(std.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Dup2(int(w.Fd()), int(std.Fd())); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), std.Name()), nil
+}
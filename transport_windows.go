@@ -0,0 +1,94 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const pipePrefix = `\\.\pipe\`
+
+// acceptFrontend waits for one frontend to connect to the named pipe name,
+// the Windows counterpart of a unix socket, which only the user may use. The
+// prefix \\.\pipe\ is added if name lacks it.
+func acceptFrontend(name string) (io.ReadWriteCloser, error) {
+	return connectPipe(pipeName(name), windows.FILE_FLAG_FIRST_PIPE_INSTANCE, 1)
+}
+
+// listenFrontends creates an instance of the named pipe name for every
+// frontend accept waits for. Waiting cannot be interrupted, stop does
+// nothing and the pipe goes away with the process.
+func listenFrontends(name string) (accept func() (io.ReadWriteCloser, error), stop func() error, err error) {
+	name = pipeName(name)
+	first := uint32(windows.FILE_FLAG_FIRST_PIPE_INSTANCE)
+	accept = func() (io.ReadWriteCloser, error) {
+		conn, err := connectPipe(name, first, windows.PIPE_UNLIMITED_INSTANCES)
+		first = 0
+		return conn, err
+	}
+	return accept, func() error { return nil }, nil
+}
+
+func pipeName(name string) string {
+	if !strings.HasPrefix(name, pipePrefix) {
+		name = pipePrefix + name
+	}
+	return name
+}
+
+// ownerOnly returns security attributes for a pipe granting access to the
+// user of the process only, instead of the default ones that let everyone
+// read it.
+func ownerOnly() (*windows.SecurityAttributes, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	sd, err := windows.SecurityDescriptorFromString("D:P(A;;GA;;;" + user.User.Sid.String() + ")")
+	if err != nil {
+		return nil, err
+	}
+	return &windows.SecurityAttributes{Length: uint32(unsafe.Sizeof(windows.SecurityAttributes{})), SecurityDescriptor: sd}, nil
+}
+
+func connectPipe(name string, flags, instances uint32) (io.ReadWriteCloser, error) {
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	sa, err := ownerOnly()
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateNamedPipe(path,
+		windows.PIPE_ACCESS_DUPLEX|flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		instances, 64*1024, 64*1024, 0, sa)
+	if err != nil {
+		return nil, err
+	}
+	err = windows.ConnectNamedPipe(h, nil)
+	if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
+
+// redirectOutput makes w the standard handle of std, os.Stdout or os.Stderr,
+// and returns a file writing to the one before.
+func redirectOutput(std, w *os.File) (*os.File, error) {
+	handle := uint32(windows.STD_OUTPUT_HANDLE)
+	if std == os.Stderr {
+		handle = uint32(windows.STD_ERROR_HANDLE)
+	}
+	if err := windows.SetStdHandle(handle, windows.Handle(w.Fd())); err != nil {
+		return nil, err
+	}
+	return std, nil
+}